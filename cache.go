@@ -0,0 +1,126 @@
+package chord
+
+import (
+	"sync"
+	"time"
+)
+
+// Caches the results of Lookup by key position. Entries expire after
+// the TTL, and are invalidated when a local vnode learns of a change
+// to the ring that affects them. Changes elsewhere in the ring are not
+// seen, so results may be stale for up to the TTL. A nil cache caches
+// nothing.
+type lookupCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*cacheEntry
+}
+
+type cacheEntry struct {
+	key    []byte
+	n      int
+	succs  []*Vnode
+	expiry time.Time
+}
+
+func (lc *lookupCache) init(ttl time.Duration, size int) {
+	lc.ttl = ttl
+	lc.size = max(size, 1)
+	lc.entries = make(map[string]*cacheEntry)
+}
+
+// Returns up to n cached successors of a key position, or nil
+func (lc *lookupCache) get(key []byte, n int) []*Vnode {
+	if lc == nil {
+		return nil
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	e, ok := lc.entries[string(key)]
+	if !ok {
+		return nil
+	}
+	if time.Now().After(e.expiry) {
+		delete(lc.entries, string(key))
+		return nil
+	}
+	if n > e.n {
+		return nil
+	}
+	res := make([]*Vnode, min(n, len(e.succs)))
+	copy(res, e.succs)
+	return res
+}
+
+// Caches the successors found for a key position
+func (lc *lookupCache) put(key []byte, n int, succs []*Vnode) {
+	if lc == nil {
+		return
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+
+	// Make room, preferring to drop expired entries
+	if _, ok := lc.entries[string(key)]; !ok && len(lc.entries) >= lc.size {
+		now := time.Now()
+		var victim string
+		for k, e := range lc.entries {
+			victim = k
+			if now.After(e.expiry) {
+				break
+			}
+		}
+		delete(lc.entries, victim)
+	}
+
+	cp := make([]*Vnode, len(succs))
+	copy(cp, succs)
+	lc.entries[string(key)] = &cacheEntry{
+		key:    key,
+		n:      n,
+		succs:  cp,
+		expiry: time.Now().Add(lc.ttl),
+	}
+}
+
+// Invalidates the entries for keys in the range (start, end]
+func (lc *lookupCache) invalidateRange(start, end []byte) {
+	if lc == nil {
+		return
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	for k, e := range lc.entries {
+		if betweenRightIncl(start, end, e.key) {
+			delete(lc.entries, k)
+		}
+	}
+}
+
+// Invalidates the entries with a given vnode as a successor
+func (lc *lookupCache) invalidateVnode(vn *Vnode) {
+	if lc == nil {
+		return
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	for k, e := range lc.entries {
+		for _, s := range e.succs {
+			if s.Equal(vn) {
+				delete(lc.entries, k)
+				break
+			}
+		}
+	}
+}
+
+// Invalidates every entry
+func (lc *lookupCache) clear() {
+	if lc == nil {
+		return
+	}
+	lc.lock.Lock()
+	defer lc.lock.Unlock()
+	lc.entries = make(map[string]*cacheEntry)
+}
@@ -0,0 +1,99 @@
+package chord
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLookupCache(t *testing.T) {
+	lc := &lookupCache{}
+	lc.init(time.Minute, 2)
+	a := &Vnode{Id: []byte{10}, Host: "a"}
+	b := &Vnode{Id: []byte{20}, Host: "b"}
+
+	lc.put([]byte{5}, 2, []*Vnode{a, b})
+	if res := lc.get([]byte{5}, 1); len(res) != 1 || res[0] != a {
+		t.Fatalf("bad cached result. %v", res)
+	}
+	if res := lc.get([]byte{5}, 3); res != nil {
+		t.Fatalf("expected miss for larger n")
+	}
+	if res := lc.get([]byte{6}, 1); res != nil {
+		t.Fatalf("expected miss")
+	}
+
+	// The size is bounded
+	lc.put([]byte{15}, 1, []*Vnode{b})
+	lc.put([]byte{25}, 1, []*Vnode{a})
+	if len(lc.entries) != 2 {
+		t.Fatalf("expected 2 entries, got %d", len(lc.entries))
+	}
+
+	// Invalidate by range and by vnode
+	lc.clear()
+	lc.put([]byte{5}, 1, []*Vnode{a})
+	lc.put([]byte{15}, 1, []*Vnode{b})
+	lc.invalidateRange([]byte{10}, []byte{20})
+	if lc.get([]byte{15}, 1) != nil || lc.get([]byte{5}, 1) == nil {
+		t.Fatalf("bad range invalidation")
+	}
+	lc.invalidateVnode(a)
+	if lc.get([]byte{5}, 1) != nil {
+		t.Fatalf("bad vnode invalidation")
+	}
+
+	// Entries expire
+	lc.ttl = time.Millisecond
+	lc.put([]byte{5}, 1, []*Vnode{a})
+	time.Sleep(2 * time.Millisecond)
+	if lc.get([]byte{5}, 1) != nil {
+		t.Fatalf("expected expired entry")
+	}
+
+	// A nil cache caches nothing
+	var nc *lookupCache
+	nc.put([]byte{5}, 1, []*Vnode{a})
+	if nc.get([]byte{5}, 1) != nil {
+		t.Fatalf("expected miss")
+	}
+}
+
+func TestRingLookupCache(t *testing.T) {
+	conf := fastConf()
+	conf.ManualStabilize = true
+	conf.LookupCacheTTL = time.Minute
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	r.Stabilize()
+
+	first, err := r.Lookup(1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(r.cache.entries) != 1 {
+		t.Fatalf("expected cached lookup")
+	}
+	second, err := r.Lookup(1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if second[0] != first[0] {
+		t.Fatalf("bad cached result")
+	}
+
+	// A new predecessor of the owner invalidates the lookup
+	var owner *localVnode
+	for _, vn := range r.vnodes {
+		if vn.Vnode.Equal(first[0]) {
+			owner = vn
+		}
+	}
+	pos, _ := r.keyPosition([]byte("foo"))
+	owner.Notify(&Vnode{Id: pos, Host: "remote"}, nil)
+	if len(r.cache.entries) != 0 {
+		t.Fatalf("expected invalidated lookup")
+	}
+}
@@ -5,28 +5,95 @@ Chord network protocol.
 package chord
 
 import (
+	"bytes"
+	"context"
 	"crypto/sha1"
+	"encoding/gob"
+	"errors"
 	"fmt"
 	"hash"
+	"io"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Implements the methods needed for a Chord ring
+// ErrNoLiveSuccessors is returned by Lookup when no live successors
+// of the key could be found
+var ErrNoLiveSuccessors = errors.New("No live successors found!")
+
+// ErrEmptyKey is returned by Lookup and ClientLookup for an empty key.
+// Empty keys are rejected instead of being placed at the hash of the
+// empty input, since they are almost always a bug in the caller.
+var ErrEmptyKey = errors.New("Cannot lookup an empty key!")
+
+// ErrRemoteHop is returned by LookupLocal when the successors of the
+// key are not known locally, and a remote vnode would need to be asked
+var ErrRemoteHop = errors.New("Lookup would need a remote hop!")
+
+// ErrInsufficientSuccessors is wrapped by the error returned by Lookup
+// when fewer than n successors were found, but the ring has more vnodes,
+// such as when some successors have failed. The successors that were
+// found are returned along with the error. If the ring simply has fewer
+// than n vnodes, the short result is returned without an error.
+var ErrInsufficientSuccessors = errors.New("Insufficient successors found!")
+
+// ErrSkipSuccessor and ErrClearPredecessor wrap the errors returned by
+// Leave when a vnode failed to have its predecessor skip it, or its
+// successor clear it. Leave joins the errors of every vnode with
+// errors.Join, so each failure can be checked with errors.Is and the
+// underlying transport error with errors.As.
+var (
+	ErrSkipSuccessor    = errors.New("Failed to skip successor!")
+	ErrClearPredecessor = errors.New("Failed to clear predecessor!")
+)
+
+// ErrPredecessorRejected wraps the error returned by Notify when the
+// Config.AcceptPredecessor of the vnode refused the notifying vnode
+var ErrPredecessorRejected = errors.New("Predecessor rejected!")
+
+// ErrVnodeDraining wraps the error returned by a vnode that has started
+// to leave, refusing to serve lookups and stabilization over the
+// network. The request may be retried with another vnode.
+var ErrVnodeDraining = errors.New("Vnode is draining!")
+
+// Implements the methods needed for a Chord ring. A transport may also
+// implement Deregister(*Vnode), to stop serving the vnodes of a ring
+// once it has been shutdown, ListVnodesInRange(host, start, end),
+// to list only the vnodes of a host with IDs in (start, end],
+// TracingTransport, to trace the path of a lookup, and LoadTransport,
+// to exchange the load of each host on Notify.
 type Transport interface {
 	// Gets a list of the vnodes on the box
 	ListVnodes(string) ([]*Vnode, error)
 
-	// Ping a Vnode, check for liveness
+	// Ping a Vnode, check for liveness. Returns true if the vnode is
+	// alive, and false without an error if the host was reached but the
+	// vnode is confirmed dead. An error is returned if the host could
+	// not be reached, in which case the vnode state is unknown.
 	Ping(*Vnode) (bool, error)
 
+	// Ping a list of vnodes, using a single request per host. Returns
+	// the liveness of each vnode, in order. Vnodes on a host that could
+	// not be reached are reported dead, and the error is also returned.
+	BatchPing([]*Vnode) ([]bool, error)
+
 	// Request a nodes predecessor
 	GetPredecessor(*Vnode) (*Vnode, error)
 
-	// Notify our successor of ourselves
-	Notify(target, self *Vnode) ([]*Vnode, error)
+	// Notify our successor of ourselves, along with an optional payload.
+	// Returns the successor list and payload of the target.
+	Notify(target, self *Vnode, payload []byte) ([]*Vnode, []byte, error)
 
-	// Find a successor
-	FindSuccessors(*Vnode, int, []byte) ([]*Vnode, error)
+	// Find the successors of a key. The vnodes that have already
+	// forwarded the request are passed on, to detect routing loops.
+	// Returns the successors, and the path of vnodes that handled the
+	// request, ending with the vnode that answered. Unless the lookup is
+	// traced, the path may only hold the visited vnodes followed by the
+	// vnode that answered.
+	FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error)
 
 	// Clears a predecessor if it matches a given vnode. Used to leave.
 	ClearPredecessor(target, self *Vnode) error
@@ -34,20 +101,173 @@ type Transport interface {
 	// Instructs a node to skip a given successor. Used to leave.
 	SkipSuccessor(target, self *Vnode) error
 
+	// Request the health of a vnode
+	Health(*Vnode) (*VnodeHealth, error)
+
 	// Register for an RPC callbacks
 	Register(*Vnode, VnodeRPC)
 }
 
+// Implemented by transports that can stop serving a registered vnode
+type deregisterer interface {
+	Deregister(*Vnode)
+}
+
+// Implemented by vnodes that refuse routing requests while leaving
+type drainer interface {
+	isDraining() bool
+}
+
+// Implemented by transports that know if vnodes of a host are
+// registered with them
+type registrar interface {
+	registered(host string) bool
+}
+
+// Implemented by transports that can list the vnodes of a host in a range
+type rangeLister interface {
+	ListVnodesInRange(host string, start, end []byte) ([]*Vnode, error)
+}
+
+// LoadTransport may optionally be implemented by a Transport that can
+// send the load of our host with Notify, apart from the payload, and
+// return the load of the target. A nil load is not reported. A transport
+// wrapping another should pass the load on, so that hosts keep
+// exchanging their loads.
+type LoadTransport interface {
+	Transport
+	NotifyLoad(target, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error)
+}
+
+// LoadVnodeRPC may optionally be implemented by a registered VnodeRPC
+// to exchange the load of its host on Notify. Transports that support
+// it use this method instead of Notify.
+type LoadVnodeRPC interface {
+	VnodeRPC
+	NotifyLoad(maybe_pred *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error)
+}
+
+// TracingTransport may optionally be implemented by a Transport that
+// can trace a lookup, returning every vnode that handled it instead of
+// only the one that answered. A transport wrapping another should pass
+// the trace flag on, so that traced lookups keep their full path.
+type TracingTransport interface {
+	Transport
+	FindSuccessorsTrace(vn *Vnode, n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error)
+}
+
+// TracingVnodeRPC may optionally be implemented by a registered VnodeRPC
+// to be told whether a lookup is traced, and pass that on when it
+// forwards the lookup. Transports that support it use this method
+// instead of FindSuccessors.
+type TracingVnodeRPC interface {
+	VnodeRPC
+	FindSuccessorsTrace(n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error)
+}
+
+// Finds the successors of a key through a transport, tracing the path
+// of the lookup if requested and supported by the transport
+func findSuccessorsTrace(trans Transport, vn *Vnode, n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	if pt, ok := trans.(TracingTransport); ok {
+		return pt.FindSuccessorsTrace(vn, n, key, visited, trace)
+	}
+	return trans.FindSuccessors(vn, n, key, visited)
+}
+
+// Passes a lookup onto a registered vnode, along with whether it is
+// traced if the vnode supports it
+func rpcFindSuccessorsTrace(obj VnodeRPC, n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	if pt, ok := obj.(TracingVnodeRPC); ok {
+		return pt.FindSuccessorsTrace(n, key, visited, trace)
+	}
+	return obj.FindSuccessors(n, key, visited)
+}
+
+// Notifies a target vnode, along with our load. If the transport cannot
+// send a load, the payload is sent alone and no load is returned.
+func notifyLoad(trans Transport, target, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	if ln, ok := trans.(LoadTransport); ok {
+		return ln.NotifyLoad(target, self, payload, load)
+	}
+	succs, resp, err := trans.Notify(target, self, payload)
+	return succs, resp, nil, err
+}
+
+// Passes a Notify onto a registered vnode, along with the load of the
+// notifying host if the vnode exchanges loads
+func rpcNotifyLoad(obj VnodeRPC, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	if ln, ok := obj.(LoadVnodeRPC); ok {
+		return ln.NotifyLoad(self, payload, load)
+	}
+	succs, resp, err := obj.Notify(self, payload)
+	return succs, resp, nil, err
+}
+
+// Lists the vnodes of a host with IDs in the range (start, end]. If the
+// transport cannot list a range, all the vnodes are listed and filtered.
+func listVnodesInRange(trans Transport, host string, start, end []byte) ([]*Vnode, error) {
+	if rl, ok := trans.(rangeLister); ok {
+		return rl.ListVnodesInRange(host, start, end)
+	}
+	vnodes, err := trans.ListVnodes(host)
+	if err != nil {
+		return nil, err
+	}
+	return filterRange(vnodes, start, end), nil
+}
+
+// Returns the vnodes with IDs in the range (start, end]
+func filterRange(vnodes []*Vnode, start, end []byte) []*Vnode {
+	var res []*Vnode
+	for _, vn := range vnodes {
+		if vn != nil && betweenRightIncl(start, end, vn.Id) {
+			res = append(res, vn)
+		}
+	}
+	return res
+}
+
 // These are the methods to invoke on the registered vnodes
 type VnodeRPC interface {
 	GetPredecessor() (*Vnode, error)
-	Notify(*Vnode) ([]*Vnode, error)
-	FindSuccessors(int, []byte) ([]*Vnode, error)
+	Notify(*Vnode, []byte) ([]*Vnode, []byte, error)
+	FindSuccessors(int, []byte, []*Vnode) ([]*Vnode, []*Vnode, error)
 	ClearPredecessor(*Vnode) error
 	SkipSuccessor(*Vnode) error
+	Health() (*VnodeHealth, error)
+}
+
+// ContextVnodeRPC may optionally be implemented by a registered VnodeRPC
+// to receive a context with each inbound RPC. Transports that support it
+// use these methods instead, with the address of the remote peer that
+// made the call available via RemoteAddrFromContext.
+type ContextVnodeRPC interface {
+	VnodeRPC
+	GetPredecessorContext(context.Context) (*Vnode, error)
+	NotifyContext(context.Context, *Vnode, []byte) ([]*Vnode, []byte, error)
+	FindSuccessorsContext(context.Context, int, []byte, []*Vnode) ([]*Vnode, []*Vnode, error)
+	ClearPredecessorContext(context.Context, *Vnode) error
+	SkipSuccessorContext(context.Context, *Vnode) error
+	HealthContext(context.Context) (*VnodeHealth, error)
+}
+
+// Key used to store the remote address in a context
+type remoteAddrKey struct{}
+
+// Returns a context carrying the address of the remote peer
+func withRemoteAddr(ctx context.Context, addr string) context.Context {
+	return context.WithValue(ctx, remoteAddrKey{}, addr)
+}
+
+// RemoteAddrFromContext returns the address of the remote peer that
+// made an inbound RPC, if the transport provided it
+func RemoteAddrFromContext(ctx context.Context) (string, bool) {
+	addr, ok := ctx.Value(remoteAddrKey{}).(string)
+	return addr, ok
 }
 
-// Delegate to notify on ring events
+// Delegate to notify on ring events. A delegate may also implement any
+// of the optional delegate interfaces below to receive more events.
 type Delegate interface {
 	NewPredecessor(local, remoteNew, remotePrev *Vnode)
 	Leaving(local, pred, succ *Vnode)
@@ -56,43 +276,219 @@ type Delegate interface {
 	Shutdown()
 }
 
+// RangeDelegate may optionally be implemented by a Delegate. The
+// NewPredecessorRange method is invoked along with NewPredecessor, with
+// the key range (transferStart, transferEnd] that now belongs to
+// remoteNew. If there was no previous predecessor, transferStart is our
+// own ID.
+type RangeDelegate interface {
+	NewPredecessorRange(local, remoteNew, remotePrev *Vnode, transferStart, transferEnd []byte)
+}
+
+// DrainDelegate may optionally be implemented by a Delegate. Draining
+// is invoked by Ring.DrainAndLeave for each local vnode before it
+// leaves, while it still serves requests.
+type DrainDelegate interface {
+	Draining(local, pred, succ *Vnode)
+}
+
+// FailureDelegate may optionally be implemented by a Delegate.
+// PeerFailed is invoked when a remote vnode is found to have failed.
+type FailureDelegate interface {
+	PeerFailed(local, dead *Vnode)
+}
+
+// IsolationDelegate may optionally be implemented by a Delegate.
+// Isolated is invoked when every successor of a vnode is on the local
+// host, and Joined when it has a remote successor again. A new ring
+// starts isolated, so Joined is invoked once a joined ring stabilizes.
+type IsolationDelegate interface {
+	Isolated(local *Vnode)
+	Joined(local *Vnode)
+}
+
+// ReclaimDelegate may optionally be implemented by a Delegate.
+// ReclaimRange is invoked after Ring.Rejoin, with the key range
+// (start, end] that a local vnode takes back from the remote vnode
+// that owned it while we were away, so its data can be pulled back.
+type ReclaimDelegate interface {
+	ReclaimRange(local *Vnode, start, end []byte, from *Vnode)
+}
+
+// PayloadDelegate may optionally be implemented by a Delegate.
+// NotifyPayload is invoked with the payload set by a remote vnode with
+// Ring.SetNotifyPayload, when it notifies us or responds to our
+// notify. It is not invoked for a nil payload.
+type PayloadDelegate interface {
+	NotifyPayload(local, remote *Vnode, payload []byte)
+}
+
 // Configuration for Chord nodes
 type Config struct {
-	Hostname      string           // Local host name
-	NumVnodes     int              // Number of vnodes per physical node
-	HashFunc      func() hash.Hash // Hash function to use
-	StabilizeMin  time.Duration    // Minimum stabilization time
-	StabilizeMax  time.Duration    // Maximum stabilization time
-	NumSuccessors int              // Number of successors to maintain
-	Delegate      Delegate         // Invoked to handle ring events
-	hashBits      int              // Bit size of the hash function
+	Hostname                 string                      // Local host name
+	NumVnodes                int                         // Number of vnodes per physical node
+	HashFunc                 func() hash.Hash            // Hash function to use
+	StabilizeMin             time.Duration               // Minimum stabilization time
+	StabilizeMax             time.Duration               // Maximum stabilization time
+	NumSuccessors            int                         // Number of successors to maintain
+	Delegate                 Delegate                    // Invoked to handle ring events
+	FingersPerStabilize      int                         // Number of finger entries repaired per stabilize
+	StrictChecks             bool                        // Validate vnode state after stabilize
+	ManualStabilize          bool                        // Disables scheduled stabilization
+	DelegateQueueSize        int                         // Delegate events queued before dropping, zero uses 32 and negative queues one
+	KeyTransform             func([]byte) []byte         // Maps a key to its ring position, instead of HashFunc
+	PredecessorFailThreshold int                         // Consecutive failed pings before clearing the predecessor
+	SuccessorFailThreshold   int                         // Consecutive failed pings before evicting a successor
+	RingID                   string                      // Identifies the ring, peers from other rings are refused
+	StabilizeErrorHandler    func(*Vnode, string, error) // Handles stabilize errors by phase, instead of logging
+	SpreadVnodes             bool                        // Space the vnode IDs evenly around the ring
+	TruncateBits             int                         // Truncates hashes to this many bits, zero uses the full hash
+	LookupCacheTTL           time.Duration               // Time a lookup is cached, zero disables the cache
+	LookupCacheSize          int                         // Maximum number of cached lookups
+	LoadReporter             func() float64              // Reports the load of this host to its neighbors
+	StabilizeTimer           func(*Vnode, time.Duration) // Receives the duration of each stabilize run
+	StabilizeRand            *rand.Rand                  // Source of the stabilize jitter, nil uses math/rand
+	RingBits                 int                         // Reduces positions modulo 2^RingBits, zero uses the hash size
+	RemoteTimeout            time.Duration               // Fails calls to remote vnodes after this long, zero waits
+	JoinQuorum               int                         // Vnodes that must find their successors to Join, zero requires all
+	PredecessorTimeout       time.Duration               // Looks up our predecessor after missing one this long, zero disables
+	LookupFanout             int                         // Closest preceding vnodes queried in parallel on each hop
+	AcceptPredecessor        func(*Vnode, *Vnode) bool   // Given our vnode and a candidate predecessor, returns false to veto it. Called without vnode locks held
+	hashBits                 int                         // Bit size of the ring
 }
 
+// Phases of stabilization, passed to the StabilizeErrorHandler. The
+// handler is invoked on the stabilize goroutine of the vnode, so it
+// should not block or invoke methods on the Ring directly.
+const (
+	PhaseCheckNewSuccessor = "checkNewSuccessor"
+	PhaseNotifySuccessor   = "notifySuccessor"
+	PhaseFixFingerTable    = "fixFingerTable"
+	PhaseCheckPredecessor  = "checkPredecessor"
+	PhaseValidate          = "validate"
+)
+
 // Represents an Vnode, local or remote
 type Vnode struct {
 	Id   []byte // Virtual ID
 	Host string // Host identifier
+	Ring string // Ring identifier, from Config.RingID
+}
+
+// Represents the health of a Vnode
+type VnodeHealth struct {
+	Vnode      *Vnode    // Vnode being checked
+	Stabilized time.Time // Last stabilization time
+	Successors int       // Number of known successors
+	Stale      bool      // Set if the vnode has not stabilized recently
+	Draining   bool      // Set if the vnode is about to leave
+
+	FingerFixed    int // Index of the last repaired finger table entry
+	FingerFailures int // Consecutive failed finger table repairs
+
+	// Durations of the recent stabilize runs, zero until the first run
+	StabilizeMin time.Duration
+	StabilizeMax time.Duration
+	StabilizeAvg time.Duration
+
+	// Stabilize runs, and those that found a different first successor
+	// or predecessor than the previous run. A high rate of changes
+	// signals an unstable ring.
+	StabilizeCount     uint64
+	SuccessorChanges   uint64
+	PredecessorChanges uint64
 }
 
 // Represents a local Vnode
 type localVnode struct {
 	Vnode
 	ring        *Ring
+	index       int        // Index the ID was generated from
+	lock        sync.Mutex // Guards the routing state and timer below
 	successors  []*Vnode
+	succFails   map[string]int
 	finger      []*Vnode
 	last_finger int
+	fingerFixed int
+	fingerFails int
 	predecessor *Vnode
+	predFails   int
+	predMissing time.Time // When we were first seen without a predecessor
+	isolated    bool
 	stabilized  time.Time
+	durations   []time.Duration // Recent stabilize durations, oldest first
+	lastSucc    *Vnode          // Neighbors at the end of the last stabilize run
+	lastPred    *Vnode
+	stabilizes  atomic.Uint64
+	succChanges atomic.Uint64
+	predChanges atomic.Uint64
 	timer       *time.Timer
+	removed     bool        // Set once removed by RemoveVnodes
+	draining    atomic.Bool // Set once leaving, refusing routing requests
 }
 
 // Stores the state required for a Chord ring
 type Ring struct {
-	config     *Config
-	transport  Transport
-	vnodes     []*localVnode
-	delegateCh chan func()
-	shutdown   chan bool
+	config          *Config
+	transport       Transport
+	base            Transport
+	vnodesLock      sync.RWMutex // Guards vnodes, which are kept sorted
+	vnodes          []*localVnode
+	delegateCh      chan func()
+	delegateLock    sync.RWMutex // Guards the delegate and its handler
+	delegateRunning bool
+	delegateStopped bool
+	stopLock        sync.Mutex // Guards shutdown and reserved
+	shutdown        chan bool
+	dropped         atomic.Uint64
+	payload         atomic.Value
+	draining        atomic.Bool
+	quiet           atomic.Bool // Set by LeaveQuiet to suppress delegate events
+	reserved        int
+	cache           *lookupCache
+	loadLock        sync.Mutex // Guards loads
+	loads           map[string]float64
+	randLock        sync.Mutex   // Guards the StabilizeRand source
+	affinityLock    sync.RWMutex // Guards affinity
+	affinity        map[string][]byte
+	lookups         lookupStats
+	wholeRing       atomic.Int64 // Successors of a short lookup found to cover the ring, zero if unknown
+}
+
+// Tracks the number of vnodes in use by all rings in the process
+var vnodeBudget struct {
+	sync.Mutex
+	max  int
+	used int
+}
+
+// SetMaxVnodes limits the total number of vnodes across all the rings
+// in the process. Create and Join return an error if the new ring would
+// exceed the limit. Rings that are already running are not affected.
+// A limit of zero, the default, disables the check.
+func SetMaxVnodes(n int) {
+	vnodeBudget.Lock()
+	defer vnodeBudget.Unlock()
+	vnodeBudget.max = n
+}
+
+// Reserves a number of vnodes from the process wide budget
+func reserveVnodes(n int) error {
+	vnodeBudget.Lock()
+	defer vnodeBudget.Unlock()
+	if vnodeBudget.max > 0 && vnodeBudget.used+n > vnodeBudget.max {
+		return fmt.Errorf("Cannot create %d vnodes, %d of %d in use!",
+			n, vnodeBudget.used, vnodeBudget.max)
+	}
+	vnodeBudget.used += n
+	return nil
+}
+
+// Returns vnodes to the process wide budget
+func releaseVnodes(n int) {
+	vnodeBudget.Lock()
+	defer vnodeBudget.Unlock()
+	vnodeBudget.used -= n
 }
 
 // Returns the default Ring configuration
@@ -103,19 +499,154 @@ func DefaultConfig(hostname string) *Config {
 		sha1.New, // SHA1
 		time.Duration(15 * time.Second),
 		time.Duration(45 * time.Second),
-		8,   // 8 successors
-		nil, // No delegate
+		8,     // 8 successors
+		nil,   // No delegate
+		1,     // 1 finger per stabilize
+		false, // No strict checks
+		false, // Scheduled stabilization
+		32,    // 32 queued delegate events
+		nil,   // Hash keys with HashFunc
+		1,     // Clear predecessor on first failed ping
+		1,     // Evict successors on first failed ping
+		"",    // No ring identifier
+		nil,   // Log stabilize errors
+		false, // Hash each vnode ID
+		0,     // Use the full hash
+		0,     // No lookup cache
+		1024,  // 1024 cached lookups
+		nil,   // No load reporting
+		nil,   // No stabilize timing
+		nil,   // Global random source
+		0,     // Ring the size of the hash
+		0,     // No remote timeout
+		0,     // Every vnode must join
+		time.Duration(3 * time.Minute),
+		1,   // Query one vnode at a time
+		nil, // Accept any predecessor
 		160, // 160bit hash function
 	}
 }
 
+// Transport returns the transport used by the ring. This wraps the
+// transport given to Create or Join, to route requests to local vnodes
+// directly.
+func (r *Ring) Transport() Transport {
+	return r.transport
+}
+
+// WrapTransport replaces the transport used to reach remote vnodes with
+// the result of wrap, which is given the current transport. The wrapper
+// must pass requests onto the transport it wraps. Vnodes have already
+// been registered with the wrapped transport, so Register is not invoked
+// on the wrapper.
+func (r *Ring) WrapTransport(wrap func(Transport) Transport) {
+	r.transport.(*LocalTransport).wrapRemote(wrap)
+}
+
+// SetNotifyPayload sets an opaque payload that is sent along with
+// Notify requests and responses, and is passed to the Delegate of the
+// remote vnode. It should be kept small, since it is exchanged on every
+// stabilize. A nil payload, the default, disables sending it.
+func (r *Ring) SetNotifyPayload(payload []byte) {
+	r.payload.Store(payload)
+}
+
+// Returns the current notify payload
+func (r *Ring) notifyPayload() []byte {
+	payload, _ := r.payload.Load().([]byte)
+	return payload
+}
+
+// SetDelegate installs a delegate on a running ring, replacing any
+// existing one, and starts the delegate handler if needed. Events that
+// were already queued are still delivered to the previous delegate.
+// Does nothing once the ring has been shutdown.
+func (r *Ring) SetDelegate(d Delegate) {
+	r.delegateLock.Lock()
+	defer r.delegateLock.Unlock()
+	if r.delegateStopped {
+		return
+	}
+	r.config.Delegate = d
+	r.startDelegate()
+}
+
+// DelegateDropped returns the number of delegate events that were
+// dropped because the delegate queue was full
+func (r *Ring) DelegateDropped() uint64 {
+	return r.dropped.Load()
+}
+
+// Initializes the hash bits, applying any truncation and ring size
+func initHashBits(conf *Config) error {
+	full := conf.HashFunc().Size() * 8
+	bits := conf.TruncateBits
+	if bits == 0 {
+		bits = full
+	}
+	if bits < 0 || bits > full || bits%8 != 0 {
+		return fmt.Errorf("TruncateBits must be a multiple of 8 up to %d!", full)
+	}
+	if conf.RingBits != 0 {
+		if conf.RingBits < 0 || conf.RingBits > bits {
+			return fmt.Errorf("RingBits must be between 1 and %d!", bits)
+		}
+		bits = conf.RingBits
+	}
+	conf.hashBits = bits
+	return nil
+}
+
+// Returns the hash sum, truncated to the bit size of the ring. With
+// RingBits, the sum is instead reduced modulo 2^RingBits.
+func hashSum(conf *Config, h hash.Hash) []byte {
+	sum := h.Sum(nil)
+	if conf.RingBits > 0 {
+		if size := conf.TruncateBits / 8; size > 0 && size < len(sum) {
+			sum = sum[:size]
+		}
+		return ringMod(sum, conf.RingBits)
+	}
+	if size := conf.hashBits / 8; size > 0 && size < len(sum) {
+		sum = sum[:size]
+	}
+	return sum
+}
+
+// Reduces a position modulo 2^bits. The result has the fewest bytes
+// that hold the bits, so that every position in the ring compares at
+// the same length.
+func ringMod(pos []byte, bits int) []byte {
+	size := (bits + 7) / 8
+	res := make([]byte, size)
+	if len(pos) >= size {
+		copy(res, pos[len(pos)-size:])
+	} else {
+		copy(res[size-len(pos):], pos)
+	}
+	res[0] &= byte(0xff >> uint(size*8-bits))
+	return res
+}
+
 // Creates a new Chord ring given the config and transport
 func Create(conf *Config, trans Transport) (*Ring, error) {
 	// Initialize the hash bits
-	conf.hashBits = conf.HashFunc().Size() * 8
+	if err := initHashBits(conf); err != nil {
+		return nil, err
+	}
+
+	// Ensure we are within the vnode budget
+	if err := reserveVnodes(conf.NumVnodes); err != nil {
+		return nil, err
+	}
+
+	// Refuse to create a second ring for the host
+	if err := checkRegistered(conf, trans); err != nil {
+		return nil, err
+	}
 
 	// Create and initialize a ring
-	ring := &Ring{}
+	ring := &Ring{reserved: conf.NumVnodes}
 	ring.init(conf, trans)
 	ring.setLocalSuccessors()
 	ring.schedule()
@@ -125,10 +656,12 @@ func Create(conf *Config, trans Transport) (*Ring, error) {
 // Joins an existing Chord ring
 func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 	// Initialize the hash bits
-	conf.hashBits = conf.HashFunc().Size() * 8
+	if err := initHashBits(conf); err != nil {
+		return nil, err
+	}
 
-	// Request a list of Vnodes from the remote host
-	hosts, err := trans.ListVnodes(existing)
+	// Request the Vnodes of the remote host near our own
+	hosts, err := seedVnodes(conf, trans, existing)
 	if err != nil {
 		return nil, err
 	}
@@ -136,89 +669,870 @@ func Join(conf *Config, trans Transport, existing string) (*Ring, error) {
 		return nil, fmt.Errorf("Remote host has no vnodes!")
 	}
 
+	// Ensure the remote host is in the same ring
+	if err := checkRingID(conf.RingID, hosts); err != nil {
+		return nil, err
+	}
+
+	// Refuse to join again, such as when retrying a Join that succeeded
+	if err := checkRegistered(conf, trans); err != nil {
+		return nil, err
+	}
+
+	// Ensure we are within the vnode budget
+	if err := reserveVnodes(conf.NumVnodes); err != nil {
+		return nil, err
+	}
+
 	// Create a ring
-	ring := &Ring{}
+	ring := &Ring{reserved: conf.NumVnodes}
 	ring.init(conf, trans)
 
 	// Acquire a live successor for each Vnode
-	for _, vn := range ring.vnodes {
-		// Get the nearest remote vnode
-		nearest := nearestVnodeToKey(hosts, vn.Id)
+	if err := ring.joinSuccessors(hosts); err != nil {
+		ring.deregister()
+		ring.release()
+		return nil, err
+	}
 
-		// Query for a list of successors to this Vnode
-		succs, err := trans.FindSuccessors(nearest, conf.NumSuccessors, vn.Id)
+	// Start delegate handler
+	ring.delegateLock.Lock()
+	ring.startDelegate()
+	ring.delegateLock.Unlock()
+
+	// Do a fast stabilization, will schedule regular execution
+	for _, vn := range ring.localVnodes() {
+		if conf.ManualStabilize {
+			vn.stabilizeOnce()
+		} else {
+			vn.stabilize()
+		}
+	}
+	return ring, nil
+}
+
+// Lists the vnodes of the seed host that a join needs, which are those
+// shortly before the IDs our vnodes will have. Each range spans the
+// share of the ring of one of our vnodes. If the ranges are empty, every
+// vnode of the seed host is listed instead.
+func seedVnodes(conf *Config, trans Transport, existing string) ([]*Vnode, error) {
+	if conf.NumVnodes <= 1 {
+		return trans.ListVnodes(existing)
+	}
+	var res []*Vnode
+	seen := make(map[string]bool)
+	for i := 0; i < conf.NumVnodes; i++ {
+		vn := &localVnode{ring: &Ring{config: conf}}
+		vn.genId(uint16(i))
+		start := spreadOffset(vn.Id, conf.NumVnodes-1, conf.NumVnodes, conf.hashBits)
+		vnodes, err := listVnodesInRange(trans, existing, start, vn.Id)
 		if err != nil {
-			return nil, fmt.Errorf("Failed to find successor for vnodes! Got %s", err)
+			return nil, err
 		}
-		if succs == nil || len(succs) == 0 {
-			return nil, fmt.Errorf("Failed to find successor for vnodes! Got no vnodes!")
+		for _, v := range vnodes {
+			if key := v.String(); !seen[key] {
+				seen[key] = true
+				res = append(res, v)
+			}
 		}
+	}
+	if len(res) == 0 {
+		return trans.ListVnodes(existing)
+	}
+	return res, nil
+}
+
+// Checks that the host has no vnodes registered with the transport,
+// which are left by a ring that has not been shutdown. This is checked
+// without a request to our own host, and a transport that cannot tell
+// is assumed to have none.
+func checkRegistered(conf *Config, trans Transport) error {
+	if reg, ok := trans.(registrar); ok && reg.registered(conf.Hostname) {
+		return fmt.Errorf("Host %s is already in the ring! Shutdown the existing ring first.", conf.Hostname)
+	}
+	return nil
+}
+
+// Rejoins an existing Chord ring using the given seed host. This is used
+// to recover after a transient partition, when the rest of the ring has
+// routed around us. The local vnodes and their identities are preserved,
+// but the successor lists and finger tables are rebuilt and the new
+// successors are notified. The delegate is then informed of the ranges
+// the local vnodes reclaim with ReclaimRange.
+func (r *Ring) Rejoin(existing string) error {
+	// Request a list of Vnodes from the remote host
+	hosts, err := r.transport.ListVnodes(existing)
+	if err != nil {
+		return err
+	}
+	if hosts == nil || len(hosts) == 0 {
+		return fmt.Errorf("Remote host has no vnodes!")
+	}
+	if err := checkRingID(r.config.RingID, hosts); err != nil {
+		return err
+	}
 
-		// Assign the successors
-		for idx, s := range succs {
-			vn.successors[idx] = s
+	// Re-acquire the successors for each Vnode
+	if err := r.joinSuccessors(hosts); err != nil {
+		return err
+	}
+
+	// Find the ranges we reclaim, before our successors learn of us
+	local := r.localVnodes()
+	var reclaims []func(Delegate)
+	for _, vn := range local {
+		f, rerr := vn.reclaimRange(local)
+		err = errors.Join(err, rerr)
+		if f != nil {
+			reclaims = append(reclaims, f)
 		}
 	}
 
-	// Start delegate handler
-	if ring.config.Delegate != nil {
-		go ring.delegateHandler()
+	// Reset the finger tables and notify our new successors
+	for _, vn := range local {
+		vn.lock.Lock()
+		for i := range vn.finger {
+			vn.finger[i] = nil
+		}
+		vn.last_finger = 0
+		vn.lock.Unlock()
+		err = errors.Join(err, vn.notifySuccessor())
+		err = errors.Join(err, vn.fixFingerTable())
 	}
 
-	// Do a fast stabilization, will schedule regular execution
-	for _, vn := range ring.vnodes {
-		vn.stabilize()
+	// Inform the delegate of the ranges, now that we have rejoined
+	for _, f := range reclaims {
+		r.invokeDelegate(f)
+	}
+	return err
+}
+
+// Runs a single round of stabilization on each local vnode. This is used
+// to drive stabilization when ManualStabilize is set, but may also be used
+// to stabilize on demand. Does nothing once the ring has been shutdown.
+func (r *Ring) Stabilize() {
+	if r.stopping() != nil {
+		return
+	}
+	for _, vn := range r.localVnodes() {
+		vn.stabilizeOnce()
 	}
-	return ring, nil
 }
 
-// Leaves a given Chord ring and shuts down the local vnodes
+// Leaves a given Chord ring and shuts down the local vnodes. If we are
+// the only host in the ring, there are no neighbors to inform, and the
+// ring is just shutdown.
 func (r *Ring) Leave() error {
 	// Shutdown the vnodes first to avoid further stabilization runs
 	r.stopVnodes()
 
 	// Instruct each vnode to leave
 	var err error
-	for _, vn := range r.vnodes {
-		err = mergeErrors(err, vn.leave())
+	if !r.soleMember() {
+		for _, vn := range r.localVnodes() {
+			err = errors.Join(err, vn.leave())
+		}
 	}
 
 	// Wait for the delegate callbacks to complete
 	r.stopDelegate()
+	r.deregister()
 	return err
 }
 
+// LeaveQuiet leaves the ring as with Leave, informing our neighbors so
+// the rest of the ring stays linked, but suppresses the delegate events
+// of this ring while leaving, such as Leaving. Only Shutdown is delivered.
+// This avoids starting data migration when the whole cluster is going
+// down. Our neighbors still see PredecessorLeaving and SuccessorLeaving
+// unless they are leaving quietly too. To skip the handoff entirely, as
+// when every host is stopped at once, use Shutdown instead.
+func (r *Ring) LeaveQuiet() error {
+	r.quiet.Store(true)
+	defer r.quiet.Store(false)
+	return r.Leave()
+}
+
+// Checks if we are the only host in the ring, with every successor and
+// predecessor known being a local vnode
+func (r *Ring) soleMember() bool {
+	for _, vn := range r.localVnodes() {
+		vn.lock.Lock()
+		remote := vn.predecessor != nil && vn.predecessor.Host != vn.Host
+		for _, s := range vn.successors {
+			remote = remote || s != nil && s.Host != vn.Host
+		}
+		vn.lock.Unlock()
+		if remote {
+			return false
+		}
+	}
+	return true
+}
+
+// RemoveVnodes shrinks the number of vnodes we host by leaving the ring
+// with count of the local vnodes, while the rest keep running. The vnodes
+// generated from the highest indices are removed. Their neighbors are
+// informed, and the ring heals around them through stabilization.
+func (r *Ring) RemoveVnodes(count int) error {
+	r.vnodesLock.Lock()
+	if count < 0 || count >= len(r.vnodes) {
+		num := len(r.vnodes)
+		r.vnodesLock.Unlock()
+		return fmt.Errorf("Cannot remove %d of %d vnodes! Use Leave to remove every vnode.", count, num)
+	}
+	byIndex := make([]*localVnode, len(r.vnodes))
+	copy(byIndex, r.vnodes)
+	sort.Slice(byIndex, func(i, j int) bool {
+		return byIndex[i].index > byIndex[j].index
+	})
+	removed := byIndex[:count]
+	r.vnodes = append([]*localVnode(nil), byIndex[count:]...)
+	sort.Sort(r)
+	r.vnodesLock.Unlock()
+
+	// Stop the vnodes before leaving, so they no longer stabilize
+	var err error
+	for _, vn := range removed {
+		vn.stop()
+		err = errors.Join(err, vn.leave())
+		if d, ok := r.transport.(deregisterer); ok {
+			d.Deregister(&vn.Vnode)
+		}
+	}
+
+	// Return the vnodes to the process wide budget, unless the whole
+	// ring was released meanwhile
+	r.stopLock.Lock()
+	if r.reserved > 0 {
+		releaseVnodes(count)
+		r.reserved -= count
+	}
+	r.stopLock.Unlock()
+	return err
+}
+
+// Evict purges a host we know to be dead, rather than waiting for its
+// vnodes to fail enough pings. Every successor, finger and predecessor
+// on the host is dropped from the local vnodes, which are stabilized to
+// backfill them. This is a local operation only: the other hosts keep
+// their references until they detect the failure or evict it too, and
+// may hand them back to us meanwhile.
+func (r *Ring) Evict(host string) error {
+	if host == r.config.Hostname {
+		return fmt.Errorf("Cannot evict the local host!")
+	}
+	local := r.localVnodes()
+	evicted := false
+	for _, vn := range local {
+		if vn.evict(host, local) {
+			evicted = true
+		}
+	}
+	if !evicted {
+		return nil
+	}
+	r.forgetLoad(host)
+	r.Stabilize()
+	return nil
+}
+
+// Leaves a given Chord ring, handing off to the given target host. Before
+// leaving, the successors are refreshed and each vnode is checked to ensure
+// that the first successor not on this host is on the target. If not, an
+// error is returned and the ring is not left.
+func (r *Ring) LeaveTo(target string) error {
+	for _, vn := range r.localVnodes() {
+		// Refresh our successor
+		if err := vn.checkNewSuccessor(); err != nil {
+			return err
+		}
+
+		// Find the first remote successor
+		var succ *Vnode
+		vn.lock.Lock()
+		for _, s := range vn.successors {
+			if s != nil && s.Host != r.config.Hostname {
+				succ = s
+				break
+			}
+		}
+		vn.lock.Unlock()
+		if succ == nil || succ.Host != target {
+			return fmt.Errorf("Target %s is not the successor of vnode %s!",
+				target, vn.String())
+		}
+	}
+	return r.Leave()
+}
+
+// DrainAndLeave leaves the ring in two phases. The vnodes are first
+// marked as draining, and the Delegate is informed with Draining, while
+// the vnodes keep serving requests so that routing stays correct. Once
+// done is closed, the ring is left as with Leave. If the context is
+// cancelled first, the vnodes stop draining and the ring is not left.
+func (r *Ring) DrainAndLeave(ctx context.Context, done <-chan struct{}) error {
+	r.draining.Store(true)
+	for _, vn := range r.localVnodes() {
+		vn.lock.Lock()
+		local, pred, succ := &vn.Vnode, vn.predecessor, vn.successors[0]
+		vn.lock.Unlock()
+		r.queueDelegate(func(d Delegate) {
+			if dd, ok := d.(DrainDelegate); ok {
+				dd.Draining(local, pred, succ)
+			}
+		}, true)
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		r.draining.Store(false)
+		return ctx.Err()
+	}
+	return r.Leave()
+}
+
 // Shutdown shuts down the local processes in a given Chord ring
 // Blocks until all the vnodes terminate.
 func (r *Ring) Shutdown() {
 	r.stopVnodes()
 	r.stopDelegate()
+	r.deregister()
 }
 
-// Does a key lookup for up to N successors of a key
+// Close shuts down the ring, and then the transport given to Create
+// or Join, if it has a Shutdown method. This takes ownership of the
+// transport, and should not be used if it is shared with other rings.
+//
+// The ring must be shutdown first, so that stabilization has stopped
+// and any pending delegate callbacks have been invoked before the
+// transport goes away. To leave the ring gracefully, invoke Leave
+// before Close, in which case the ring is already shutdown.
+func (r *Ring) Close() {
+	if r.stopping() == nil {
+		r.Shutdown()
+	}
+	if s, ok := r.base.(interface{ Shutdown() }); ok {
+		s.Shutdown()
+	}
+}
+
+// Does a key lookup for up to N successors of a key. The key must not
+// be empty. If a KeyTransform is configured, the position it returns
+// must be exactly the size of the hash. With a LookupCacheTTL, results
+// are cached and may be stale for up to the TTL. If fewer than n are
+// found while the ring has more vnodes, the successors found are
+// returned with an error wrapping ErrInsufficientSuccessors.
 func (r *Ring) Lookup(n int, key []byte) ([]*Vnode, error) {
+	key_hash, err := r.lookupPosition(n, key)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for a cached lookup
+	if cached := r.cache.get(key_hash, n); cached != nil {
+		return cached, nil
+	}
+
+	start := time.Now()
+	successors, _, err := r.route(r.nearestVnode(key_hash), n, key_hash, false)
+	r.lookups.record(time.Since(start), err)
+	if err != nil {
+		return successors, err
+	}
+	r.cache.put(key_hash, n, successors)
+	return successors, nil
+}
+
+// LookupTrace does a key lookup as with Lookup, but also returns the
+// path of vnodes the lookup traversed, in order. The path starts with
+// the local vnode the lookup was routed from, and ends with the vnode
+// that found the successors. The cache is never used, so that the
+// lookup is always routed through the ring.
+func (r *Ring) LookupTrace(n int, key []byte) ([]*Vnode, []*Vnode, error) {
+	key_hash, err := r.lookupPosition(n, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return r.route(r.nearestVnode(key_hash), n, key_hash, true)
+}
+
+// LookupFrom does a key lookup as with Lookup, but enters the ring
+// through the local vnode with the given ID, instead of the vnode
+// nearest to the key. An error is returned if there is no such local
+// vnode. The cache is never used, so that the lookup is always routed
+// from the vnode.
+func (r *Ring) LookupFrom(vnodeID []byte, n int, key []byte) ([]*Vnode, error) {
+	from := r.localVnode(vnodeID)
+	if from == nil {
+		return nil, fmt.Errorf("Vnode %x is not a local vnode!", vnodeID)
+	}
+	key_hash, err := r.lookupPosition(n, key)
+	if err != nil {
+		return nil, err
+	}
+	successors, _, err := r.route(from, n, key_hash, false)
+	return successors, err
+}
+
+// LookupLocal does a key lookup as with Lookup, but only uses the
+// successor lists and finger tables of the local vnodes, never making a
+// remote call. If the lookup would need to be forwarded to a remote
+// vnode, ErrRemoteHop is returned. The result may be stale, since it
+// is not confirmed by the owner of the key.
+func (r *Ring) LookupLocal(n int, key []byte) ([]*Vnode, error) {
+	key_hash, err := r.lookupPosition(n, key)
+	if err != nil {
+		return nil, err
+	}
+	successors, err := r.nearestVnode(key_hash).findSuccessorsLocal(n, key_hash)
+	if err == errExhaustedPreceeding {
+		return nil, ErrNoLiveSuccessors
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Trim the nil successors
+	successors = trimSlice(successors)
+	if len(successors) == 0 {
+		return nil, ErrNoLiveSuccessors
+	}
+	return successors, nil
+}
+
+// Checks the arguments of a lookup, returning the ring position of the key
+func (r *Ring) lookupPosition(n int, key []byte) ([]byte, error) {
 	// Ensure that n is sane
 	if n > r.config.NumSuccessors {
 		return nil, fmt.Errorf("Cannot ask for more successors than NumSuccessors!")
 	}
+	if n <= 0 {
+		return nil, fmt.Errorf("Cannot ask for fewer than one successor!")
+	}
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+
+	// Keys with an affinity are placed at the designated vnode
+	if id := r.affinityPosition(key); id != nil {
+		return id, nil
+	}
+
+	// Find the ring position of the key
+	return r.keyPosition(key)
+}
+
+// SetAffinity places every key starting with the prefix at the vnode
+// with the given ID, regardless of the hash of the key. A lookup of such
+// a key returns that vnode first, followed by its successors. If the
+// vnode is not in the ring, its successor is returned instead, as for a
+// key hashed to its ID. When several prefixes match a key, the longest
+// is used. The affinity only applies to lookups on this ring.
+func (r *Ring) SetAffinity(prefix []byte, vnodeID []byte) error {
+	if len(prefix) == 0 {
+		return fmt.Errorf("Affinity prefix cannot be empty!")
+	}
+	if size := len(r.localVnodes()[0].Id); len(vnodeID) != size {
+		return fmt.Errorf("Vnode ID must be %d bytes, got %d!", size, len(vnodeID))
+	}
+	r.affinityLock.Lock()
+	defer r.affinityLock.Unlock()
+	if r.affinity == nil {
+		r.affinity = make(map[string][]byte)
+	}
+	id := make([]byte, len(vnodeID))
+	copy(id, vnodeID)
+	r.affinity[string(prefix)] = id
+	return nil
+}
+
+// ClearAffinity removes the affinity of a prefix set by SetAffinity
+func (r *Ring) ClearAffinity(prefix []byte) {
+	r.affinityLock.Lock()
+	defer r.affinityLock.Unlock()
+	delete(r.affinity, string(prefix))
+}
+
+// Returns the vnode ID for the longest prefix of the key with an
+// affinity, or nil
+func (r *Ring) affinityPosition(key []byte) []byte {
+	r.affinityLock.RLock()
+	defer r.affinityLock.RUnlock()
+	var best string
+	var id []byte
+	for prefix, target := range r.affinity {
+		if len(prefix) > len(best) && bytes.HasPrefix(key, []byte(prefix)) {
+			best, id = prefix, target
+		}
+	}
+	return id
+}
+
+// Routes a lookup for the successors of a key position through a
+// local vnode, returning the successors and the path taken. Unless the
+// lookup is traced, the path only ends with the vnode that answered.
+func (r *Ring) route(from *localVnode, n int, key_hash []byte, trace bool) ([]*Vnode, []*Vnode, error) {
+	successors, path, err := from.FindSuccessorsTrace(n, key_hash, nil, trace)
+	if err == errExhaustedPreceeding {
+		return nil, nil, ErrNoLiveSuccessors
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	// Trim the nil successors
+	successors = trimSlice(successors)
+	if len(successors) == 0 {
+		return nil, nil, ErrNoLiveSuccessors
+	}
+	if len(successors) < n {
+		err = r.checkShort(n, successors, path)
+	}
+	return successors, path, err
+}
+
+// Checks a lookup that found fewer than n successors, returning an
+// error wrapping ErrInsufficientSuccessors unless the ring has no other
+// vnodes. This is the case if the successor of the last one found wraps
+// around to the vnode that found them, or to one of the successors.
+// Once a number of successors is found to cover the ring, later lookups
+// finding as many are trusted without a scan, until the next stabilize.
+func (r *Ring) checkShort(n int, successors, path []*Vnode) error {
+	if r.wholeRing.Load() == int64(len(successors)) {
+		return nil
+	}
+	short := fmt.Errorf("%w Found %d of %d.", ErrInsufficientSuccessors, len(successors), n)
+	next, err := r.scanSuccessor(successors[len(successors)-1])
+	if err != nil {
+		return short
+	}
+	wraps := len(path) > 0 && next.Equal(path[len(path)-1])
+	for _, s := range successors {
+		if next.Equal(s) {
+			wraps = true
+		}
+	}
+	if !wraps {
+		return short
+	}
+	r.wholeRing.Store(int64(len(successors)))
+	return nil
+}
 
-	// Hash the key
-	h := r.config.HashFunc()
-	h.Write(key)
-	key_hash := h.Sum(nil)
+// ClientLookup finds up to n successors of a key without running any
+// local vnodes, by routing the lookup through the vnodes of a seed host.
+// Keys are placed on the ring as configured by conf, which must match
+// the config of the ring, such as its HashFunc and KeyTransform.
+func ClientLookup(conf *Config, trans Transport, seed string, n int, key []byte) ([]*Vnode, error) {
+	if len(key) == 0 {
+		return nil, ErrEmptyKey
+	}
+	if err := initHashBits(conf); err != nil {
+		return nil, err
+	}
+	key_hash, err := keyPosition(conf, key)
+	if err != nil {
+		return nil, err
+	}
 
-	// Find the nearest local vnode
-	nearest := r.nearestVnode(key_hash)
+	// Request a list of Vnodes from the seed
+	vnodes, err := trans.ListVnodes(seed)
+	if err != nil {
+		return nil, err
+	}
+	if len(vnodes) == 0 {
+		return nil, fmt.Errorf("Remote host has no vnodes!")
+	}
 
-	// Use the nearest node for the lookup
-	successors, err := nearest.FindSuccessors(n, key_hash)
+	// Use the nearest seed vnode for the lookup
+	nearest := nearestVnodeToKey(vnodes, key_hash)
+	successors, _, err := trans.FindSuccessors(nearest, n, key_hash, nil)
 	if err != nil {
 		return nil, err
 	}
+	if len(successors) > n {
+		successors = successors[:n]
+	}
 
 	// Trim the nil successors
-	for successors[len(successors)-1] == nil {
-		successors = successors[:len(successors)-1]
+	successors = trimSlice(successors)
+	if len(successors) == 0 {
+		return nil, ErrNoLiveSuccessors
 	}
 	return successors, nil
 }
+
+// Returns the ring position of a key
+func (r *Ring) keyPosition(key []byte) ([]byte, error) {
+	return keyPosition(r.config, key)
+}
+
+// Returns the ring position of a key. This is the hash of the key,
+// unless a KeyTransform is configured.
+func keyPosition(conf *Config, key []byte) ([]byte, error) {
+	if conf.KeyTransform == nil {
+		h := conf.HashFunc()
+		h.Write(key)
+		return hashSum(conf, h), nil
+	}
+	pos := conf.KeyTransform(key)
+	if conf.RingBits > 0 {
+		return ringMod(pos, conf.RingBits), nil
+	}
+	if len(pos)*8 != conf.hashBits {
+		return nil, fmt.Errorf("KeyTransform must return %d bytes, got %d!",
+			conf.hashBits/8, len(pos))
+	}
+	return pos, nil
+}
+
+// PrefixKeyTransform returns a KeyTransform that keeps the first
+// prefixLen bytes of a key as the high-order bytes of its ring position,
+// followed by the hash of the rest of the key. Keys sharing a prefix are
+// placed in the same contiguous range of the ring. Short keys are padded
+// with zeros.
+//
+// This trades load distribution for locality. Each prefix owns only
+// 1/256^prefixLen of the ring, so the vnodes covering a busy prefix carry
+// all of its keys, and unused prefixes leave vnodes idle. It works best
+// with many prefixes of similar size, and a short prefixLen.
+func PrefixKeyTransform(prefixLen int, hf func() hash.Hash) func([]byte) []byte {
+	return func(key []byte) []byte {
+		h := hf()
+		size := h.Size()
+		plen := min(prefixLen, size)
+		pos := make([]byte, size)
+		copy(pos[:plen], key)
+		if len(key) > plen {
+			h.Write(key[plen:])
+		}
+		copy(pos[plen:], h.Sum(nil))
+		return pos
+	}
+}
+
+// Scan walks the entire ring in order, starting from a local vnode and
+// proceeding via successors until it wraps around. The callback is invoked
+// for each vnode with the range of keys it owns, which is (start, end].
+// If the walk fails to contact a vnode, the lookup is routed through the
+// local vnodes instead, skipping over the failed node.
+func (r *Ring) Scan(ctx context.Context, fn func(owner *Vnode, start, end []byte) error) error {
+	first := &r.localVnodes()[0].Vnode
+	prev := first
+	for {
+		// Check for cancellation
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
+
+		// Find the successor of the prev vnode
+		next, err := r.scanSuccessor(prev)
+		if err != nil {
+			return err
+		}
+
+		// Check if we've wrapped around the ring, taking into
+		// account that the first vnode may have left
+		end := next.Id
+		done := next.Equal(first)
+		if !done && between(prev.Id, next.Id, first.Id) {
+			end = first.Id
+			done = true
+		}
+
+		// Invoke the callback
+		if err := fn(next, prev.Id, end); err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+		prev = next
+	}
+}
+
+// Returns the immediate successor of a vnode for a ring Scan
+func (r *Ring) scanSuccessor(vn *Vnode) (*Vnode, error) {
+	key := powerOffset(vn.Id, 0, r.config.hashBits)
+
+	// Try asking the vnode directly
+	succs, _, err := r.transport.FindSuccessors(vn, 1, key, nil)
+	if err != nil || len(succs) == 0 || succs[0] == nil {
+		// Route the lookup through the nearest local vnode
+		succs, _, err = r.nearestVnode(key).FindSuccessors(1, key, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(succs) == 0 || succs[0] == nil {
+		return nil, fmt.Errorf("Failed to find successor of %s!", vn.String())
+	}
+	return succs[0], nil
+}
+
+// RingHealth crawls the ring and returns the health of each vnode.
+// A vnode is flagged as stale if it has not stabilized within twice
+// StabilizeMax, or if its health could not be retrieved.
+func (r *Ring) RingHealth(ctx context.Context) ([]VnodeHealth, error) {
+	var res []VnodeHealth
+	limit := 2 * r.config.StabilizeMax
+	err := r.Scan(ctx, func(owner *Vnode, start, end []byte) error {
+		health, err := r.transport.Health(owner)
+		if err != nil || health == nil {
+			health = &VnodeHealth{Vnode: owner, Stale: true}
+		} else {
+			health.Stale = time.Since(health.Stabilized) > limit
+		}
+		res = append(res, *health)
+		return nil
+	})
+	return res, err
+}
+
+// DumpDOT writes the local topology of the ring in the Graphviz DOT
+// format. Each local vnode is drawn along with edges to its first
+// successor and its predecessor, which may be remote.
+func (r *Ring) DumpDOT(w io.Writer) error {
+	var buf bytes.Buffer
+	seen := make(map[string]bool)
+	node := func(vn *Vnode, local bool) string {
+		name := fmt.Sprintf("%q", vn.Host+"/"+vn.String())
+		if !seen[name] {
+			seen[name] = true
+			id := vn.String()
+			if len(id) > 8 {
+				id = id[:8]
+			}
+			style := ""
+			if local {
+				style = ", style=filled"
+			}
+			fmt.Fprintf(&buf, "\t%s [label=%q%s];\n", name, vn.Host+"\n"+id, style)
+		}
+		return name
+	}
+
+	buf.WriteString("digraph chord {\n")
+	for _, vn := range r.localVnodes() {
+		node(&vn.Vnode, true)
+	}
+	for _, vn := range r.localVnodes() {
+		self := node(&vn.Vnode, true)
+		vn.lock.Lock()
+		succ, pred := vn.successors[0], vn.predecessor
+		vn.lock.Unlock()
+		if succ != nil {
+			fmt.Fprintf(&buf, "\t%s -> %s [label=\"succ\"];\n", self, node(succ, false))
+		}
+		if pred != nil {
+			fmt.Fprintf(&buf, "\t%s -> %s [label=\"pred\", style=dashed];\n", self, node(pred, false))
+		}
+	}
+	buf.WriteString("}\n")
+
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// Version of the format used by ExportState
+const stateVersion = 1
+
+// Serialized routing state of a ring. Empty entries in the successor
+// list and finger table are stored as a Vnode with no ID, since gob
+// cannot encode nil pointers in a slice.
+type ringState struct {
+	Version int
+	Vnodes  []vnodeState
+}
+
+// Serialized routing state of a single local vnode
+type vnodeState struct {
+	Id          []byte
+	Successors  []Vnode
+	Predecessor Vnode
+	Finger      []Vnode
+}
+
+// ExportState serializes the successor list, predecessor and finger
+// table of each local vnode. The result can be given to ImportState
+// after a restart, to warm start routing instead of rebuilding it.
+func (r *Ring) ExportState() ([]byte, error) {
+	flatten := func(vns []*Vnode) []Vnode {
+		out := make([]Vnode, len(vns))
+		for idx, vn := range vns {
+			if vn != nil {
+				out[idx] = *vn
+			}
+		}
+		return out
+	}
+	state := ringState{Version: stateVersion}
+	for _, vn := range r.localVnodes() {
+		vn.lock.Lock()
+		vs := vnodeState{
+			Id:         vn.Id,
+			Successors: flatten(vn.successors),
+			Finger:     flatten(vn.finger),
+		}
+		if vn.predecessor != nil {
+			vs.Predecessor = *vn.predecessor
+		}
+		vn.lock.Unlock()
+		state.Vnodes = append(state.Vnodes, vs)
+	}
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(&state); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// ImportState restores the routing state produced by ExportState. It
+// should be invoked right after Create, since the vnode IDs must match
+// for the state to be restored. Entries for unknown vnodes are ignored.
+// The restored state may be stale, but is verified and corrected by
+// the normal stabilization.
+func (r *Ring) ImportState(b []byte) error {
+	var state ringState
+	if err := gob.NewDecoder(bytes.NewReader(b)).Decode(&state); err != nil {
+		return err
+	}
+	if state.Version != stateVersion {
+		return fmt.Errorf("Unsupported state version %d!", state.Version)
+	}
+
+	// Restores a list into a local slice, which keeps its size
+	restore := func(dst []*Vnode, src []Vnode) {
+		for idx := range dst {
+			dst[idx] = nil
+			if idx < len(src) && len(src[idx].Id) > 0 {
+				vn := src[idx]
+				dst[idx] = &vn
+			}
+		}
+	}
+	for _, vs := range state.Vnodes {
+		for _, vn := range r.localVnodes() {
+			if !bytes.Equal(vn.Id, vs.Id) {
+				continue
+			}
+			vn.lock.Lock()
+			if len(vs.Successors) > 0 && len(vs.Successors[0].Id) > 0 {
+				restore(vn.successors, vs.Successors)
+			}
+			restore(vn.finger, vs.Finger)
+			vn.predecessor = nil
+			if len(vs.Predecessor.Id) > 0 {
+				pred := vs.Predecessor
+				vn.predecessor = &pred
+			}
+			vn.predFails = 0
+			vn.succFails = nil
+			vn.lock.Unlock()
+		}
+	}
+	return nil
+}
@@ -1,13 +1,19 @@
 package chord
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"runtime"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 type MultiLocalTrans struct {
 	remote Transport
+	lock   sync.RWMutex
 	hosts  map[string]*LocalTransport
 }
 
@@ -19,8 +25,15 @@ func InitMLTransport() *MultiLocalTrans {
 	return ml
 }
 
+func (ml *MultiLocalTrans) get(host string) (*LocalTransport, bool) {
+	ml.lock.RLock()
+	defer ml.lock.RUnlock()
+	local, ok := ml.hosts[host]
+	return local, ok
+}
+
 func (ml *MultiLocalTrans) ListVnodes(host string) ([]*Vnode, error) {
-	if local, ok := ml.hosts[host]; ok {
+	if local, ok := ml.get(host); ok {
 		return local.ListVnodes(host)
 	}
 	return ml.remote.ListVnodes(host)
@@ -28,39 +41,53 @@ func (ml *MultiLocalTrans) ListVnodes(host string) ([]*Vnode, error) {
 
 // Ping a Vnode, check for liveness
 func (ml *MultiLocalTrans) Ping(v *Vnode) (bool, error) {
-	if local, ok := ml.hosts[v.Host]; ok {
+	if local, ok := ml.get(v.Host); ok {
 		return local.Ping(v)
 	}
 	return ml.remote.Ping(v)
 }
 
+// Ping a list of vnodes, check for liveness
+func (ml *MultiLocalTrans) BatchPing(vns []*Vnode) ([]bool, error) {
+	res := make([]bool, len(vns))
+	var err error
+	for idx, v := range vns {
+		alive, pingErr := ml.Ping(v)
+		res[idx] = alive
+		if pingErr != nil {
+			err = pingErr
+		}
+	}
+	return res, err
+}
+
 // Request a nodes predecessor
 func (ml *MultiLocalTrans) GetPredecessor(v *Vnode) (*Vnode, error) {
-	if local, ok := ml.hosts[v.Host]; ok {
+	if local, ok := ml.get(v.Host); ok {
 		return local.GetPredecessor(v)
 	}
 	return ml.remote.GetPredecessor(v)
 }
 
 // Notify our successor of ourselves
-func (ml *MultiLocalTrans) Notify(target, self *Vnode) ([]*Vnode, error) {
-	if local, ok := ml.hosts[target.Host]; ok {
-		return local.Notify(target, self)
+func (ml *MultiLocalTrans) Notify(target, self *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	if local, ok := ml.get(target.Host); ok {
+		return local.Notify(target, self, payload)
 	}
-	return ml.remote.Notify(target, self)
+	return ml.remote.Notify(target, self, payload)
 }
 
 // Find a successor
-func (ml *MultiLocalTrans) FindSuccessors(v *Vnode, n int, k []byte) ([]*Vnode, error) {
-	if local, ok := ml.hosts[v.Host]; ok {
-		return local.FindSuccessors(v, n, k)
+func (ml *MultiLocalTrans) FindSuccessors(v *Vnode, n int, k []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	if local, ok := ml.get(v.Host); ok {
+		return local.FindSuccessors(v, n, k, visited)
 	}
-	return ml.remote.FindSuccessors(v, n, k)
+	return ml.remote.FindSuccessors(v, n, k, visited)
 }
 
 // Clears a predecessor if it matches a given vnode. Used to leave.
 func (ml *MultiLocalTrans) ClearPredecessor(target, self *Vnode) error {
-	if local, ok := ml.hosts[target.Host]; ok {
+	if local, ok := ml.get(target.Host); ok {
 		return local.ClearPredecessor(target, self)
 	}
 	return ml.remote.ClearPredecessor(target, self)
@@ -68,13 +95,22 @@ func (ml *MultiLocalTrans) ClearPredecessor(target, self *Vnode) error {
 
 // Instructs a node to skip a given successor. Used to leave.
 func (ml *MultiLocalTrans) SkipSuccessor(target, self *Vnode) error {
-	if local, ok := ml.hosts[target.Host]; ok {
+	if local, ok := ml.get(target.Host); ok {
 		return local.SkipSuccessor(target, self)
 	}
 	return ml.remote.SkipSuccessor(target, self)
 }
 
+func (ml *MultiLocalTrans) Health(v *Vnode) (*VnodeHealth, error) {
+	if local, ok := ml.get(v.Host); ok {
+		return local.Health(v)
+	}
+	return ml.remote.Health(v)
+}
+
 func (ml *MultiLocalTrans) Register(v *Vnode, o VnodeRPC) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
 	local, ok := ml.hosts[v.Host]
 	if !ok {
 		local = InitLocalTransport(nil).(*LocalTransport)
@@ -84,6 +120,8 @@ func (ml *MultiLocalTrans) Register(v *Vnode, o VnodeRPC) {
 }
 
 func (ml *MultiLocalTrans) Deregister(host string) {
+	ml.lock.Lock()
+	defer ml.lock.Unlock()
 	delete(ml.hosts, host)
 }
 
@@ -113,6 +151,69 @@ func TestDefaultConfig(t *testing.T) {
 	if conf.Delegate != nil {
 		t.Fatalf("bad delegate")
 	}
+	if conf.FingersPerStabilize != 1 {
+		t.Fatalf("bad fingers per stabilize")
+	}
+	if conf.StrictChecks {
+		t.Fatalf("bad strict checks")
+	}
+	if conf.ManualStabilize {
+		t.Fatalf("bad manual stabilize")
+	}
+	if conf.DelegateQueueSize != 32 {
+		t.Fatalf("bad delegate queue size")
+	}
+	if conf.KeyTransform != nil {
+		t.Fatalf("bad key transform")
+	}
+	if conf.PredecessorFailThreshold != 1 {
+		t.Fatalf("bad predecessor fail threshold")
+	}
+	if conf.SuccessorFailThreshold != 1 {
+		t.Fatalf("bad successor fail threshold")
+	}
+	if conf.RingID != "" {
+		t.Fatalf("bad ring id")
+	}
+	if conf.StabilizeErrorHandler != nil {
+		t.Fatalf("bad stabilize error handler")
+	}
+	if conf.SpreadVnodes {
+		t.Fatalf("bad spread vnodes")
+	}
+	if conf.TruncateBits != 0 {
+		t.Fatalf("bad truncate bits")
+	}
+	if conf.LookupCacheTTL != 0 || conf.LookupCacheSize != 1024 {
+		t.Fatalf("bad lookup cache")
+	}
+	if conf.LoadReporter != nil {
+		t.Fatalf("bad load reporter")
+	}
+	if conf.StabilizeTimer != nil {
+		t.Fatalf("bad stabilize timer")
+	}
+	if conf.StabilizeRand != nil {
+		t.Fatalf("bad stabilize rand")
+	}
+	if conf.RingBits != 0 {
+		t.Fatalf("bad ring bits")
+	}
+	if conf.RemoteTimeout != 0 {
+		t.Fatalf("bad remote timeout")
+	}
+	if conf.JoinQuorum != 0 {
+		t.Fatalf("bad join quorum")
+	}
+	if conf.PredecessorTimeout != 3*time.Minute {
+		t.Fatalf("bad predecessor timeout")
+	}
+	if conf.LookupFanout != 1 {
+		t.Fatalf("bad lookup fanout")
+	}
+	if conf.AcceptPredecessor != nil {
+		t.Fatalf("bad accept predecessor")
+	}
 }
 
 func fastConf() *Config {
@@ -162,6 +263,39 @@ func TestJoin(t *testing.T) {
 	r2.Shutdown()
 }
 
+func TestJoinRingIDMismatch(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	conf.RingID = "prod"
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+
+	// Joining with another ring ID is refused
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.RingID = "staging"
+	_, err = Join(conf2, ml, "test")
+	if err == nil || !strings.Contains(err.Error(), "Ring ID mismatch") {
+		t.Fatalf("expected ring ID err. %v", err)
+	}
+
+	// The matching ring ID joins
+	conf3 := fastConf()
+	conf3.Hostname = "test3"
+	conf3.RingID = "prod"
+	r3, err := Join(conf3, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	r3.Shutdown()
+}
+
 func TestJoinDeadHost(t *testing.T) {
 	// Create a multi transport
 	ml := InitMLTransport()
@@ -206,9 +340,11 @@ func TestLeave(t *testing.T) {
 	// Verify r2 ring is still in tact
 	num := len(r2.vnodes)
 	for idx, vn := range r2.vnodes {
-		if vn.successors[0] != &r2.vnodes[(idx+1)%num].Vnode {
-			t.Fatalf("bad successor! Got:%s:%s", vn.successors[0].Host,
-				vn.successors[0])
+		vn.lock.Lock()
+		succ := vn.successors[0]
+		vn.lock.Unlock()
+		if succ != &r2.vnodes[(idx+1)%num].Vnode {
+			t.Fatalf("bad successor! Got:%s:%s", succ.Host, succ)
 		}
 	}
 }
@@ -273,3 +409,707 @@ func TestLookup(t *testing.T) {
 		}
 	}
 }
+
+func TestLookupConcurrentStabilize(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create two rings that stabilize in the background
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+	defer r2.Shutdown()
+
+	// Lookups and on demand stabilization should not race with the
+	// timers, which is checked when testing with -race
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				r.Lookup(3, []byte("foo"))
+				r2.Stabilize()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestRejoin(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Create a second ring
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Simulate a partition, r2 only knows about itself
+	r2.stopVnodes()
+	r2.shutdown = nil
+	for _, vn := range r2.vnodes {
+		vn.lock.Lock()
+		for i := range vn.successors {
+			vn.successors[i] = nil
+		}
+		vn.lock.Unlock()
+	}
+	r2.setLocalSuccessors()
+
+	// Rejoin the ring
+	if err := r2.Rejoin("test"); err != nil {
+		t.Fatalf("failed to rejoin! Got %s", err)
+	}
+
+	// Should have a remote successor again
+	remote := false
+	for _, vn := range r2.vnodes {
+		for _, s := range vn.successors {
+			if s != nil && s.Host == "test" {
+				remote = true
+			}
+		}
+		if vn.successors[0].String() == vn.String() {
+			t.Fatalf("should not be our own successor!")
+		}
+	}
+	if !remote {
+		t.Fatalf("expected a remote successor!")
+	}
+
+	// Shutdown
+	r.Shutdown()
+}
+
+func TestScan(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Create a second ring
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Wait for some stabilization
+	<-time.After(100 * time.Millisecond)
+
+	// Scan the ring
+	var owners []*Vnode
+	var starts, ends [][]byte
+	err = r.Scan(context.Background(), func(owner *Vnode, start, end []byte) error {
+		owners = append(owners, owner)
+		starts = append(starts, start)
+		ends = append(ends, end)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Should visit every vnode once
+	if len(owners) != conf.NumVnodes+conf2.NumVnodes {
+		t.Fatalf("bad number of owners! %d", len(owners))
+	}
+
+	// Ranges should be contiguous
+	for i := 1; i < len(owners); i++ {
+		if !bytes.Equal(starts[i], ends[i-1]) {
+			t.Fatalf("ranges are not contiguous!")
+		}
+	}
+	if !bytes.Equal(starts[0], ends[len(ends)-1]) {
+		t.Fatalf("scan did not wrap around!")
+	}
+
+	// Shutdown
+	r.Shutdown()
+	r2.Shutdown()
+}
+
+func TestScanCancel(t *testing.T) {
+	conf := fastConf()
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = r.Scan(ctx, func(owner *Vnode, start, end []byte) error {
+		return nil
+	})
+	if err != context.Canceled {
+		t.Fatalf("expected cancel err. %v", err)
+	}
+}
+
+func TestLeaveSoleMember(t *testing.T) {
+	conf := fastConf()
+	conf.ManualStabilize = true
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		r.Stabilize()
+	}
+
+	// Leaving does not inform the local vnodes of each other
+	if err := r.Leave(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, vn := range r.vnodes {
+		if vn.predecessor == nil {
+			t.Fatalf("expected predecessor to be kept")
+		}
+	}
+}
+
+func TestLeaveTo(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Create a second ring
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Wait for some stabilization
+	<-time.After(100 * time.Millisecond)
+
+	// Should not leave to an unknown host
+	if err := r.LeaveTo("test3"); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Should leave to the other host
+	if err := r.LeaveTo("test2"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	ml.Deregister("test")
+	r2.Shutdown()
+}
+
+func TestRingHealth(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Create a second ring
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Wait for some stabilization
+	<-time.After(100 * time.Millisecond)
+
+	health, err := r.RingHealth(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(health) != conf.NumVnodes+conf2.NumVnodes {
+		t.Fatalf("bad number of records! %d", len(health))
+	}
+	for _, h := range health {
+		if h.Stale {
+			t.Fatalf("unexpected stale vnode! %v", h)
+		}
+		if h.Successors == 0 {
+			t.Fatalf("expected successors! %v", h)
+		}
+	}
+
+	// Stop stabilizing the second ring
+	r2.Shutdown()
+	<-time.After(2*conf.StabilizeMax + 10*time.Millisecond)
+	health, err = r.RingHealth(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, h := range health {
+		if h.Stale != (h.Vnode.Host == "test2") {
+			t.Fatalf("bad stale flag! %s %v", h.Vnode.Host, h.Stale)
+		}
+	}
+	r.Shutdown()
+}
+
+func TestManualStabilize(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	// Create the initial ring
+	conf := fastConf()
+	conf.ManualStabilize = true
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, vn := range r.vnodes {
+		if vn.timer != nil {
+			t.Fatalf("unexpected timer!")
+		}
+	}
+
+	// Create a second ring
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.ManualStabilize = true
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Nothing should stabilize on its own
+	<-time.After(50 * time.Millisecond)
+	for _, vn := range r.vnodes {
+		if vn.timer != nil || !vn.stabilized.IsZero() {
+			t.Fatalf("unexpected stabilize!")
+		}
+	}
+
+	// Drive the stabilization
+	r.Stabilize()
+	for _, vn := range r.vnodes {
+		if vn.stabilized.IsZero() {
+			t.Fatalf("expected stabilize!")
+		}
+	}
+
+	// Should shutdown without timers
+	r.Shutdown()
+	r2.Shutdown()
+}
+
+func TestLookupNoLiveSuccessors(t *testing.T) {
+	conf := fastConf()
+	conf.ManualStabilize = true
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+
+	// Only know of dead successors
+	for _, vn := range r.vnodes {
+		vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "dead"}
+		for i := 1; i < len(vn.successors); i++ {
+			vn.successors[i] = nil
+		}
+	}
+
+	_, err = r.Lookup(3, []byte("test"))
+	if err != ErrNoLiveSuccessors {
+		t.Fatalf("expected no live successors. %v", err)
+	}
+}
+
+func TestDumpDOT(t *testing.T) {
+	conf := fastConf()
+	conf.ManualStabilize = true
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	r.Stabilize()
+
+	var buf bytes.Buffer
+	if err := r.DumpDOT(&buf); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	out := buf.String()
+	if !strings.HasPrefix(out, "digraph chord {\n") || !strings.HasSuffix(out, "}\n") {
+		t.Fatalf("bad graph! %s", out)
+	}
+	if n := strings.Count(out, "style=filled"); n != conf.NumVnodes {
+		t.Fatalf("expected %d vnodes, got %d. %s", conf.NumVnodes, n, out)
+	}
+	if n := strings.Count(out, "[label=\"succ\"]"); n != conf.NumVnodes {
+		t.Fatalf("expected %d succ edges, got %d. %s", conf.NumVnodes, n, out)
+	}
+	if n := strings.Count(out, "[label=\"pred\", style=dashed]"); n != conf.NumVnodes {
+		t.Fatalf("expected %d pred edges, got %d. %s", conf.NumVnodes, n, out)
+	}
+}
+
+func TestPrefixKeyTransform(t *testing.T) {
+	tf := PrefixKeyTransform(2, sha1.New)
+	a := tf([]byte("t1/foo"))
+	b := tf([]byte("t1/bar"))
+	if len(a) != 20 || len(b) != 20 {
+		t.Fatalf("bad lengths %d %d", len(a), len(b))
+	}
+	if !bytes.Equal(a[:2], []byte("t1")) || !bytes.Equal(b[:2], []byte("t1")) {
+		t.Fatalf("prefix not kept! %x %x", a, b)
+	}
+	if bytes.Equal(a, b) {
+		t.Fatalf("expected different positions")
+	}
+
+	// Short keys are padded
+	c := tf([]byte("x"))
+	if c[0] != 'x' || c[1] != 0 {
+		t.Fatalf("bad short key! %x", c)
+	}
+}
+
+func TestLookupKeyTransform(t *testing.T) {
+	conf := fastConf()
+	conf.ManualStabilize = true
+	conf.KeyTransform = func(key []byte) []byte {
+		return key
+	}
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	r.Stabilize()
+
+	// Position must match the hash size
+	if _, err := r.Lookup(1, []byte("short")); err == nil {
+		t.Fatalf("expected err on bad position")
+	}
+
+	// Empty keys are rejected
+	if _, err := r.Lookup(1, nil); err != ErrEmptyKey {
+		t.Fatalf("expected empty key err. %v", err)
+	}
+
+	// The position is used directly, a vnode owns its own ID
+	vns, err := r.Lookup(1, r.vnodes[2].Id)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !bytes.Equal(vns[0].Id, r.vnodes[2].Id) {
+		t.Fatalf("bad successor! %x", vns[0].Id)
+	}
+}
+
+func TestTruncateBits(t *testing.T) {
+	ml := InitMLTransport()
+	conf := fastConf()
+	conf.ManualStabilize = true
+	conf.TruncateBits = 64
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.ManualStabilize = true
+	conf2.TruncateBits = 64
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r2.Shutdown()
+	for i := 0; i < 5; i++ {
+		r.Stabilize()
+		r2.Stabilize()
+	}
+
+	// The whole ring uses the truncated width
+	for _, vn := range r.vnodes {
+		if len(vn.Id) != 8 || len(vn.finger) != 64 {
+			t.Fatalf("bad width. %d %d", len(vn.Id), len(vn.finger))
+		}
+	}
+	vn1, err := r.Lookup(1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vn2, err := r2.Lookup(1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn1[0].String() != vn2[0].String() {
+		t.Fatalf("results differ!")
+	}
+
+	// Truncation must be a whole number of bytes within the hash
+	for _, bits := range []int{-8, 12, 168} {
+		conf := fastConf()
+		conf.TruncateBits = bits
+		if _, err := Create(conf, nil); err == nil {
+			t.Fatalf("expected err for %d bits", bits)
+		}
+	}
+}
+
+func TestRingBits(t *testing.T) {
+	ml := InitMLTransport()
+	conf := fastConf()
+	conf.ManualStabilize = true
+	conf.RingBits = 20
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	conf2 := fastConf()
+	conf2.Hostname = "test2"
+	conf2.ManualStabilize = true
+	conf2.RingBits = 20
+	r2, err := Join(conf2, ml, "test")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r2.Shutdown()
+	for i := 0; i < 5; i++ {
+		r.Stabilize()
+		r2.Stabilize()
+	}
+
+	// Every position fits in the smaller ring
+	for _, vn := range r.vnodes {
+		if len(vn.Id) != 3 || vn.Id[0] > 0x0f || len(vn.finger) != 20 {
+			t.Fatalf("bad width. %x %d", vn.Id, len(vn.finger))
+		}
+	}
+	for _, key := range []string{"foo", "bar", "baz", "zip"} {
+		vn1, err := r.Lookup(1, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		vn2, err := r2.Lookup(1, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		if vn1[0].String() != vn2[0].String() {
+			t.Fatalf("results differ!")
+		}
+	}
+
+	// The ring cannot be larger than the hash
+	for _, bits := range []int{-1, 161} {
+		conf := fastConf()
+		conf.RingBits = bits
+		if _, err := Create(conf, nil); err == nil {
+			t.Fatalf("expected err for %d bits", bits)
+		}
+	}
+	conf = fastConf()
+	conf.TruncateBits = 64
+	conf.RingBits = 65
+	if _, err := Create(conf, nil); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestRingWrapTransport(t *testing.T) {
+	// Create a multi transport
+	ml := InitMLTransport()
+
+	conf := fastConf()
+	conf.ManualStabilize = true
+	r, err := Create(conf, ml)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+
+	// The accessor can list our own vnodes
+	vns, err := r.Transport().ListVnodes("test")
+	if err != nil || len(vns) != conf.NumVnodes {
+		t.Fatalf("bad vnodes! %v %v", vns, err)
+	}
+
+	// Partition remote hosts with a fault transport
+	var ft *FaultTransport
+	r.WrapTransport(func(trans Transport) Transport {
+		if trans != ml {
+			t.Fatalf("expected the original transport")
+		}
+
+		// The transport can be used while wrapping
+		if _, err := r.Transport().ListVnodes("test"); err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		ft = InitFaultTransport(trans)
+		return ft
+	})
+	ft.Partition("test2")
+	if _, err := r.Transport().ListVnodes("test2"); err == nil || !strings.Contains(err.Error(), "Partitioned") {
+		t.Fatalf("expected partition err. %v", err)
+	}
+
+	// Local vnodes are still reachable
+	if _, err := r.Transport().ListVnodes("test"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+}
+
+func TestSetMaxVnodes(t *testing.T) {
+	// Other tests may leave rings running
+	vnodeBudget.Lock()
+	used := vnodeBudget.used
+	vnodeBudget.Unlock()
+	SetMaxVnodes(used + 10)
+	defer SetMaxVnodes(0)
+
+	conf := fastConf()
+	conf.ManualStabilize = true
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Would exceed the budget
+	conf2 := fastConf()
+	conf2.ManualStabilize = true
+	if _, err := Create(conf2, nil); err == nil {
+		t.Fatalf("expected budget err")
+	}
+
+	// Shutting down returns the vnodes
+	r.Shutdown()
+	r, err = Create(conf2, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r.Shutdown()
+	r.Shutdown()
+
+	vnodeBudget.Lock()
+	defer vnodeBudget.Unlock()
+	if vnodeBudget.used != used {
+		t.Fatalf("vnodes leaked! %d %d", vnodeBudget.used, used)
+	}
+}
+
+func TestRemoveVnodesShutdownBudget(t *testing.T) {
+	vnodeBudget.Lock()
+	used := vnodeBudget.used
+	vnodeBudget.Unlock()
+	SetMaxVnodes(used + 10)
+	defer SetMaxVnodes(0)
+
+	conf := fastConf()
+	conf.ManualStabilize = true
+	r, err := Create(conf, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Removing vnodes while shutting down returns each vnode once
+	done := make(chan struct{})
+	go func() {
+		r.RemoveVnodes(2)
+		close(done)
+	}()
+	r.Shutdown()
+	<-done
+
+	vnodeBudget.Lock()
+	defer vnodeBudget.Unlock()
+	if vnodeBudget.used != used {
+		t.Fatalf("vnodes leaked! %d %d", vnodeBudget.used, used)
+	}
+}
+
+func TestClientLookup(t *testing.T) {
+	c := stableCluster(t, 2, nil)
+
+	// Should match a lookup from a ring member
+	key := []byte("test")
+	for _, seed := range []string{"host0", "host1"} {
+		checkClientLookup(t, c, inmemConf("client"), seed, key)
+	}
+
+	// Unknown seed
+	if _, err := ClientLookup(inmemConf("client"), c.Transport, "host2", 3, key); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// Empty key
+	if _, err := ClientLookup(inmemConf("client"), c.Transport, "host0", 3, nil); err != ErrEmptyKey {
+		t.Fatalf("expected empty key err. %v", err)
+	}
+}
+
+func TestClientLookupConfig(t *testing.T) {
+	prefixKeys := func(conf *Config) {
+		conf.KeyTransform = PrefixKeyTransform(2, sha1.New)
+	}
+	c := stableCluster(t, 2, prefixKeys)
+	client := inmemConf("client")
+	prefixKeys(client)
+
+	// Keys are placed with the KeyTransform of the config
+	for _, key := range []string{"aa-foo", "mm-bar", "zz-baz"} {
+		checkClientLookup(t, c, client, "host1", []byte(key))
+	}
+}
+
+// Checks a ClientLookup agrees with a lookup from a ring member
+func checkClientLookup(t *testing.T, c *inmemCluster, conf *Config, seed string, key []byte) {
+	expect, err := c.Ring("host0").Lookup(3, key)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vns, err := ClientLookup(conf, c.Transport, seed, 3, key)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(vns) != len(expect) {
+		t.Fatalf("bad lookup! %v %v", vns, expect)
+	}
+	for i := range vns {
+		if vns[i].String() != expect[i].String() {
+			t.Fatalf("bad lookup of %q! %v %v", key, vns, expect)
+		}
+	}
+}
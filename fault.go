@@ -0,0 +1,292 @@
+package chord
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// FaultTransport wraps another Transport and is used to inject faults,
+// for testing the resilience of a ring to adverse network conditions.
+// Latency and error rates are configured per method, using the name of
+// the Transport method (e.g. "Ping"). Partitioned hosts are unreachable
+// for all methods. Register is always passed through.
+//
+// Single vnodes may also be killed, or have the successors returned by
+// Notify overridden. With ManualStabilize, this forces the outcome of
+// the stabilize phases of the vnodes calling them, such as a successor
+// being found dead, for testing how a Delegate reacts to ring churn.
+type FaultTransport struct {
+	remote      Transport
+	lock        sync.RWMutex
+	latency     map[string]time.Duration
+	errRate     map[string]float64
+	partitioned map[string]struct{}
+	dead        map[string]struct{}
+	notify      map[string][]*Vnode
+}
+
+// Creates a fault transport to wrap a remote transport
+func InitFaultTransport(remote Transport) *FaultTransport {
+	return &FaultTransport{
+		remote:      remote,
+		latency:     make(map[string]time.Duration),
+		errRate:     make(map[string]float64),
+		partitioned: make(map[string]struct{}),
+		dead:        make(map[string]struct{}),
+		notify:      make(map[string][]*Vnode),
+	}
+}
+
+// Sets the latency added to every call of a method
+func (ft *FaultTransport) SetLatency(method string, latency time.Duration) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.latency[method] = latency
+}
+
+// Sets the fraction of calls to a method that will fail, between 0 and 1
+func (ft *FaultTransport) SetErrorRate(method string, rate float64) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.errRate[method] = rate
+}
+
+// Partitions a host, causing all calls to it to fail
+func (ft *FaultTransport) Partition(host string) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.partitioned[host] = struct{}{}
+}
+
+// Heals a partitioned host
+func (ft *FaultTransport) Heal(host string) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	delete(ft.partitioned, host)
+}
+
+// Kills a vnode until it is revived. Pings confirm it dead, and all
+// other calls to it fail, while the rest of its host is reachable.
+func (ft *FaultTransport) KillVnode(vn *Vnode) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	ft.dead[faultKey(vn)] = struct{}{}
+}
+
+// Revives a killed vnode
+func (ft *FaultTransport) ReviveVnode(vn *Vnode) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	delete(ft.dead, faultKey(vn))
+}
+
+// Sets the successors returned by every Notify of the target vnode,
+// instead of passing the call on. A nil list removes the override.
+func (ft *FaultTransport) SetNotifyResult(target *Vnode, succs []*Vnode) {
+	ft.lock.Lock()
+	defer ft.lock.Unlock()
+	if succs == nil {
+		delete(ft.notify, faultKey(target))
+		return
+	}
+	cp := make([]*Vnode, len(succs))
+	copy(cp, succs)
+	ft.notify[faultKey(target)] = cp
+}
+
+// Returns the key of a vnode for the fault maps
+func faultKey(vn *Vnode) string {
+	return vn.Host + "/" + vn.String()
+}
+
+// Checks if a vnode has been killed
+func (ft *FaultTransport) killed(vn *Vnode) bool {
+	ft.lock.RLock()
+	defer ft.lock.RUnlock()
+	_, ok := ft.dead[faultKey(vn)]
+	return ok
+}
+
+// Applies any configured faults for a call to a vnode
+func (ft *FaultTransport) faultVnode(method string, vn *Vnode) error {
+	if err := ft.fault(method, vn.Host); err != nil {
+		return err
+	}
+	if ft.killed(vn) {
+		return fmt.Errorf("Injected dead vnode! %s to %s", method, vn.String())
+	}
+	return nil
+}
+
+// Applies any configured faults for a call to a host
+func (ft *FaultTransport) fault(method, host string) error {
+	ft.lock.RLock()
+	latency := ft.latency[method]
+	rate := ft.errRate[method]
+	_, partitioned := ft.partitioned[host]
+	ft.lock.RUnlock()
+
+	if latency > 0 {
+		time.Sleep(latency)
+	}
+	if partitioned {
+		return fmt.Errorf("Failed to connect! Partitioned: %s", host)
+	}
+	if rate > 0 && rand.Float64() < rate {
+		return fmt.Errorf("Injected fault! %s to %s", method, host)
+	}
+	return nil
+}
+
+func (ft *FaultTransport) ListVnodes(host string) ([]*Vnode, error) {
+	if err := ft.fault("ListVnodes", host); err != nil {
+		return nil, err
+	}
+	return ft.remote.ListVnodes(host)
+}
+
+func (ft *FaultTransport) ListVnodesInRange(host string, start, end []byte) ([]*Vnode, error) {
+	if err := ft.fault("ListVnodes", host); err != nil {
+		return nil, err
+	}
+	return listVnodesInRange(ft.remote, host, start, end)
+}
+
+func (ft *FaultTransport) Ping(vn *Vnode) (bool, error) {
+	if err := ft.fault("Ping", vn.Host); err != nil {
+		return false, err
+	}
+	if ft.killed(vn) {
+		return false, nil
+	}
+	return ft.remote.Ping(vn)
+}
+
+// BatchPing applies faults once per host. Vnodes on a faulted host and
+// killed vnodes are reported dead, and the rest are passed onto the remote.
+func (ft *FaultTransport) BatchPing(vns []*Vnode) ([]bool, error) {
+	res := make([]bool, len(vns))
+	faults := make(map[string]error)
+	var err error
+	var pass []*Vnode
+	var passIdx []int
+	for idx, vn := range vns {
+		hostErr, ok := faults[vn.Host]
+		if !ok {
+			hostErr = ft.fault("BatchPing", vn.Host)
+			faults[vn.Host] = hostErr
+		}
+		if hostErr != nil {
+			err = hostErr
+			continue
+		}
+		if ft.killed(vn) {
+			continue
+		}
+		pass = append(pass, vn)
+		passIdx = append(passIdx, idx)
+	}
+	if len(pass) == 0 {
+		return res, err
+	}
+
+	alive, remoteErr := ft.remote.BatchPing(pass)
+	for i, idx := range passIdx {
+		if i < len(alive) {
+			res[idx] = alive[i]
+		}
+	}
+	if remoteErr != nil {
+		err = remoteErr
+	}
+	return res, err
+}
+
+func (ft *FaultTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	if err := ft.faultVnode("GetPredecessor", vn); err != nil {
+		return nil, err
+	}
+	return ft.remote.GetPredecessor(vn)
+}
+
+func (ft *FaultTransport) Notify(target, self *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	if err := ft.faultVnode("Notify", target); err != nil {
+		return nil, nil, err
+	}
+	ft.lock.RLock()
+	succs, ok := ft.notify[faultKey(target)]
+	ft.lock.RUnlock()
+	if ok {
+		res := make([]*Vnode, len(succs))
+		copy(res, succs)
+		return res, nil, nil
+	}
+	return ft.remote.Notify(target, self, payload)
+}
+
+func (ft *FaultTransport) NotifyLoad(target, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	if err := ft.faultVnode("Notify", target); err != nil {
+		return nil, nil, nil, err
+	}
+	ft.lock.RLock()
+	succs, ok := ft.notify[faultKey(target)]
+	ft.lock.RUnlock()
+	if ok {
+		res := make([]*Vnode, len(succs))
+		copy(res, succs)
+		return res, nil, nil, nil
+	}
+	return notifyLoad(ft.remote, target, self, payload, load)
+}
+
+func (ft *FaultTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	if err := ft.faultVnode("FindSuccessors", vn); err != nil {
+		return nil, nil, err
+	}
+	return ft.remote.FindSuccessors(vn, n, key, visited)
+}
+
+func (ft *FaultTransport) FindSuccessorsTrace(vn *Vnode, n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	if err := ft.faultVnode("FindSuccessors", vn); err != nil {
+		return nil, nil, err
+	}
+	return findSuccessorsTrace(ft.remote, vn, n, key, visited, trace)
+}
+
+func (ft *FaultTransport) ClearPredecessor(target, self *Vnode) error {
+	if err := ft.faultVnode("ClearPredecessor", target); err != nil {
+		return err
+	}
+	return ft.remote.ClearPredecessor(target, self)
+}
+
+func (ft *FaultTransport) SkipSuccessor(target, self *Vnode) error {
+	if err := ft.faultVnode("SkipSuccessor", target); err != nil {
+		return err
+	}
+	return ft.remote.SkipSuccessor(target, self)
+}
+
+func (ft *FaultTransport) Health(vn *Vnode) (*VnodeHealth, error) {
+	if err := ft.faultVnode("Health", vn); err != nil {
+		return nil, err
+	}
+	return ft.remote.Health(vn)
+}
+
+func (ft *FaultTransport) Register(v *Vnode, o VnodeRPC) {
+	ft.remote.Register(v, o)
+}
+
+func (ft *FaultTransport) Deregister(v *Vnode) {
+	if d, ok := ft.remote.(deregisterer); ok {
+		d.Deregister(v)
+	}
+}
+
+func (ft *FaultTransport) registered(host string) bool {
+	reg, ok := ft.remote.(registrar)
+	return ok && reg.registered(host)
+}
@@ -0,0 +1,113 @@
+package chord
+
+import (
+	"testing"
+	"time"
+)
+
+func makeFault() (*FaultTransport, *Vnode) {
+	l := makeLocal()
+	vn := &Vnode{Id: []byte{1}, Host: "test"}
+	l.Register(vn, &MockVnodeRPC{})
+	return InitFaultTransport(l), vn
+}
+
+func TestFaultPassThrough(t *testing.T) {
+	ft, vn := makeFault()
+	if res, err := ft.Ping(vn); !res || err != nil {
+		t.Fatalf("ping failed")
+	}
+	list, err := ft.ListVnodes("test")
+	if err != nil || len(list) != 1 {
+		t.Fatalf("list failed")
+	}
+}
+
+func TestFaultPartition(t *testing.T) {
+	ft, vn := makeFault()
+	ft.Partition("test")
+	if res, err := ft.Ping(vn); res || err == nil {
+		t.Fatalf("expected fail")
+	}
+	if _, err := ft.ListVnodes("test"); err == nil {
+		t.Fatalf("expected fail")
+	}
+	if err := ft.SkipSuccessor(vn, vn); err == nil {
+		t.Fatalf("expected fail")
+	}
+
+	ft.Heal("test")
+	if res, err := ft.Ping(vn); !res || err != nil {
+		t.Fatalf("ping failed")
+	}
+}
+
+func TestFaultErrorRate(t *testing.T) {
+	ft, vn := makeFault()
+	ft.SetErrorRate("Ping", 1)
+	if _, err := ft.Ping(vn); err == nil {
+		t.Fatalf("expected fail")
+	}
+	if _, err := ft.GetPredecessor(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+}
+
+func TestFaultLatency(t *testing.T) {
+	ft, vn := makeFault()
+	ft.SetLatency("Ping", 20*time.Millisecond)
+	start := time.Now()
+	if res, err := ft.Ping(vn); !res || err != nil {
+		t.Fatalf("ping failed")
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("expected latency")
+	}
+}
+
+func TestFaultKillVnode(t *testing.T) {
+	ft, vn := makeFault()
+	other := &Vnode{Id: []byte{2}, Host: "test"}
+	ft.remote.Register(other, &MockVnodeRPC{})
+	ft.KillVnode(vn)
+	if res, err := ft.Ping(vn); res || err != nil {
+		t.Fatalf("expected dead vnode. %v %v", res, err)
+	}
+	if res, err := ft.BatchPing([]*Vnode{vn, other}); res[0] || !res[1] || err != nil {
+		t.Fatalf("expected only vn dead. %v %v", res, err)
+	}
+	if _, err := ft.GetPredecessor(vn); err == nil {
+		t.Fatalf("expected fail")
+	}
+
+	ft.ReviveVnode(vn)
+	if res, err := ft.Ping(vn); !res || err != nil {
+		t.Fatalf("ping failed")
+	}
+}
+
+func TestFaultNotifyResult(t *testing.T) {
+	c := stableCluster(t, 2, nil)
+	var ft *FaultTransport
+	r := c.Ring("host0")
+	r.WrapTransport(func(trans Transport) Transport {
+		ft = InitFaultTransport(trans)
+		return ft
+	})
+
+	// Force the successors of a vnode to be replaced on notify
+	vn := r.localVnodes()[0]
+	vn.lock.Lock()
+	succ := vn.successors[0]
+	vn.lock.Unlock()
+	forced := c.Ring("host1").localVnodes()[3]
+	ft.SetNotifyResult(succ, []*Vnode{&forced.Vnode})
+	if err := vn.notifySuccessor(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if !vn.successors[1].Equal(&forced.Vnode) {
+		t.Fatalf("expected forced successor. %v", vn.successors)
+	}
+}
@@ -0,0 +1,354 @@
+package chord
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// inmemTransport is a Transport that connects rings running in the same
+// process, without using the network. Each ring wraps it in its own
+// LocalTransport, and any request for another host is routed directly
+// to the vnodes registered by that host. Hosts may be failed to simulate
+// a host that cannot be reached. It is exported as InmemTransport with
+// the chordtest build tag.
+type inmemTransport struct {
+	lock   sync.RWMutex
+	hosts  map[string]map[string]*localRPC
+	failed map[string]struct{}
+}
+
+// Creates a new in-memory transport
+func initInmemTransport() *inmemTransport {
+	return &inmemTransport{
+		hosts:  make(map[string]map[string]*localRPC),
+		failed: make(map[string]struct{}),
+	}
+}
+
+// Fails a host, making it unreachable until it is recovered
+func (it *inmemTransport) Fail(host string) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	it.failed[host] = struct{}{}
+}
+
+// Recovers a failed host
+func (it *inmemTransport) Recover(host string) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	delete(it.failed, host)
+}
+
+// Removes all the vnodes registered by a host, which are then
+// confirmed dead to any pings
+func (it *inmemTransport) Remove(host string) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	delete(it.hosts, host)
+}
+
+// Deregisters a single vnode, which is then confirmed dead to pings
+func (it *inmemTransport) Deregister(v *Vnode) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	delete(it.hosts[v.Host], v.String())
+}
+
+// Checks that a host can be reached
+func (it *inmemTransport) reach(host string) (map[string]*localRPC, error) {
+	it.lock.RLock()
+	defer it.lock.RUnlock()
+	if _, ok := it.failed[host]; ok {
+		return nil, fmt.Errorf("Failed to connect! Failed host: %s", host)
+	}
+	return it.hosts[host], nil
+}
+
+// Gets a registered vnode, or an error if it cannot be reached
+func (it *inmemTransport) get(vn *Vnode) (VnodeRPC, error) {
+	local, err := it.reach(vn.Host)
+	if err != nil {
+		return nil, err
+	}
+	it.lock.RLock()
+	w, ok := local[vn.String()]
+	it.lock.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Target VN not found! Target %s:%s",
+			vn.Host, vn.String())
+	}
+	return w.obj, nil
+}
+
+func (it *inmemTransport) ListVnodes(host string) ([]*Vnode, error) {
+	local, err := it.reach(host)
+	if err != nil {
+		return nil, err
+	}
+	it.lock.RLock()
+	res := make([]*Vnode, 0, len(local))
+	for _, v := range local {
+		res = append(res, v.vnode)
+	}
+	it.lock.RUnlock()
+	return res, nil
+}
+
+func (it *inmemTransport) ListVnodesInRange(host string, start, end []byte) ([]*Vnode, error) {
+	vnodes, err := it.ListVnodes(host)
+	if err != nil {
+		return nil, err
+	}
+	return filterRange(vnodes, start, end), nil
+}
+
+func (it *inmemTransport) Ping(vn *Vnode) (bool, error) {
+	local, err := it.reach(vn.Host)
+	if err != nil {
+		return false, err
+	}
+	it.lock.RLock()
+	_, ok := local[vn.String()]
+	it.lock.RUnlock()
+	return ok, nil
+}
+
+func (it *inmemTransport) BatchPing(vns []*Vnode) ([]bool, error) {
+	res := make([]bool, len(vns))
+	var err error
+	for idx, vn := range vns {
+		alive, pingErr := it.Ping(vn)
+		res[idx] = alive
+		if pingErr != nil {
+			err = pingErr
+		}
+	}
+	return res, err
+}
+
+func (it *inmemTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	obj, err := it.get(vn)
+	if err != nil {
+		return nil, err
+	}
+	return obj.GetPredecessor()
+}
+
+func (it *inmemTransport) Notify(target, self *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	obj, err := it.get(target)
+	if err != nil {
+		return nil, nil, err
+	}
+	succs, resp, err := obj.Notify(self, payload)
+	return trimSlice(succs), resp, err
+}
+
+func (it *inmemTransport) NotifyLoad(target, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	obj, err := it.get(target)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	succs, resp, respLoad, err := rpcNotifyLoad(obj, self, payload, load)
+	return trimSlice(succs), resp, respLoad, err
+}
+
+func (it *inmemTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	obj, err := it.get(vn)
+	if err != nil {
+		return nil, nil, err
+	}
+	succs, path, err := obj.FindSuccessors(n, key, visited)
+	return trimSlice(succs), path, err
+}
+
+func (it *inmemTransport) FindSuccessorsTrace(vn *Vnode, n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	obj, err := it.get(vn)
+	if err != nil {
+		return nil, nil, err
+	}
+	succs, path, err := rpcFindSuccessorsTrace(obj, n, key, visited, trace)
+	return trimSlice(succs), path, err
+}
+
+func (it *inmemTransport) ClearPredecessor(target, self *Vnode) error {
+	obj, err := it.get(target)
+	if err != nil {
+		return err
+	}
+	return obj.ClearPredecessor(self)
+}
+
+func (it *inmemTransport) SkipSuccessor(target, self *Vnode) error {
+	obj, err := it.get(target)
+	if err != nil {
+		return err
+	}
+	return obj.SkipSuccessor(self)
+}
+
+func (it *inmemTransport) Health(vn *Vnode) (*VnodeHealth, error) {
+	obj, err := it.get(vn)
+	if err != nil {
+		return nil, err
+	}
+	return obj.Health()
+}
+
+// Checks if vnodes of a host are registered, even if it has failed
+func (it *inmemTransport) registered(host string) bool {
+	it.lock.RLock()
+	defer it.lock.RUnlock()
+	return len(it.hosts[host]) > 0
+}
+
+func (it *inmemTransport) Register(v *Vnode, o VnodeRPC) {
+	it.lock.Lock()
+	defer it.lock.Unlock()
+	local, ok := it.hosts[v.Host]
+	if !ok {
+		local = make(map[string]*localRPC)
+		it.hosts[v.Host] = local
+	}
+	local[v.String()] = &localRPC{v, o}
+}
+
+// inmemCluster manages a set of rings connected by an inmemTransport,
+// so that tests can drive several hosts deterministically.
+// Using a config with ManualStabilize set, the rings only change state
+// when Stabilize is invoked. It is exported as InmemCluster with the
+// chordtest build tag.
+type inmemCluster struct {
+	Transport *inmemTransport
+	conf      func(host string) *Config
+	lock      sync.Mutex
+	rings     map[string]*Ring
+}
+
+// Creates a cluster of n rings, with hosts named "host0" to "hostN-1".
+// The first host creates the ring, and the rest join it in order. The
+// conf function returns the config to use for each host, and must set
+// the Hostname to the given host.
+func initInmemCluster(n int, conf func(host string) *Config) (*inmemCluster, error) {
+	c := &inmemCluster{
+		Transport: initInmemTransport(),
+		conf:      conf,
+		rings:     make(map[string]*Ring),
+	}
+	for i := 0; i < n; i++ {
+		host := fmt.Sprintf("host%d", i)
+		if _, err := c.Join(host); err != nil {
+			c.Shutdown()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Joins a new host to the cluster. If the cluster is empty, a new
+// ring is created instead.
+func (c *inmemCluster) Join(host string) (*Ring, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if _, ok := c.rings[host]; ok {
+		return nil, fmt.Errorf("Host %s is already in the cluster!", host)
+	}
+
+	var r *Ring
+	var err error
+	if existing := c.anyHost(); existing == "" {
+		r, err = Create(c.conf(host), c.Transport)
+	} else {
+		r, err = Join(c.conf(host), c.Transport, existing)
+	}
+	if err != nil {
+		c.Transport.Remove(host)
+		return nil, err
+	}
+	c.rings[host] = r
+	return r, nil
+}
+
+// Returns any live host in the cluster, or an empty string
+func (c *inmemCluster) anyHost() string {
+	for _, host := range c.sortedHosts() {
+		if _, err := c.Transport.reach(host); err == nil {
+			return host
+		}
+	}
+	return ""
+}
+
+// Returns the hosts in the cluster in sorted order
+func (c *inmemCluster) sortedHosts() []string {
+	hosts := make([]string, 0, len(c.rings))
+	for host := range c.rings {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+// Gracefully leaves the ring with a host, and removes it
+func (c *inmemCluster) Leave(host string) error {
+	c.lock.Lock()
+	r, ok := c.rings[host]
+	delete(c.rings, host)
+	c.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("Host %s is not in the cluster!", host)
+	}
+	err := r.Leave()
+	c.Transport.Remove(host)
+	return err
+}
+
+// Simulates a host crashing. It is shutdown without leaving, and its
+// vnodes are removed so they are confirmed dead.
+func (c *inmemCluster) Kill(host string) error {
+	c.lock.Lock()
+	r, ok := c.rings[host]
+	delete(c.rings, host)
+	c.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("Host %s is not in the cluster!", host)
+	}
+	r.Shutdown()
+	c.Transport.Remove(host)
+	return nil
+}
+
+// Returns the ring of a host, or nil
+func (c *inmemCluster) Ring(host string) *Ring {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.rings[host]
+}
+
+// Stabilizes every ring in the cluster once, in host order. Failed
+// hosts are skipped.
+func (c *inmemCluster) Stabilize() {
+	c.lock.Lock()
+	var rings []*Ring
+	for _, host := range c.sortedHosts() {
+		if _, err := c.Transport.reach(host); err == nil {
+			rings = append(rings, c.rings[host])
+		}
+	}
+	c.lock.Unlock()
+	for _, r := range rings {
+		r.Stabilize()
+	}
+}
+
+// Shuts down every ring in the cluster
+func (c *inmemCluster) Shutdown() {
+	c.lock.Lock()
+	rings := c.rings
+	c.rings = make(map[string]*Ring)
+	c.lock.Unlock()
+	for host, r := range rings {
+		r.Shutdown()
+		c.Transport.Remove(host)
+	}
+}
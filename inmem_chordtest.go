@@ -0,0 +1,30 @@
+//go:build chordtest
+
+package chord
+
+// InmemTransport is a Transport that connects rings running in the same
+// process, without using the network, so that applications can test
+// their use of Chord without opening ports. Hosts may be failed with
+// Fail and recovered with Recover. It is only built with the chordtest
+// build tag, as with "go test -tags chordtest".
+type InmemTransport = inmemTransport
+
+// InmemCluster manages a set of rings connected by an InmemTransport.
+// Hosts may be joined, gracefully left, or killed to simulate a crash.
+// Using a config with ManualStabilize set, the rings only change state
+// when Stabilize is invoked, so tests are deterministic. It is only
+// built with the chordtest build tag.
+type InmemCluster = inmemCluster
+
+// InitInmemTransport creates a new in-memory transport
+func InitInmemTransport() *InmemTransport {
+	return initInmemTransport()
+}
+
+// InitInmemCluster creates a cluster of n rings, with hosts named
+// "host0" to "hostN-1". The first host creates the ring, and the rest
+// join it in order. The conf function returns the config to use for
+// each host, and must set the Hostname to the given host.
+func InitInmemCluster(n int, conf func(host string) *Config) (*InmemCluster, error) {
+	return initInmemCluster(n, conf)
+}
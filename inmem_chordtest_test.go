@@ -0,0 +1,36 @@
+//go:build chordtest
+
+package chord
+
+import (
+	"testing"
+)
+
+func TestExportedInmemCluster(t *testing.T) {
+	c, err := InitInmemCluster(3, inmemConf)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	settle(c)
+
+	// Simulate a failed host, and one that leaves
+	var trans *InmemTransport = c.Transport
+	trans.Fail("host2")
+	if _, err := c.Ring("host0").Lookup(1, []byte("foo")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	trans.Recover("host2")
+	if err := c.Leave("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := c.Kill("host2"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	settle(c)
+	if _, err := c.Join("host3"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	settle(c)
+	checkLookups(t, c, []string{"host0", "host3"})
+}
@@ -0,0 +1,981 @@
+package chord
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
+	"sort"
+	"testing"
+	"time"
+)
+
+func inmemConf(host string) *Config {
+	conf := DefaultConfig(host)
+	conf.NumVnodes = 4
+	conf.ManualStabilize = true
+	return conf
+}
+
+// Creates a stabilized cluster of n hosts, failing the test on error.
+// Each host uses the inmemConf, passed to conf if set to adjust it. The
+// cluster is shutdown once the test completes.
+func stableCluster(t *testing.T, n int, conf func(*Config)) *inmemCluster {
+	c, err := initInmemCluster(n, func(host string) *Config {
+		hostConf := inmemConf(host)
+		if conf != nil {
+			conf(hostConf)
+		}
+		return hostConf
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	t.Cleanup(c.Shutdown)
+	settle(c)
+	return c
+}
+
+// Stabilizes every ring of a cluster enough times to converge
+func settle(c *inmemCluster) {
+	for i := 0; i < 5; i++ {
+		c.Stabilize()
+	}
+}
+
+// Checks every host agrees on the owner of some keys
+func checkLookups(t *testing.T, c *inmemCluster, hosts []string) {
+	for _, key := range []string{"foo", "bar", "baz", "zip"} {
+		var owner *Vnode
+		for _, host := range hosts {
+			vns, err := c.Ring(host).Lookup(1, []byte(key))
+			if err != nil {
+				t.Fatalf("unexpected err. %s", err)
+			}
+			if owner == nil {
+				owner = vns[0]
+			} else if !bytes.Equal(owner.Id, vns[0].Id) {
+				t.Fatalf("hosts disagree on %s! %s %s", key, owner.Host, vns[0].Host)
+			}
+		}
+		found := false
+		for _, host := range hosts {
+			found = found || owner.Host == host
+		}
+		if !found {
+			t.Fatalf("key %s owned by departed host %s", key, owner.Host)
+		}
+	}
+}
+
+func TestInmemCluster(t *testing.T) {
+	c := stableCluster(t, 4, nil)
+	checkLookups(t, c, []string{"host0", "host1", "host2", "host3"})
+
+	// Gracefully leave
+	if err := c.Leave("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if c.Ring("host1") != nil {
+		t.Fatalf("expected host to be removed")
+	}
+	settle(c)
+	checkLookups(t, c, []string{"host0", "host2", "host3"})
+
+	// Crash a host
+	if err := c.Kill("host2"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	settle(c)
+	checkLookups(t, c, []string{"host0", "host3"})
+
+	// Join a new host
+	if _, err := c.Join("host4"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := c.Join("host4"); err == nil {
+		t.Fatalf("expected duplicate join err")
+	}
+	settle(c)
+	checkLookups(t, c, []string{"host0", "host3", "host4"})
+}
+
+func TestInmemTransportFail(t *testing.T) {
+	it := initInmemTransport()
+	vn := &Vnode{Id: []byte{1}, Host: "test"}
+	it.Register(vn, &MockVnodeRPC{})
+
+	if res, err := it.Ping(vn); !res || err != nil {
+		t.Fatalf("expected live vnode. %v %v", res, err)
+	}
+
+	// Failed hosts cannot be reached
+	it.Fail("test")
+	if _, err := it.Ping(vn); err == nil {
+		t.Fatalf("expected err")
+	}
+	if _, err := it.ListVnodes("test"); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// Removed vnodes are confirmed dead
+	it.Recover("test")
+	it.Remove("test")
+	if res, err := it.Ping(vn); res || err != nil {
+		t.Fatalf("expected dead vnode. %v %v", res, err)
+	}
+	if _, err := it.GetPredecessor(vn); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestRingExportImportState(t *testing.T) {
+	c := stableCluster(t, 2, nil)
+	old := c.Ring("host1")
+	state, err := old.ExportState()
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Restart the host, and restore the routing state
+	if err := c.Kill("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r, err := Create(inmemConf("host1"), c.Transport)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	if err := r.ImportState(state); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for idx, vn := range r.vnodes {
+		prev := old.vnodes[idx]
+		for i, succ := range vn.successors {
+			if (succ == nil) != (prev.successors[i] == nil) ||
+				succ != nil && succ.String() != prev.successors[i].String() {
+				t.Fatalf("successor mismatch at %d. %v %v", i, succ, prev.successors[i])
+			}
+		}
+		if vn.predecessor.String() != prev.predecessor.String() {
+			t.Fatalf("predecessor mismatch")
+		}
+		if vn.finger[0].String() != prev.finger[0].String() {
+			t.Fatalf("finger mismatch")
+		}
+	}
+
+	// Routing is usable without stabilizing
+	for _, key := range []string{"foo", "bar", "baz"} {
+		a, err := r.Lookup(1, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		b, err := c.Ring("host0").Lookup(1, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		if a[0].String() != b[0].String() {
+			t.Fatalf("lookup mismatch for %s", key)
+		}
+	}
+
+	// Bad versions are rejected
+	var buf bytes.Buffer
+	gob.NewEncoder(&buf).Encode(&ringState{Version: stateVersion + 1})
+	if err := r.ImportState(buf.Bytes()); err == nil {
+		t.Fatalf("expected version err")
+	}
+}
+
+func TestRingDrainAndLeave(t *testing.T) {
+	d := &MockDelegate{}
+	c := stableCluster(t, 2, func(conf *Config) {
+		if conf.Hostname == "host1" {
+			conf.Delegate = d
+		}
+	})
+	r := c.Ring("host1")
+
+	// A cancelled drain does not leave
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := r.DrainAndLeave(ctx, nil); err != context.Canceled {
+		t.Fatalf("expected cancel err. %v", err)
+	}
+	if h, _ := r.vnodes[0].Health(); h.Draining {
+		t.Fatalf("expected drain to stop")
+	}
+
+	// Requests are served until done is closed
+	done := make(chan struct{})
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- r.DrainAndLeave(context.Background(), done)
+	}()
+	for {
+		if h, _ := r.vnodes[0].Health(); h.Draining {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := c.Ring("host0").Lookup(1, []byte("foo")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	close(done)
+	if err := <-errCh; err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	delete(c.rings, "host1")
+	if len(d.draining) != 2*len(r.vnodes) || !d.shutdown {
+		t.Fatalf("bad delegate calls. %d %v", len(d.draining), d.shutdown)
+	}
+}
+
+func TestRingIsolatedDelegate(t *testing.T) {
+	d := &MockDelegate{}
+	conf := func(host string) *Config {
+		conf := inmemConf(host)
+		if host == "host0" {
+			conf.Delegate = d
+		}
+		return conf
+	}
+	c, err := initInmemCluster(1, conf)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	r := c.Ring("host0")
+
+	// Stabilizes, then waits for the queued delegate callbacks
+	stabilize := func() {
+		settle(c)
+		<-r.queueDelegate(func(Delegate) {}, true)
+	}
+
+	// A new ring starts isolated
+	stabilize()
+	if d.isolated != 0 || d.joined != 0 {
+		t.Fatalf("unexpected callbacks. %d %d", d.isolated, d.joined)
+	}
+
+	// Every vnode gains a remote successor
+	if _, err := c.Join("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	stabilize()
+	if d.isolated != 0 || d.joined != len(r.vnodes) {
+		t.Fatalf("unexpected callbacks. %d %d", d.isolated, d.joined)
+	}
+
+	// And becomes isolated once the peer is gone. Stale successors may
+	// flap the state while the ring converges.
+	if err := c.Kill("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for i := 0; i < 3; i++ {
+		stabilize()
+	}
+	for _, vn := range r.vnodes {
+		if !vn.isolated {
+			t.Fatalf("expected isolated vnode. %v", vn.successors)
+		}
+	}
+	if d.isolated < len(r.vnodes) || d.isolated != d.joined {
+		t.Fatalf("unexpected callbacks. %d %d", d.isolated, d.joined)
+	}
+}
+
+func TestLookupTrace(t *testing.T) {
+	c := stableCluster(t, 3, nil)
+	r := c.Ring("host0")
+	for _, key := range []string{"foo", "bar", "baz", "zip"} {
+		succs, path, err := r.LookupTrace(2, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		exp, err := r.Lookup(2, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		for i := range exp {
+			if !succs[i].Equal(exp[i]) {
+				t.Fatalf("lookup mismatch for %s", key)
+			}
+		}
+
+		// The path starts locally, and never repeats a vnode
+		if len(path) == 0 || path[0].Host != "host0" {
+			t.Fatalf("bad path start. %v", path)
+		}
+		seen := make(map[string]bool)
+		for _, vn := range path {
+			if seen[vn.String()] {
+				t.Fatalf("repeated hop %s. %v", vn, path)
+			}
+			seen[vn.String()] = true
+		}
+
+		// The last hop is the immediate predecessor of the key
+		last := path[len(path)-1]
+		key_hash, _ := r.keyPosition([]byte(key))
+		if !betweenRightIncl(last.Id, succs[0].Id, key_hash) {
+			t.Fatalf("bad last hop %s for %s", last, key)
+		}
+	}
+}
+
+func TestJoinTwice(t *testing.T) {
+	trans := initInmemTransport()
+	r0, err := Create(inmemConf("host0"), trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r0.Shutdown()
+	r1, err := Join(inmemConf("host1"), trans, "host0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// A retried join is refused, and the first ring is still served
+	if _, err := Join(inmemConf("host1"), trans, "host0"); err == nil {
+		t.Fatalf("expected err")
+	}
+	if _, err := Create(inmemConf("host0"), trans); err == nil {
+		t.Fatalf("expected err")
+	}
+	for _, vn := range r1.vnodes {
+		if alive, err := trans.Ping(&vn.Vnode); !alive || err != nil {
+			t.Fatalf("expected live vnode. %v %v", alive, err)
+		}
+	}
+
+	// Once shutdown, the vnodes are deregistered and the host may join
+	r1.Shutdown()
+	for _, vn := range r1.vnodes {
+		if alive, err := trans.Ping(&vn.Vnode); alive || err != nil {
+			t.Fatalf("expected dead vnode. %v %v", alive, err)
+		}
+	}
+	r1, err = Join(inmemConf("host1"), trans, "host0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r1.Shutdown()
+}
+
+func TestLookupLocal(t *testing.T) {
+	c := stableCluster(t, 4, func(conf *Config) {
+		conf.NumSuccessors = 2
+	})
+
+	// Local answers agree with a routed lookup, and the rest would
+	// need a remote hop
+	r := c.Ring("host0")
+	local, remote := 0, 0
+	for i := 0; i < 100; i++ {
+		key := []byte{byte(i), 'k'}
+		succs, err := r.LookupLocal(1, key)
+		if err == ErrRemoteHop {
+			remote++
+			continue
+		} else if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		local++
+		exp, err := r.Lookup(1, key)
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		if len(succs) != len(exp) {
+			t.Fatalf("bad successors. %v %v", succs, exp)
+		}
+		for i := range exp {
+			if !succs[i].Equal(exp[i]) {
+				t.Fatalf("bad successors. %v %v", succs, exp)
+			}
+		}
+	}
+	if local == 0 || remote == 0 {
+		t.Fatalf("expected local and remote keys. %d %d", local, remote)
+	}
+
+	// A lone ring knows every key locally
+	r2, err := Create(inmemConf("alone"), initInmemTransport())
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r2.Shutdown()
+	if _, err := r2.LookupLocal(1, []byte("foo")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+}
+
+func TestSingleSuccessor(t *testing.T) {
+	c := stableCluster(t, 3, func(conf *Config) {
+		conf.NumSuccessors = 1
+	})
+	checkLookups(t, c, []string{"host0", "host1", "host2"})
+
+	// Crash a host, leaving no alternate successors to fall back on
+	if err := c.Kill("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for i := 0; i < 20; i++ {
+		c.Stabilize()
+	}
+	for _, host := range []string{"host0", "host2"} {
+		for _, vn := range c.Ring(host).localVnodes() {
+			vn.lock.Lock()
+			succ := vn.successors[0]
+			vn.lock.Unlock()
+			if succ.Host == "host1" {
+				t.Fatalf("vnode %s stuck on dead successor", vn.String())
+			}
+		}
+	}
+	checkLookups(t, c, []string{"host0", "host2"})
+}
+
+func TestJoinFillsSuccessors(t *testing.T) {
+	conf := func(host string) *Config {
+		conf := inmemConf(host)
+		conf.NumVnodes = 2
+		return conf
+	}
+	c, err := initInmemCluster(1, conf)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	// The seed only knows one successor of each vnode, but the joining
+	// vnodes learn the whole ring
+	r := &Ring{}
+	r.init(conf("host1"), c.Transport)
+	defer r.deregister()
+	hosts, err := c.Transport.ListVnodes("host0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := r.joinSuccessors(hosts); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, vn := range r.localVnodes() {
+		vn.lock.Lock()
+		known := vn.knownSuccessors()
+		err := vn.validate()
+		vn.lock.Unlock()
+		if known != 3 {
+			t.Fatalf("expected 3 successors! Got %d", known)
+		}
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+	}
+}
+
+func TestLookupFrom(t *testing.T) {
+	c := stableCluster(t, 3, nil)
+	r := c.Ring("host0")
+
+	// Every entry point finds the same successors
+	for _, key := range []string{"foo", "bar", "baz", "zip"} {
+		exp, err := r.Lookup(2, []byte(key))
+		if err != nil {
+			t.Fatalf("unexpected err. %s", err)
+		}
+		for _, vn := range r.localVnodes() {
+			succs, err := r.LookupFrom(vn.Id, 2, []byte(key))
+			if err != nil {
+				t.Fatalf("unexpected err. %s", err)
+			}
+			if len(succs) != len(exp) {
+				t.Fatalf("lookup mismatch for %s", key)
+			}
+			for i := range exp {
+				if !succs[i].Equal(exp[i]) {
+					t.Fatalf("lookup mismatch for %s", key)
+				}
+			}
+		}
+	}
+
+	// Remote vnodes cannot be used
+	remote := c.Ring("host1").localVnodes()[0]
+	if _, err := r.LookupFrom(remote.Id, 2, []byte("foo")); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestLookupInsufficientSuccessors(t *testing.T) {
+	// A ring smaller than n gives a clean short result
+	conf := func(host string) *Config {
+		conf := inmemConf(host)
+		conf.NumVnodes = 2
+		return conf
+	}
+	small, err := initInmemCluster(1, conf)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer small.Shutdown()
+	succs, err := small.Ring("host0").Lookup(3, []byte("foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(succs) != 1 {
+		t.Fatalf("expected 1 successor. %v", succs)
+	}
+
+	// The whole ring is remembered until the next stabilize
+	r := small.Ring("host0")
+	if whole := r.wholeRing.Load(); whole != 1 {
+		t.Fatalf("expected the ring size to be kept. %d", whole)
+	}
+	if _, err := r.Lookup(3, []byte("bar")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	small.Stabilize()
+	if whole := r.wholeRing.Load(); whole != 0 {
+		t.Fatalf("expected the ring size to be cleared. %d", whole)
+	}
+
+	// Forgetting successors in a larger ring is reported
+	c := stableCluster(t, 3, nil)
+	for _, host := range []string{"host0", "host1", "host2"} {
+		for _, vn := range c.Ring(host).localVnodes() {
+			vn.lock.Lock()
+			for i := 1; i < len(vn.successors); i++ {
+				vn.successors[i] = nil
+			}
+			vn.lock.Unlock()
+		}
+	}
+	succs, err = c.Ring("host0").Lookup(3, []byte("foo"))
+	if !errors.Is(err, ErrInsufficientSuccessors) {
+		t.Fatalf("expected insufficient successors. %v", err)
+	}
+	if len(succs) != 1 {
+		t.Fatalf("expected 1 successor. %v", succs)
+	}
+}
+
+// Fails the first FindSuccessors call
+type failOnceTransport struct {
+	*inmemTransport
+	failed bool
+}
+
+func (ft *failOnceTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	if !ft.failed {
+		ft.failed = true
+		return nil, nil, errors.New("transient failure")
+	}
+	return ft.inmemTransport.FindSuccessors(vn, n, key, visited)
+}
+
+func TestJoinQuorum(t *testing.T) {
+	c, err := initInmemCluster(1, inmemConf)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+
+	// By default every vnode must find its successors
+	trans := &failOnceTransport{inmemTransport: c.Transport}
+	if _, err := Join(inmemConf("host1"), trans, "host0"); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// A quorum tolerates the failure
+	trans.failed = false
+	conf := inmemConf("host1")
+	conf.JoinQuorum = 1
+	r, err := Join(conf, trans, "host0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	for _, vn := range r.localVnodes() {
+		vn.lock.Lock()
+		succ := vn.successors[0]
+		vn.lock.Unlock()
+		if succ == nil {
+			t.Fatalf("expected a successor")
+		}
+	}
+	for i := 0; i < 5; i++ {
+		c.Stabilize()
+		r.Stabilize()
+	}
+	vn1, err := r.Lookup(1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vn2, err := c.Ring("host0").Lookup(1, []byte("foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !vn1[0].Equal(vn2[0]) {
+		t.Fatalf("hosts disagree")
+	}
+}
+
+func TestRemoveVnodes(t *testing.T) {
+	c := stableCluster(t, 3, nil)
+
+	r := c.Ring("host1")
+	if err := r.RemoveVnodes(4); err == nil {
+		t.Fatalf("expected err")
+	}
+	if err := r.RemoveVnodes(2); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// The vnodes with the highest indices are removed
+	vnodes := r.localVnodes()
+	if len(vnodes) != 2 {
+		t.Fatalf("expected 2 vnodes. %d", len(vnodes))
+	}
+	for _, vn := range vnodes {
+		if vn.index > 1 {
+			t.Fatalf("expected index 0 or 1. %d", vn.index)
+		}
+	}
+
+	// The ring heals around the removed vnodes
+	settle(c)
+	checkLookups(t, c, []string{"host0", "host1", "host2"})
+	for _, host := range []string{"host0", "host2"} {
+		for _, vn := range c.Ring(host).localVnodes() {
+			vn.lock.Lock()
+			for _, s := range vn.successors {
+				if s != nil && s.Host == "host1" && r.localVnode(s.Id) == nil {
+					t.Fatalf("removed vnode is still a successor")
+				}
+			}
+			vn.lock.Unlock()
+		}
+	}
+}
+
+// Implements only the required Delegate methods
+type baseDelegate struct {
+	newPred int
+}
+
+func (b *baseDelegate) NewPredecessor(local, remoteNew, remotePrev *Vnode) {
+	b.newPred++
+}
+func (b *baseDelegate) Leaving(local, pred, succ *Vnode)        {}
+func (b *baseDelegate) PredecessorLeaving(local, remote *Vnode) {}
+func (b *baseDelegate) SuccessorLeaving(local, remote *Vnode)   {}
+func (b *baseDelegate) Shutdown()                               {}
+
+func TestRingBaseDelegate(t *testing.T) {
+	d := &baseDelegate{}
+	c, err := initInmemCluster(3, func(host string) *Config {
+		conf := inmemConf(host)
+		if host == "host0" {
+			conf.Delegate = d
+		}
+		return conf
+	})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c.Ring("host0").SetNotifyPayload([]byte("payload"))
+	c.Ring("host1").SetNotifyPayload([]byte("payload"))
+	settle(c)
+
+	// The optional events are skipped for a delegate without them
+	if err := c.Kill("host2"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	settle(c)
+	c.Shutdown()
+	if d.newPred == 0 {
+		t.Fatalf("expected new predecessors")
+	}
+}
+
+func TestRingEvict(t *testing.T) {
+	d := &MockDelegate{}
+	c := stableCluster(t, 2, func(conf *Config) {
+		if conf.Hostname == "host0" {
+			conf.Delegate = d
+		}
+	})
+
+	r := c.Ring("host0")
+	if err := r.Evict("host0"); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// Without any failed pings, every reference to host1 is dropped
+	c.Transport.Fail("host1")
+	if err := r.Evict("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	for _, vn := range r.localVnodes() {
+		vn.lock.Lock()
+		if vn.predecessor != nil && vn.predecessor.Host == "host1" {
+			t.Fatalf("evicted predecessor")
+		}
+		if vn.successors[0] == nil {
+			t.Fatalf("expected a successor")
+		}
+		for _, s := range vn.successors {
+			if s != nil && s.Host == "host1" {
+				t.Fatalf("evicted successor")
+			}
+		}
+		for _, f := range vn.finger {
+			if f != nil && f.Host == "host1" {
+				t.Fatalf("evicted finger")
+			}
+		}
+		vn.lock.Unlock()
+	}
+	checkLookups(t, c, []string{"host0"})
+
+	r.stopDelegate()
+	if len(d.failed) == 0 {
+		t.Fatalf("expected failed peers")
+	}
+}
+
+func TestRingEvictSoleVnode(t *testing.T) {
+	c := stableCluster(t, 2, func(conf *Config) {
+		if conf.Hostname == "host1" {
+			conf.NumVnodes = 1
+		}
+	})
+
+	// Every successor is on the evicted host, so the last one is kept
+	r := c.Ring("host1")
+	c.Transport.Fail("host0")
+	if err := r.Evict("host0"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	vn := r.localVnodes()[0]
+	vn.lock.Lock()
+	succ := vn.successors[0]
+	known := vn.knownSuccessors()
+	vn.lock.Unlock()
+	if succ == nil || known != 1 {
+		t.Fatalf("expected a single successor. %v %d", succ, known)
+	}
+
+	// Stabilizing and serving lookups keep working
+	r.Stabilize()
+	vn.FindSuccessors(1, prevPosition(vn.Id, r.config.hashBits), nil)
+}
+
+func TestRejoinReclaimRange(t *testing.T) {
+	d := &MockDelegate{}
+	c := stableCluster(t, 2, func(conf *Config) {
+		if conf.Hostname == "host1" {
+			conf.Delegate = d
+		}
+	})
+
+	// Every vnode in ring order, to find the owner of each range
+	var all []*Vnode
+	for _, host := range []string{"host0", "host1"} {
+		for _, vn := range c.Ring(host).localVnodes() {
+			all = append(all, &vn.Vnode)
+		}
+	}
+	sort.Slice(all, func(i, j int) bool {
+		return bytes.Compare(all[i].Id, all[j].Id) < 0
+	})
+
+	// Partition host1, which host0 routes around
+	c.Transport.Fail("host1")
+	if err := c.Ring("host0").Evict("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c.Transport.Recover("host1")
+	r := c.Ring("host1")
+	if err := r.Rejoin("host0"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r.stopDelegate()
+
+	// Each vnode reclaims the keys after the vnode preceding it, from
+	// the vnode of host0 following it
+	if len(d.reclaims) != 4 {
+		t.Fatalf("expected 4 reclaimed ranges. %d", len(d.reclaims))
+	}
+	for _, e := range d.reclaims {
+		for i, vn := range all {
+			if !vn.Equal(e.local) {
+				continue
+			}
+			prev := all[(i+len(all)-1)%len(all)]
+			if !bytes.Equal(e.start, prev.Id) || !bytes.Equal(e.end, vn.Id) {
+				t.Fatalf("bad range for %s. %x %x", vn, e.start, e.end)
+			}
+			next := i + 1
+			for all[next%len(all)].Host != "host0" {
+				next++
+			}
+			if !e.from.Equal(all[next%len(all)]) {
+				t.Fatalf("bad owner for %s. %s", vn, e.from)
+			}
+		}
+	}
+}
+
+func TestLeaveQuiet(t *testing.T) {
+	d0, d1 := &MockDelegate{}, &MockDelegate{}
+	c := stableCluster(t, 2, func(conf *Config) {
+		conf.Delegate = d0
+		if conf.Hostname == "host1" {
+			conf.Delegate = d1
+		}
+	})
+
+	// No leaving events are delivered, only the shutdown
+	if err := c.Ring("host1").LeaveQuiet(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if d1.leaving != 0 {
+		t.Fatalf("expected no leaving events. %d", d1.leaving)
+	}
+	if !d1.shutdown {
+		t.Fatalf("expected shutdown")
+	}
+	if c.Ring("host1").quiet.Load() {
+		t.Fatalf("expected events to be unsuppressed after leaving")
+	}
+
+	// Our neighbors were still informed
+	c.Ring("host0").stopDelegate()
+	if d0.leaving == 0 {
+		t.Fatalf("expected leaving events")
+	}
+}
+
+func TestFindPredecessor(t *testing.T) {
+	c := stableCluster(t, 2, func(conf *Config) {
+		conf.PredecessorTimeout = time.Millisecond
+	})
+
+	vn := c.Ring("host0").localVnodes()[0]
+	vn.lock.Lock()
+	pred := vn.predecessor
+	vn.predecessor = nil
+	vn.lock.Unlock()
+	if pred == nil {
+		t.Fatalf("expected a predecessor")
+	}
+
+	// The predecessor is only looked up after the timeout
+	if err := vn.checkPredecessor(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn.predecessor != nil {
+		t.Fatalf("expected no predecessor")
+	}
+	time.Sleep(2 * time.Millisecond)
+	if err := vn.checkPredecessor(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !vn.predecessor.Equal(pred) {
+		t.Fatalf("expected predecessor %s. %v", pred.String(), vn.predecessor)
+	}
+}
+
+func TestRingAffinity(t *testing.T) {
+	c := stableCluster(t, 3, nil)
+
+	r := c.Ring("host0")
+	hot := c.Ring("host2").localVnodes()[1]
+	special := c.Ring("host1").localVnodes()[2]
+	if err := r.SetAffinity(nil, hot.Id); err == nil {
+		t.Fatalf("expected err")
+	}
+	if err := r.SetAffinity([]byte("hot/"), []byte{1}); err == nil {
+		t.Fatalf("expected err")
+	}
+	if err := r.SetAffinity([]byte("hot/"), hot.Id); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := r.SetAffinity([]byte("hot/special"), special.Id); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Matching keys resolve to the designated vnode and its successors
+	vns, err := r.Lookup(2, []byte("hot/foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	hot.lock.Lock()
+	succ := hot.successors[0]
+	hot.lock.Unlock()
+	if len(vns) != 2 || !vns[0].Equal(&hot.Vnode) || !vns[1].Equal(succ) {
+		t.Fatalf("expected the hot vnode and its successor. %v", vns)
+	}
+
+	// The longest prefix wins
+	vns, err = r.Lookup(1, []byte("hot/special/bar"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !vns[0].Equal(&special.Vnode) {
+		t.Fatalf("expected the special vnode. %v", vns)
+	}
+
+	// Cleared keys are hashed again
+	r.ClearAffinity([]byte("hot/"))
+	vns, err = r.Lookup(1, []byte("hot/foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	other, err := c.Ring("host1").Lookup(1, []byte("hot/foo"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !vns[0].Equal(other[0]) {
+		t.Fatalf("expected the hashed owner. %v %v", vns, other)
+	}
+}
+
+func TestVnodeChurnCounters(t *testing.T) {
+	c := stableCluster(t, 2, nil)
+
+	// Joining changed the neighbors of some vnodes
+	var succChanges, predChanges uint64
+	for _, host := range []string{"host0", "host1"} {
+		for _, vn := range c.Ring(host).localVnodes() {
+			health, _ := vn.Health()
+			if health.StabilizeCount < 5 {
+				t.Fatalf("expected 5 stabilizes. %d", health.StabilizeCount)
+			}
+			succChanges += health.SuccessorChanges
+			predChanges += health.PredecessorChanges
+		}
+	}
+	if succChanges == 0 || predChanges == 0 {
+		t.Fatalf("expected changes. %d %d", succChanges, predChanges)
+	}
+
+	// A stable ring has no further changes
+	for i := 0; i < 3; i++ {
+		c.Stabilize()
+	}
+	var after uint64
+	for _, host := range []string{"host0", "host1"} {
+		for _, vn := range c.Ring(host).localVnodes() {
+			health, _ := vn.Health()
+			after += health.SuccessorChanges + health.PredecessorChanges
+		}
+	}
+	if after != succChanges+predChanges {
+		t.Fatalf("expected no more changes. %d %d", after, succChanges+predChanges)
+	}
+}
@@ -4,12 +4,19 @@ import (
 	"math/big"
 )
 
+// Iterates over the known vnodes preceding a key, closest first, by
+// merging the successor list and the finger table. Each vnode is yielded
+// at most once, tracked by ID, even if it is in both or repeated. When a
+// successor and a finger are equally close, which means they share an
+// ID, the successor is yielded and the finger is then skipped, so the
+// order only depends on the routing state.
 type closestPreceedingVnodeIterator struct {
 	key           []byte
 	vn            *localVnode
 	finger_idx    int
 	successor_idx int
 	yielded       map[string]struct{}
+	failed        map[string]struct{}
 }
 
 func (cp *closestPreceedingVnodeIterator) init(vn *localVnode, key []byte) {
@@ -18,6 +25,21 @@ func (cp *closestPreceedingVnodeIterator) init(vn *localVnode, key []byte) {
 	cp.successor_idx = len(vn.successors) - 1
 	cp.finger_idx = len(vn.finger) - 1
 	cp.yielded = make(map[string]struct{})
+	cp.failed = make(map[string]struct{})
+}
+
+// Marks a host as failed, skipping any further vnodes on it
+func (cp *closestPreceedingVnodeIterator) Fail(host string) {
+	cp.failed[host] = struct{}{}
+}
+
+// Checks if a vnode should not be yielded
+func (cp *closestPreceedingVnodeIterator) skip(vn *Vnode) bool {
+	if _, ok := cp.yielded[vn.String()]; ok {
+		return true
+	}
+	_, ok := cp.failed[vn.Host]
+	return ok
 }
 
 func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
@@ -27,12 +49,14 @@ func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
 
 	// Scan to find the next successor
 	vn := cp.vn
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
 	var i int
 	for i = cp.successor_idx; i >= 0; i-- {
 		if vn.successors[i] == nil {
 			continue
 		}
-		if _, ok := cp.yielded[vn.successors[i].String()]; ok {
+		if cp.skip(vn.successors[i]) {
 			continue
 		}
 		if between(vn.Id, cp.key, vn.successors[i].Id) {
@@ -47,7 +71,7 @@ func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
 		if vn.finger[i] == nil {
 			continue
 		}
-		if _, ok := cp.yielded[vn.finger[i].String()]; ok {
+		if cp.skip(vn.finger[i]) {
 			continue
 		}
 		if between(vn.Id, cp.key, vn.finger[i].Id) {
@@ -61,6 +85,7 @@ func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
 	if successor_node != nil && finger_node != nil {
 		// Determine the closer node
 		hb := cp.vn.ring.config.hashBits
+		// Ties go to the successor, as it is passed first
 		closest := closest_preceeding_vnode(successor_node,
 			finger_node, cp.key, hb)
 		if closest == successor_node {
@@ -85,10 +110,24 @@ func (cp *closestPreceedingVnodeIterator) Next() *Vnode {
 	return nil
 }
 
-// Returns the closest preceeding Vnode to the key
+// Returns up to the next n vnodes, closest first
+func (cp *closestPreceedingVnodeIterator) NextN(n int) []*Vnode {
+	var res []*Vnode
+	for len(res) < n {
+		next := cp.Next()
+		if next == nil {
+			break
+		}
+		res = append(res, next)
+	}
+	return res
+}
+
+// Returns the closest preceeding Vnode to the key, or a if they are
+// equally close
 func closest_preceeding_vnode(a, b *Vnode, key []byte, bits int) *Vnode {
-	a_dist := distance(a.Id, key, bits)
-	b_dist := distance(b.Id, key, bits)
+	a_dist := RingDistance(a.Id, key, bits)
+	b_dist := RingDistance(b.Id, key, bits)
 	if a_dist.Cmp(b_dist) <= 0 {
 		return a
 	} else {
@@ -96,8 +135,10 @@ func closest_preceeding_vnode(a, b *Vnode, key []byte, bits int) *Vnode {
 	}
 }
 
-// Computes the forward distance from a to b modulus a ring size
-func distance(a, b []byte, bits int) *big.Int {
+// RingDistance computes the forward distance from a to b modulus a
+// ring of 2^bits IDs. This is the amount of key space from a to b, so
+// the range owned by a vnode is the distance from its predecessor.
+func RingDistance(a, b []byte, bits int) *big.Int {
 	// Get the ring size
 	var ring big.Int
 	ring.Exp(big.NewInt(2), big.NewInt(int64(bits)), nil)
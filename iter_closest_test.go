@@ -145,6 +145,79 @@ func TestNextClosestNoFinger(t *testing.T) {
 	}
 }
 
+func TestNextClosestFailedHost(t *testing.T) {
+	// Make the vnodes on the ring (mod 64)
+	v1 := &Vnode{Id: []byte{1}, Host: "a"}
+	v2 := &Vnode{Id: []byte{10}, Host: "b"}
+	v4 := &Vnode{Id: []byte{32}, Host: "a"}
+	v6 := &Vnode{Id: []byte{59}, Host: "b"}
+	v7 := &Vnode{Id: []byte{62}, Host: "a"}
+
+	// Make a vnode
+	vn := &localVnode{}
+	vn.Id = []byte{54}
+	vn.successors = []*Vnode{v6, v7, nil}
+	vn.finger = []*Vnode{v6, v6, v7, v1, v2, v4, nil}
+	vn.ring = &Ring{}
+	vn.ring.config = &Config{hashBits: 6}
+
+	// Make an iterator
+	k := []byte{32}
+	cp := &closestPreceedingVnodeIterator{}
+	cp.init(vn, k)
+
+	s1 := cp.Next()
+	if s1 != v2 {
+		t.Fatalf("Expect v2. %v", s1)
+	}
+
+	// Skip the rest of host b
+	cp.Fail("b")
+	s2 := cp.Next()
+	if s2 != v1 {
+		t.Fatalf("Expect v1. %v", s2)
+	}
+	s3 := cp.Next()
+	if s3 != v7 {
+		t.Fatalf("Expect v7. %v", s3)
+	}
+	s4 := cp.Next()
+	if s4 != nil {
+		t.Fatalf("Expect nil. %v", s4)
+	}
+}
+
+func TestNextClosestTie(t *testing.T) {
+	// Make the vnodes on the ring (mod 64), with a copy of v2 in a
+	// finger, and v1 in both lists
+	v1 := &Vnode{Id: []byte{1}}
+	v2 := &Vnode{Id: []byte{10}}
+	v2copy := &Vnode{Id: []byte{10}}
+	v4 := &Vnode{Id: []byte{32}}
+
+	// Make a vnode
+	vn := &localVnode{}
+	vn.Id = []byte{54}
+	vn.successors = []*Vnode{v1, v2, nil}
+	vn.finger = []*Vnode{v1, v1, v2copy, v4, nil}
+	vn.ring = &Ring{}
+	vn.ring.config = &Config{hashBits: 6}
+
+	// The successors win each tie, and every ID is yielded once
+	for i := 0; i < 3; i++ {
+		cp := &closestPreceedingVnodeIterator{}
+		cp.init(vn, []byte{32})
+		for _, exp := range []*Vnode{v2, v1} {
+			if next := cp.Next(); next != exp {
+				t.Fatalf("Expect %v. %v", exp, next)
+			}
+		}
+		if next := cp.Next(); next != nil {
+			t.Fatalf("Expect nil. %v", next)
+		}
+	}
+}
+
 func TestClosest(t *testing.T) {
 	a := &Vnode{Id: []byte{128}}
 	b := &Vnode{Id: []byte{32}}
@@ -157,26 +230,35 @@ func TestClosest(t *testing.T) {
 	if c != b {
 		t.Fatalf("expect b to be closer!")
 	}
+
+	// Ties go to the first vnode
+	bcopy := &Vnode{Id: []byte{32}}
+	if closest_preceeding_vnode(b, bcopy, k, 8) != b {
+		t.Fatalf("expect b on a tie!")
+	}
+	if closest_preceeding_vnode(bcopy, b, k, 8) != bcopy {
+		t.Fatalf("expect bcopy on a tie!")
+	}
 }
 
 func TestDistance(t *testing.T) {
 	a := []byte{63}
 	b := []byte{3}
-	d := distance(a, b, 6) // Ring size of 64
+	d := RingDistance(a, b, 6) // Ring size of 64
 	if d.Cmp(big.NewInt(4)) != 0 {
 		t.Fatalf("expect distance 4! %v", d)
 	}
 
 	a = []byte{0}
 	b = []byte{65}
-	d = distance(a, b, 7) // Ring size of 128
+	d = RingDistance(a, b, 7) // Ring size of 128
 	if d.Cmp(big.NewInt(65)) != 0 {
 		t.Fatalf("expect distance 65! %v", d)
 	}
 
 	a = []byte{1}
 	b = []byte{255}
-	d = distance(a, b, 8) // Ring size of 256
+	d = RingDistance(a, b, 8) // Ring size of 256
 	if d.Cmp(big.NewInt(254)) != 0 {
 		t.Fatalf("expect distance 254! %v", d)
 	}
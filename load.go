@@ -0,0 +1,49 @@
+package chord
+
+// Returns the load of our host to send with Notify, or nil without a
+// LoadReporter
+func (r *Ring) reportLoad() *float64 {
+	report := r.config.LoadReporter
+	if report == nil {
+		return nil
+	}
+	load := report()
+	return &load
+}
+
+// Records the load of a remote host, received with a Notify request or
+// response. Hosts that did not report a load are ignored.
+func (r *Ring) recordLoad(remote *Vnode, load *float64) {
+	if load == nil || remote == nil || remote.Host == r.config.Hostname {
+		return
+	}
+	r.loadLock.Lock()
+	defer r.loadLock.Unlock()
+	if r.loads == nil {
+		r.loads = make(map[string]float64)
+	}
+	r.loads[remote.Host] = *load
+}
+
+// Forgets the load of a host, once one of its vnodes has failed
+func (r *Ring) forgetLoad(host string) {
+	r.loadLock.Lock()
+	defer r.loadLock.Unlock()
+	delete(r.loads, host)
+}
+
+// NeighborLoads returns the last load reported by each neighboring
+// host, as measured by its LoadReporter. Neighbors are the hosts of
+// the successors and predecessors of our vnodes, which exchange their
+// loads as they stabilize. The view is approximate, since loads are
+// only updated as often as the vnodes stabilize. Hosts are forgotten
+// once one of their vnodes is found to have failed.
+func (r *Ring) NeighborLoads() map[string]float64 {
+	r.loadLock.Lock()
+	defer r.loadLock.Unlock()
+	loads := make(map[string]float64, len(r.loads))
+	for host, load := range r.loads {
+		loads[host] = load
+	}
+	return loads
+}
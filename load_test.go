@@ -0,0 +1,87 @@
+package chord
+
+import (
+	"testing"
+)
+
+func TestRingNeighborLoads(t *testing.T) {
+	conf := func(host string) *Config {
+		conf := inmemConf(host)
+		load := float64(host[len(host)-1]-'0') + 0.5
+		conf.LoadReporter = func() float64 { return load }
+		return conf
+	}
+	c, err := initInmemCluster(2, conf)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer c.Shutdown()
+	c.Ring("host0").SetNotifyPayload([]byte("payload"))
+	settle(c)
+
+	// Each host learns the load of the other, but not its own
+	for _, host := range []string{"host0", "host1"} {
+		loads := c.Ring(host).NeighborLoads()
+		if len(loads) != 1 {
+			t.Fatalf("bad loads for %s. %v", host, loads)
+		}
+		for peer, load := range loads {
+			if peer == host || load != float64(peer[len(peer)-1]-'0')+0.5 {
+				t.Fatalf("bad load for %s. %v", host, loads)
+			}
+		}
+	}
+
+	// Failed hosts are forgotten
+	if err := c.Kill("host1"); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	settle(c)
+	if loads := c.Ring("host0").NeighborLoads(); len(loads) != 0 {
+		t.Fatalf("expected no loads. %v", loads)
+	}
+}
+
+func TestRingLoadPayload(t *testing.T) {
+	delegates := make(map[string]*MockDelegate)
+	conf := func(host string) *Config {
+		conf := inmemConf(host)
+		d := &MockDelegate{}
+		delegates[host] = d
+		conf.Delegate = d
+		if host == "host0" {
+			conf.LoadReporter = func() float64 { return 2 }
+		}
+		return conf
+	}
+	c, err := initInmemCluster(2, conf)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c.Ring("host0").SetNotifyPayload([]byte("host0"))
+	c.Ring("host1").SetNotifyPayload([]byte("host1"))
+	settle(c)
+
+	// Only the host reporting a load is known to the other
+	if loads := c.Ring("host1").NeighborLoads(); len(loads) != 1 || loads["host0"] != 2 {
+		t.Fatalf("bad loads. %v", loads)
+	}
+	if loads := c.Ring("host0").NeighborLoads(); len(loads) != 0 {
+		t.Fatalf("expected no loads. %v", loads)
+	}
+	c.Shutdown()
+
+	// Payloads are passed on untouched either way
+	for host, d := range delegates {
+		remote := false
+		for _, payload := range d.payloads {
+			if string(payload) != "host0" && string(payload) != "host1" {
+				t.Fatalf("bad payload for %s. %q", host, payload)
+			}
+			remote = remote || string(payload) != host
+		}
+		if !remote {
+			t.Fatalf("expected a remote payload for %s", host)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package chord
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// Implemented by transports that report their outbound connections
+type poolStatser interface {
+	PoolStats() map[string]TCPPoolStats
+}
+
+// Counts the lookups routed through the ring, and their latency
+type lookupStats struct {
+	count  atomic.Uint64
+	errors atomic.Uint64
+	nanos  atomic.Uint64
+}
+
+func (ls *lookupStats) record(d time.Duration, err error) {
+	ls.count.Add(1)
+	ls.nanos.Add(uint64(d))
+	if err != nil {
+		ls.errors.Add(1)
+	}
+}
+
+// MetricsHandler returns a handler serving the metrics of the ring in
+// the Prometheus text format, ready to be scraped. These are the health
+// of each local vnode, the latency of the lookups routed through the
+// ring, the delegate events dropped, and the connection pool of the
+// transport if it is a TCPTransport. Metrics are read on each request.
+func (r *Ring) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		w.Write(r.metrics())
+	})
+}
+
+// Formats the metrics served by MetricsHandler
+func (r *Ring) metrics() []byte {
+	var buf bytes.Buffer
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&buf, "# HELP chord_%s %s\n# TYPE chord_%s %s\n", name, help, name, kind)
+	}
+
+	vnodes := r.localVnodes()
+	metric("vnodes", "gauge", "Number of local vnodes.")
+	fmt.Fprintf(&buf, "chord_vnodes %d\n", len(vnodes))
+
+	// Gather the health of each vnode, flagged as stale as by RingHealth
+	health := make([]*VnodeHealth, len(vnodes))
+	for i, vn := range vnodes {
+		health[i], _ = vn.Health()
+		health[i].Stale = time.Since(health[i].Stabilized) > 2*r.config.StabilizeMax
+	}
+	vnodeMetric := func(name, kind, help string, value func(h *VnodeHealth) interface{}) {
+		metric(name, kind, help)
+		for _, h := range health {
+			fmt.Fprintf(&buf, "chord_%s{vnode=%q} %v\n", name, h.Vnode.String(), value(h))
+		}
+	}
+	vnodeMetric("vnode_successors", "gauge", "Number of known successors.",
+		func(h *VnodeHealth) interface{} { return h.Successors })
+	vnodeMetric("vnode_stale", "gauge", "Set if the vnode has not stabilized recently.",
+		func(h *VnodeHealth) interface{} { return boolMetric(h.Stale) })
+	vnodeMetric("vnode_stabilize_total", "counter", "Stabilize runs.",
+		func(h *VnodeHealth) interface{} { return h.StabilizeCount })
+	vnodeMetric("vnode_stabilize_avg_seconds", "gauge", "Average duration of the recent stabilize runs.",
+		func(h *VnodeHealth) interface{} { return h.StabilizeAvg.Seconds() })
+	vnodeMetric("vnode_successor_changes_total", "counter", "Stabilize runs that found a different first successor.",
+		func(h *VnodeHealth) interface{} { return h.SuccessorChanges })
+	vnodeMetric("vnode_predecessor_changes_total", "counter", "Stabilize runs that found a different predecessor.",
+		func(h *VnodeHealth) interface{} { return h.PredecessorChanges })
+	vnodeMetric("vnode_finger_failures", "gauge", "Consecutive failed finger table repairs.",
+		func(h *VnodeHealth) interface{} { return h.FingerFailures })
+
+	metric("lookup_seconds", "summary", "Latency of the lookups routed through the ring.")
+	fmt.Fprintf(&buf, "chord_lookup_seconds_sum %v\n", time.Duration(r.lookups.nanos.Load()).Seconds())
+	fmt.Fprintf(&buf, "chord_lookup_seconds_count %d\n", r.lookups.count.Load())
+	metric("lookup_errors_total", "counter", "Lookups routed through the ring that failed.")
+	fmt.Fprintf(&buf, "chord_lookup_errors_total %d\n", r.lookups.errors.Load())
+
+	metric("delegate_dropped_total", "counter", "Delegate events dropped on a full queue.")
+	fmt.Fprintf(&buf, "chord_delegate_dropped_total %d\n", r.DelegateDropped())
+
+	// Connection pools are listed by host
+	if ps, ok := r.base.(poolStatser); ok {
+		stats := ps.PoolStats()
+		hosts := make([]string, 0, len(stats))
+		for host := range stats {
+			hosts = append(hosts, host)
+		}
+		sort.Strings(hosts)
+		metric("pool_open", "gauge", "Outbound connections not yet closed.")
+		for _, host := range hosts {
+			fmt.Fprintf(&buf, "chord_pool_open{host=%q} %d\n", host, stats[host].Open)
+		}
+		metric("pool_idle", "gauge", "Outbound connections waiting in the pool.")
+		for _, host := range hosts {
+			fmt.Fprintf(&buf, "chord_pool_idle{host=%q} %d\n", host, stats[host].Idle)
+		}
+	}
+	return buf.Bytes()
+}
+
+// Returns a flag as a metric value
+func boolMetric(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,62 @@
+package chord
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	c := stableCluster(t, 2, nil)
+	r := c.Ring("host0")
+	if _, err := r.Lookup(1, []byte("foo")); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	rec := httptest.NewRecorder()
+	r.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("bad content type. %s", ct)
+	}
+	body := rec.Body.String()
+	vn := r.localVnodes()[0]
+	for _, line := range []string{
+		"# TYPE chord_vnodes gauge",
+		"chord_vnodes 4",
+		`chord_vnode_successors{vnode="` + vn.String() + `"} 7`,
+		"# TYPE chord_vnode_stabilize_total counter",
+		"chord_lookup_seconds_count 1",
+		"chord_lookup_errors_total 0",
+		"chord_delegate_dropped_total 0",
+	} {
+		if !strings.Contains(body, line+"\n") {
+			t.Fatalf("missing %q in:\n%s", line, body)
+		}
+	}
+
+	// Pools are only reported by transports that have them
+	if strings.Contains(body, "chord_pool_open") {
+		t.Fatalf("unexpected pool metrics")
+	}
+}
+
+func TestMetricsHandlerPoolStats(t *testing.T) {
+	trans, err := InitTCPTransport("localhost:0", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	conf := DefaultConfig(trans.LocalAddr().String())
+	conf.ManualStabilize = true
+	r, err := Create(conf, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Close()
+
+	rec := httptest.NewRecorder()
+	r.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(rec.Body.String(), "# TYPE chord_pool_open gauge\n") {
+		t.Fatalf("missing pool metrics in:\n%s", rec.Body.String())
+	}
+}
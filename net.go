@@ -1,9 +1,17 @@
 package chord
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
 	"sync"
 	"sync/atomic"
@@ -21,15 +29,92 @@ Internally, there is 1 Goroutine listening for inbound connections, 1 Goroutine
 inbound connection.
 */
 type TCPTransport struct {
-	sock     *net.TCPListener
-	timeout  time.Duration
-	maxIdle  time.Duration
-	lock     sync.RWMutex
-	local    map[string]*localRPC
-	inbound  map[*net.TCPConn]struct{}
-	poolLock sync.Mutex
-	pool     map[string][]*tcpOutConn
-	shutdown int32
+	sock        *net.TCPListener
+	timeout     atomic.Int64 // Call timeout, as a time.Duration
+	pingTimeout atomic.Int64 // Ping timeout, zero uses the call timeout
+	initTimeout time.Duration
+	maxIdle     time.Duration
+	lock        sync.RWMutex
+	local       map[string]map[string]*localRPC
+	inbound     map[*net.TCPConn]struct{}
+	poolLock    sync.Mutex
+	pool        map[string][]*tcpOutConn
+	open        map[string]int
+	breakers    map[string]*tcpBreaker
+	slots       map[string]chan struct{} // Connections in use by host
+	shutdown    int32
+	shutdownCh  chan struct{}
+	opts        TCPOptions
+}
+
+// TCPOptions are the socket options applied to every inbound
+// and outbound connection of a TCPTransport. If BindIP is set, the
+// transport only listens on that IP, using the port of the listen
+// address. The listen address may then name another interface, such
+// as the address advertised to the ring in the Config Hostname.
+//
+// If Secret is set, every request is signed with an HMAC of its header,
+// body and the time it was sent, and requests that are unsigned, carry
+// a bad signature or were sent more than tcpSignatureWindow away from
+// our clock are rejected by closing the connection. Each response is
+// signed along with the signature of its request, and a response with
+// a bad signature fails the call. This prevents forged requests and
+// responses from peers that do not know the secret, such as a Notify
+// or SkipSuccessor meant to disrupt the ring, and limits replays of a
+// captured request to the window, but does not encrypt the traffic.
+// Every host in the ring must use the same secret, and keep its clock
+// within the window of the others.
+//
+// MaxConns limits the connections in use to a single host, so that a
+// burst of requests to a hot host cannot exhaust our file descriptors.
+// Once the limit is reached, callers wait for a connection to be freed,
+// up to the timeout of their request. The limit is fixed when the
+// transport is created.
+//
+// MaxDialFailures enables a circuit breaker on outbound connections.
+// After that many consecutive dial failures to a host, any connection to
+// that host fails immediately until the BreakerCooldown has passed. The
+// breaker is disabled by default.
+//
+// ReconnectJitter spreads out the reconnections of many nodes to a host
+// that has recovered. A dial to a host whose last dial failed is delayed
+// by up to the window, and the cooldown of an open circuit breaker is
+// extended by up to the window. The jitter is disabled by default.
+type TCPOptions struct {
+	NoDelay         bool          // Disable Nagle's algorithm
+	KeepAlive       bool          // Enable TCP keepalives
+	KeepAlivePeriod time.Duration // Keepalive period, zero uses the OS default
+	BindIP          string        // Local IP to listen on, empty uses the listen address
+	Secret          string        // Shared secret signing every request, empty disables signing
+	MaxConns        int           // Connections in use to a single host, zero is unlimited
+	MaxDialFailures int           // Consecutive dial failures that open the circuit of a host, zero disables
+	BreakerCooldown time.Duration // How long an open circuit fails connections to its host
+	ReconnectJitter time.Duration // Window of random delay when reconnecting, zero disables
+}
+
+// Returns the default TCP options, which disable Nagle's
+// algorithm, enable keepalives and allow 64 connections per host
+func DefaultTCPOptions() TCPOptions {
+	return TCPOptions{
+		NoDelay:   true,
+		KeepAlive: true,
+		MaxConns:  tcpMaxConns,
+	}
+}
+
+// TCPPoolStats are the outbound connections held to a host. Open counts
+// every connection that has been dialed and not yet closed, including
+// those in use and those still serving a request that timed out.
+type TCPPoolStats struct {
+	Open     int       // Connections not yet closed
+	Idle     int       // Connections waiting in the pool
+	LastUsed time.Time // Most recent use of an idle connection
+}
+
+// Tracks the consecutive dial failures to a host
+type tcpBreaker struct {
+	failures int
+	open     time.Time // Fail fast until this time
 }
 
 type tcpOutConn struct {
@@ -39,6 +124,7 @@ type tcpOutConn struct {
 	enc    *gob.Encoder
 	dec    *gob.Decoder
 	used   time.Time
+	reused bool // Taken from the pool, so may be stale
 }
 
 const (
@@ -49,47 +135,151 @@ const (
 	tcpFindSucReq
 	tcpClearPredReq
 	tcpSkipSucReq
+	tcpHealthReq
+	tcpBatchPingReq
+	tcpListRangeReq
+)
+
+// Default limit on the connections in use to a single host
+const tcpMaxConns = 64
+
+// Bounds of the delay between failed accepts
+const (
+	acceptBackoffMin = 5 * time.Millisecond
+	acceptBackoffMax = time.Second
 )
 
 type tcpHeader struct {
-	ReqType int
+	ReqType   int
+	Namespace string
+	Time      int64  // Unix time in nanoseconds the request was signed
+	Sig       []byte // HMAC of the request, if signing is enabled
+}
+
+// Signed requests sent further than this from our clock are rejected,
+// which bounds the time a captured request can be replayed
+const tcpSignatureWindow = 30 * time.Second
+
+// An error returned by a remote vnode. Errors are sent as their message,
+// along with that of the sentinel error they wrap, if any, so callers
+// can still check for the sentinels with errors.Is.
+type tcpError struct {
+	Msg      string
+	Sentinel string
+}
+
+// Sentinel errors that are kept across the wire
+var tcpSentinels = []error{ErrVnodeDraining, ErrPredecessorRejected}
+
+func init() {
+	gob.Register(&tcpError{})
+}
+
+func (e *tcpError) Error() string {
+	return e.Msg
+}
+
+func (e *tcpError) Unwrap() error {
+	for _, s := range tcpSentinels {
+		if e.Sentinel != "" && s.Error() == e.Sentinel {
+			return s
+		}
+	}
+	return nil
+}
+
+// Converts an error to be sent to a remote caller
+func remoteError(err error) error {
+	if err == nil {
+		return nil
+	}
+	res := &tcpError{Msg: err.Error()}
+	for _, s := range tcpSentinels {
+		if errors.Is(err, s) {
+			res.Sentinel = s.Error()
+			break
+		}
+	}
+	return res
 }
 
 // Potential body types
 type tcpBodyError struct {
 	Err error
 }
+type tcpBodySigned struct {
+	Body []byte
+	Sig  []byte // HMAC of a response, unset for requests
+}
 type tcpBodyString struct {
 	S string
 }
+type tcpBodyRange struct {
+	S     string
+	Start []byte
+	End   []byte
+}
 type tcpBodyVnode struct {
 	Vn *Vnode
 }
+type tcpBodyVnodeList struct {
+	Vnodes []*Vnode
+}
 type tcpBodyTwoVnode struct {
-	Target *Vnode
-	Vn     *Vnode
+	Target  *Vnode
+	Vn      *Vnode
+	Payload []byte
+	Load    *float64
 }
 type tcpBodyFindSuc struct {
-	Target *Vnode
-	Num    int
-	Key    []byte
+	Target  *Vnode
+	Num     int
+	Key     []byte
+	Visited []*Vnode
+	Trace   bool // Return every vnode that handled the lookup
 }
 type tcpBodyVnodeError struct {
 	Vnode *Vnode
 	Err   error
 }
 type tcpBodyVnodeListError struct {
-	Vnodes []*Vnode
-	Err    error
+	Vnodes  []*Vnode
+	Payload []byte
+	Load    *float64
+	Path    []*Vnode
+	Err     error
 }
 type tcpBodyBoolError struct {
 	B   bool
 	Err error
 }
+type tcpBodyBoolListError struct {
+	B   []bool
+	Err error
+}
+type tcpBodyHealthError struct {
+	Health *VnodeHealth
+	Err    error
+}
 
 // Creates a new TCP transport on the given listen address with the
 // configured timeout duration.
 func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, error) {
+	return InitTCPTransportWithOptions(listen, timeout, DefaultTCPOptions())
+}
+
+// Creates a new TCP transport on the given listen address with the
+// configured timeout duration and socket options.
+func InitTCPTransportWithOptions(listen string, timeout time.Duration, opts TCPOptions) (*TCPTransport, error) {
+	// Bind only the requested interface
+	if opts.BindIP != "" {
+		addr, err := bindAddr(listen, opts.BindIP)
+		if err != nil {
+			return nil, err
+		}
+		listen = addr
+	}
+
 	// Try to start the listener
 	sock, err := net.Listen("tcp", listen)
 	if err != nil {
@@ -97,7 +287,7 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 	}
 
 	// allocate maps
-	local := make(map[string]*localRPC)
+	local := make(map[string]map[string]*localRPC)
 	inbound := make(map[*net.TCPConn]struct{})
 	pool := make(map[string][]*tcpOutConn)
 
@@ -106,11 +296,17 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 
 	// Setup the transport
 	tcp := &TCPTransport{sock: sock.(*net.TCPListener),
-		timeout: timeout,
-		maxIdle: maxIdle,
-		local:   local,
-		inbound: inbound,
-		pool:    pool}
+		maxIdle:    maxIdle,
+		local:      local,
+		inbound:    inbound,
+		pool:       pool,
+		open:       make(map[string]int),
+		breakers:   make(map[string]*tcpBreaker),
+		slots:      make(map[string]chan struct{}),
+		shutdownCh: make(chan struct{}),
+		opts:       opts}
+	tcp.initTimeout = timeout
+	tcp.timeout.Store(int64(timeout))
 
 	// Listen for connections
 	go tcp.listen()
@@ -122,12 +318,188 @@ func InitTCPTransport(listen string, timeout time.Duration) (*TCPTransport, erro
 	return tcp, nil
 }
 
-// Checks for a local vnode
-func (t *TCPTransport) get(vn *Vnode) (VnodeRPC, bool) {
+// Sends the header and body of a request. With a secret, the body is
+// encoded on its own and sent as bytes, so that the receiver can check
+// the signature over exactly the bytes it decodes.
+func (t *TCPTransport) sendRequest(out *tcpOutConn, body interface{}) error {
+	if t.opts.Secret == "" {
+		if err := out.enc.Encode(&out.header); err != nil {
+			return err
+		}
+		return out.enc.Encode(body)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		return err
+	}
+	out.header.Time = time.Now().UnixNano()
+	out.header.Sig = signRequest(t.opts.Secret, &out.header, buf.Bytes())
+	if err := out.enc.Encode(&out.header); err != nil {
+		return err
+	}
+	return out.enc.Encode(&tcpBodySigned{Body: buf.Bytes()})
+}
+
+// Reads the response to a request. With a secret, the response must be
+// signed along with the signature of the request it answers.
+func (t *TCPTransport) recvResponse(out *tcpOutConn, resp interface{}) error {
+	if t.opts.Secret == "" {
+		return out.dec.Decode(resp)
+	}
+	signed := tcpBodySigned{}
+	if err := out.dec.Decode(&signed); err != nil {
+		return err
+	}
+	if !hmac.Equal(signed.Sig, signResponse(t.opts.Secret, out.header.Sig, signed.Body)) {
+		return fmt.Errorf("Rejected TCP response with a bad signature from %s!", out.host)
+	}
+	return gob.NewDecoder(bytes.NewReader(signed.Body)).Decode(resp)
+}
+
+// Returns the HMAC of a request type, namespace, send time and encoded
+// body
+func signRequest(secret string, header *tcpHeader, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(header.ReqType))
+	mac.Write(buf[:])
+	binary.BigEndian.PutUint64(buf[:], uint64(len(header.Namespace)))
+	mac.Write(buf[:])
+	mac.Write([]byte(header.Namespace))
+	binary.BigEndian.PutUint64(buf[:], uint64(header.Time))
+	mac.Write(buf[:])
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Returns the HMAC of an encoded response, bound to the signature of
+// the request it answers so it cannot be replayed for another request
+func signResponse(secret string, reqSig []byte, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("response"))
+	mac.Write(reqSig)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// Returns the address to listen on for a bind IP, using the port of the
+// listen address. The IP must belong to a local interface, so that a
+// typo cannot fall back to listening on another one.
+func bindAddr(listen string, bind string) (string, error) {
+	_, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", err
+	}
+	ip := net.ParseIP(bind)
+	if ip == nil {
+		return "", fmt.Errorf("Invalid bind IP %s!", bind)
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return "", fmt.Errorf("Failed to list interfaces! Got %s", err)
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return net.JoinHostPort(ip.String(), port), nil
+		}
+	}
+	return "", fmt.Errorf("Bind IP %s is not a local interface address!", ip)
+}
+
+// Sets the timeout of every call, replacing the one given at Init. This
+// may be changed while the transport is in use, such as to allow for a
+// slow maintenance window, and applies to the calls made after it. Zero
+// or a negative timeout reverts to the timeout given at Init.
+func (t *TCPTransport) SetTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = t.initTimeout
+	}
+	t.timeout.Store(int64(timeout))
+}
+
+// Sets the timeout used for Ping requests. This defaults to the
+// timeout of the transport, but may be set lower to detect failed
+// nodes faster. As with SetTimeout, this may be changed while the
+// transport is in use, and zero reverts to the timeout of the transport.
+func (t *TCPTransport) SetPingTimeout(timeout time.Duration) {
+	t.pingTimeout.Store(int64(timeout))
+}
+
+// Returns the current timeout of a call
+func (t *TCPTransport) callTimeout() time.Duration {
+	return time.Duration(t.timeout.Load())
+}
+
+// Returns the current timeout of a ping
+func (t *TCPTransport) pingCallTimeout() time.Duration {
+	if timeout := t.pingTimeout.Load(); timeout > 0 {
+		return time.Duration(timeout)
+	}
+	return t.callTimeout()
+}
+
+// Caps a timeout to a limit, if one is set
+func limitTimeout(timeout, limit time.Duration) time.Duration {
+	if limit > 0 && limit < timeout {
+		return limit
+	}
+	return timeout
+}
+
+// Returns a view of the transport that bounds each call to a timeout,
+// or the timeout of the transport if it is shorter
+func (t *TCPTransport) withCallTimeout(timeout time.Duration) Transport {
+	return &tcpNamespace{t: t, limit: timeout}
+}
+
+// Takes a connection slot for a host, waiting up to the timeout
+func (t *TCPTransport) acquireSlot(host string, timeout time.Duration) error {
+	if t.opts.MaxConns <= 0 {
+		return nil
+	}
+	t.poolLock.Lock()
+	slots, ok := t.slots[host]
+	if !ok {
+		slots = make(chan struct{}, t.opts.MaxConns)
+		t.slots[host] = slots
+	}
+	t.poolLock.Unlock()
+
+	select {
+	case slots <- struct{}{}:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("Timed out waiting for a connection to %s!", host)
+	case <-t.shutdownCh:
+		return fmt.Errorf("TCP transport is shutdown")
+	}
+}
+
+// Frees a connection slot for a host
+func (t *TCPTransport) releaseSlot(host string) {
+	if t.opts.MaxConns <= 0 {
+		return
+	}
+	t.poolLock.Lock()
+	slots := t.slots[host]
+	t.poolLock.Unlock()
+	<-slots
+}
+
+// Returns a random duration within the jitter window
+func (t *TCPTransport) randJitter() time.Duration {
+	if t.opts.ReconnectJitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(t.opts.ReconnectJitter)))
+}
+
+// Checks for a local vnode in a namespace
+func (t *TCPTransport) get(ns string, vn *Vnode) (VnodeRPC, bool) {
 	key := vn.String()
 	t.lock.RLock()
 	defer t.lock.RUnlock()
-	w, ok := t.local[key]
+	w, ok := t.local[ns][key]
 	if ok {
 		return w.obj, ok
 	} else {
@@ -135,8 +507,46 @@ func (t *TCPTransport) get(vn *Vnode) (VnodeRPC, bool) {
 	}
 }
 
-// Gets an outbound connection to a host
-func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
+// Checks for a local vnode to serve a routing request, as with
+// getContext. A vnode that has started to leave refuses the request
+// with ErrVnodeDraining, rather than serve its stale routing state.
+func (t *TCPTransport) getRouting(ctx context.Context, ns string, vn *Vnode) (VnodeRPC, error) {
+	obj, ok := t.get(ns, vn)
+	if !ok {
+		return nil, fmt.Errorf("Target VN not found! Target %s:%s", vn.Host, vn.String())
+	}
+	if d, ok := obj.(drainer); ok && d.isDraining() {
+		return nil, fmt.Errorf("%w Target %s:%s", ErrVnodeDraining, vn.Host, vn.String())
+	}
+	return withContextRPC(ctx, obj), nil
+}
+
+// Checks for a local vnode in a namespace, wrapping it to receive
+// the context of an inbound RPC
+func (t *TCPTransport) getContext(ctx context.Context, ns string, vn *Vnode) (VnodeRPC, bool) {
+	obj, ok := t.get(ns, vn)
+	if ok {
+		obj = withContextRPC(ctx, obj)
+	}
+	return obj, ok
+}
+
+// Gets an outbound connection to a host. The connection holds a slot
+// until it is returned with returnConn, or closed with failConn, as
+// done by roundTrip.
+func (t *TCPTransport) getConn(host string, timeout time.Duration) (*tcpOutConn, error) {
+	if err := t.acquireSlot(host, timeout); err != nil {
+		return nil, err
+	}
+	out, err := t.dialConn(host, timeout)
+	if err != nil {
+		t.releaseSlot(host)
+	}
+	return out, err
+}
+
+// Gets a pooled connection to a host, or dials a new one
+func (t *TCPTransport) dialConn(host string, timeout time.Duration) (*tcpOutConn, error) {
 	// Check if we have a conn cached
 	var out *tcpOutConn
 	t.poolLock.Lock()
@@ -152,15 +562,32 @@ func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 	}
 	t.poolLock.Unlock()
 	if out != nil {
-		// Verify that the socket is valid. Might be closed.
-		if _, err := out.sock.Read(nil); err == nil {
-			return out, nil
+		// The socket might be closed, which roundTrip detects and redials
+		out.reused = true
+		return out, nil
+	}
+	return t.newConn(host, timeout)
+}
+
+// Dials a new connection to a host
+func (t *TCPTransport) newConn(host string, timeout time.Duration) (*tcpOutConn, error) {
+	// Fail fast if the host is known to be down
+	if t.breakerOpen(host) {
+		return nil, fmt.Errorf("Circuit open for host %s!", host)
+	}
+
+	// Spread out reconnections to a host that was failing
+	if t.reconnecting(host) {
+		select {
+		case <-time.After(t.randJitter()):
+		case <-t.shutdownCh:
+			return nil, fmt.Errorf("TCP transport is shutdown")
 		}
-		out.sock.Close()
 	}
 
 	// Try to establish a connection
-	conn, err := net.DialTimeout("tcp", host, t.timeout)
+	conn, err := net.DialTimeout("tcp", host, timeout)
+	t.recordDial(host, err)
 	if err != nil {
 		return nil, err
 	}
@@ -173,12 +600,153 @@ func (t *TCPTransport) getConn(host string) (*tcpOutConn, error) {
 	now := time.Now()
 
 	// Wrap the sock
-	out = &tcpOutConn{host: host, sock: sock, enc: enc, dec: dec, used: now}
+	out := &tcpOutConn{host: host, sock: sock, enc: enc, dec: dec, used: now}
+	t.poolLock.Lock()
+	t.open[host]++
+	t.poolLock.Unlock()
 	return out, nil
 }
 
+// Checks if an error means a connection is broken, rather than that
+// the request was invalid
+func isConnError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.As(err, &netErr) && !netErr.Timeout()
+}
+
+// Sends a request over a connection and decodes the response. The
+// connection is returned to the pool on success, and closed otherwise.
+// If a pooled connection is broken, as when the peer restarted since it
+// was last used, it is discarded and the request is retried once on a
+// freshly dialed connection, keeping the slot of the host. The request
+// must complete within the timeout, so that a peer that never responds
+// cannot hold the connection and its slot once the caller gave up.
+func (t *TCPTransport) roundTrip(out *tcpOutConn, timeout time.Duration, body, resp interface{}) error {
+	for {
+		out.sock.SetDeadline(time.Now().Add(timeout))
+		err := t.sendRequest(out, body)
+		if err == nil {
+			err = t.recvResponse(out, resp)
+		}
+		if err == nil {
+			out.sock.SetDeadline(time.Time{})
+			t.returnConn(out)
+			return nil
+		}
+		if !out.reused || !isConnError(err) {
+			t.failConn(out)
+			return err
+		}
+
+		stale := out
+		t.poolLock.Lock()
+		t.closeConn(stale)
+		t.poolLock.Unlock()
+		if out, err = t.newConn(stale.host, timeout); err != nil {
+			t.releaseSlot(stale.host)
+			return err
+		}
+		out.header = stale.header
+	}
+}
+
+// Closes an outbound connection after a failed request, since the
+// state of its stream is unknown
+func (t *TCPTransport) failConn(o *tcpOutConn) {
+	t.poolLock.Lock()
+	t.closeConn(o)
+	t.poolLock.Unlock()
+	t.releaseSlot(o.host)
+}
+
+// Closes an outbound connection. The pool lock must be held.
+func (t *TCPTransport) closeConn(o *tcpOutConn) {
+	o.sock.Close()
+	if t.open[o.host]--; t.open[o.host] <= 0 {
+		delete(t.open, o.host)
+	}
+}
+
+// Returns the address the transport is listening on. When listening on
+// port zero, this has the port that was chosen, which should then be
+// used as the Hostname of the ring.
+func (t *TCPTransport) LocalAddr() net.Addr {
+	return t.sock.Addr()
+}
+
+// Returns the outbound connections held to each host
+func (t *TCPTransport) PoolStats() map[string]TCPPoolStats {
+	t.poolLock.Lock()
+	defer t.poolLock.Unlock()
+	res := make(map[string]TCPPoolStats, len(t.open))
+	for host, open := range t.open {
+		res[host] = TCPPoolStats{Open: open}
+	}
+	for host, conns := range t.pool {
+		if len(conns) == 0 {
+			continue
+		}
+		stats := res[host]
+		stats.Idle = len(conns)
+		for _, o := range conns {
+			if o.used.After(stats.LastUsed) {
+				stats.LastUsed = o.used
+			}
+		}
+		res[host] = stats
+	}
+	return res
+}
+
+// Checks if the circuit breaker for a host is open
+func (t *TCPTransport) breakerOpen(host string) bool {
+	if t.opts.MaxDialFailures <= 0 {
+		return false
+	}
+	t.poolLock.Lock()
+	defer t.poolLock.Unlock()
+	b, ok := t.breakers[host]
+	return ok && time.Now().Before(b.open)
+}
+
+// Checks if the last dial to a host failed, when jitter is enabled
+func (t *TCPTransport) reconnecting(host string) bool {
+	if t.opts.ReconnectJitter <= 0 {
+		return false
+	}
+	t.poolLock.Lock()
+	defer t.poolLock.Unlock()
+	_, ok := t.breakers[host]
+	return ok
+}
+
+// Records the result of a dial for the circuit breaker and jitter
+func (t *TCPTransport) recordDial(host string, err error) {
+	if t.opts.MaxDialFailures <= 0 && t.opts.ReconnectJitter <= 0 {
+		return
+	}
+	t.poolLock.Lock()
+	defer t.poolLock.Unlock()
+	if err == nil {
+		delete(t.breakers, host)
+		return
+	}
+	b, ok := t.breakers[host]
+	if !ok {
+		b = &tcpBreaker{}
+		t.breakers[host] = b
+	}
+	b.failures++
+	if t.opts.MaxDialFailures > 0 && b.failures >= t.opts.MaxDialFailures {
+		b.open = time.Now().Add(t.opts.BreakerCooldown + t.randJitter())
+	}
+}
+
 // Returns an outbound TCP connection to the pool
 func (t *TCPTransport) returnConn(o *tcpOutConn) {
+	defer t.releaseSlot(o.host)
+
 	// Update the last used time
 	o.used = time.Now()
 
@@ -186,7 +754,7 @@ func (t *TCPTransport) returnConn(o *tcpOutConn) {
 	t.poolLock.Lock()
 	defer t.poolLock.Unlock()
 	if atomic.LoadInt32(&t.shutdown) == 1 {
-		o.sock.Close()
+		t.closeConn(o)
 		return
 	}
 	list, _ := t.pool[o.host]
@@ -195,14 +763,28 @@ func (t *TCPTransport) returnConn(o *tcpOutConn) {
 
 // Setup a connection
 func (t *TCPTransport) setupConn(c *net.TCPConn) {
-	c.SetNoDelay(true)
-	c.SetKeepAlive(true)
+	c.SetNoDelay(t.opts.NoDelay)
+	c.SetKeepAlive(t.opts.KeepAlive)
+	if t.opts.KeepAlive && t.opts.KeepAlivePeriod > 0 {
+		c.SetKeepAlivePeriod(t.opts.KeepAlivePeriod)
+	}
 }
 
 // Gets a list of the vnodes on the box
 func (t *TCPTransport) ListVnodes(host string) ([]*Vnode, error) {
+	return t.listVnodes("", 0, host, nil)
+}
+
+// Gets a list of the vnodes on the box with IDs in the range (start, end]
+func (t *TCPTransport) ListVnodesInRange(host string, start, end []byte) ([]*Vnode, error) {
+	return t.listVnodes("", 0, host, &tcpBodyRange{S: host, Start: start, End: end})
+}
+
+// Lists the vnodes of a host, or only those in a range if given
+func (t *TCPTransport) listVnodes(ns string, limit time.Duration, host string, rng *tcpBodyRange) ([]*Vnode, error) {
 	// Get a conn
-	out, err := t.getConn(host)
+	timeout := limitTimeout(t.callTimeout(), limit)
+	out, err := t.getConn(host, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -213,25 +795,20 @@ func (t *TCPTransport) ListVnodes(host string) ([]*Vnode, error) {
 
 	go func() {
 		// Send a list command
+		var body interface{} = &tcpBodyString{S: host}
 		out.header.ReqType = tcpListReq
-		body := tcpBodyString{S: host}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
+		if rng != nil {
+			body = rng
+			out.header.ReqType = tcpListRangeReq
 		}
+		out.header.Namespace = ns
 
-		// Read in the response
+		// Send it and read in the response
 		resp := tcpBodyVnodeListError{}
-		if err := out.dec.Decode(&resp); err != nil {
+		if err := t.roundTrip(out, timeout, body, &resp); err != nil {
 			errChan <- err
+			return
 		}
-
-		// Return the connection
-		t.returnConn(out)
 		if resp.Err == nil {
 			respChan <- resp.Vnodes
 		} else {
@@ -240,7 +817,7 @@ func (t *TCPTransport) ListVnodes(host string) ([]*Vnode, error) {
 	}()
 
 	select {
-	case <-time.After(t.timeout):
+	case <-time.After(timeout):
 		return nil, fmt.Errorf("Command timed out!")
 	case err := <-errChan:
 		return nil, err
@@ -249,10 +826,17 @@ func (t *TCPTransport) ListVnodes(host string) ([]*Vnode, error) {
 	}
 }
 
-// Ping a Vnode, check for liveness
+// Ping a Vnode, check for liveness. Returns false without an error
+// if the remote host does not have the vnode, and an error if the
+// remote host could not be reached.
 func (t *TCPTransport) Ping(vn *Vnode) (bool, error) {
+	return t.ping("", 0, vn)
+}
+
+func (t *TCPTransport) ping(ns string, limit time.Duration, vn *Vnode) (bool, error) {
 	// Get a conn
-	out, err := t.getConn(vn.Host)
+	timeout := limitTimeout(t.pingCallTimeout(), limit)
+	out, err := t.getConn(vn.Host, timeout)
 	if err != nil {
 		return false, err
 	}
@@ -264,25 +848,95 @@ func (t *TCPTransport) Ping(vn *Vnode) (bool, error) {
 	go func() {
 		// Send a list command
 		out.header.ReqType = tcpPing
+		out.header.Namespace = ns
 		body := tcpBodyVnode{Vn: vn}
-		if err := out.enc.Encode(&out.header); err != nil {
+
+		// Send it and read in the response
+		resp := tcpBodyBoolError{}
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
 			errChan <- err
 			return
 		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
+		if resp.Err == nil {
+			respChan <- resp.B
+		} else {
+			errChan <- resp.Err
 		}
+	}()
 
-		// Read in the response
-		resp := tcpBodyBoolError{}
-		if err := out.dec.Decode(&resp); err != nil {
+	select {
+	case <-time.After(timeout):
+		return false, fmt.Errorf("Command timed out!")
+	case err := <-errChan:
+		return false, err
+	case res := <-respChan:
+		return res, nil
+	}
+}
+
+// Ping a list of vnodes, sending a single request to each host
+func (t *TCPTransport) BatchPing(vns []*Vnode) ([]bool, error) {
+	return t.batchPing("", 0, vns)
+}
+
+func (t *TCPTransport) batchPing(ns string, limit time.Duration, vns []*Vnode) ([]bool, error) {
+	// Group the vnodes by host, preserving order
+	var hosts []string
+	byHost := make(map[string][]int)
+	for idx, vn := range vns {
+		if _, ok := byHost[vn.Host]; !ok {
+			hosts = append(hosts, vn.Host)
+		}
+		byHost[vn.Host] = append(byHost[vn.Host], idx)
+	}
+
+	// Ping each host, unreachable hosts are left as dead
+	res := make([]bool, len(vns))
+	var err error
+	for _, host := range hosts {
+		idxs := byHost[host]
+		batch := make([]*Vnode, len(idxs))
+		for i, idx := range idxs {
+			batch[i] = vns[idx]
+		}
+		alive, hostErr := t.batchPingHost(ns, limit, host, batch)
+		if hostErr != nil {
+			err = hostErr
+			continue
+		}
+		for i, idx := range idxs {
+			if i < len(alive) {
+				res[idx] = alive[i]
+			}
+		}
+	}
+	return res, err
+}
+
+func (t *TCPTransport) batchPingHost(ns string, limit time.Duration, host string, vns []*Vnode) ([]bool, error) {
+	// Get a conn
+	timeout := limitTimeout(t.pingCallTimeout(), limit)
+	out, err := t.getConn(host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	// Response channels
+	respChan := make(chan []bool, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		// Send a batch ping command
+		out.header.ReqType = tcpBatchPingReq
+		out.header.Namespace = ns
+		body := tcpBodyVnodeList{Vnodes: vns}
+
+		// Send it and read in the response
+		resp := tcpBodyBoolListError{}
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
 			errChan <- err
 			return
 		}
-
-		// Return the connection
-		t.returnConn(out)
 		if resp.Err == nil {
 			respChan <- resp.B
 		} else {
@@ -291,10 +945,10 @@ func (t *TCPTransport) Ping(vn *Vnode) (bool, error) {
 	}()
 
 	select {
-	case <-time.After(t.timeout):
-		return false, fmt.Errorf("Command timed out!")
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Command timed out!")
 	case err := <-errChan:
-		return false, err
+		return nil, err
 	case res := <-respChan:
 		return res, nil
 	}
@@ -302,8 +956,13 @@ func (t *TCPTransport) Ping(vn *Vnode) (bool, error) {
 
 // Request a nodes predecessor
 func (t *TCPTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	return t.getPredecessor("", 0, vn)
+}
+
+func (t *TCPTransport) getPredecessor(ns string, limit time.Duration, vn *Vnode) (*Vnode, error) {
 	// Get a conn
-	out, err := t.getConn(vn.Host)
+	timeout := limitTimeout(t.callTimeout(), limit)
+	out, err := t.getConn(vn.Host, timeout)
 	if err != nil {
 		return nil, err
 	}
@@ -314,25 +973,15 @@ func (t *TCPTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
 	go func() {
 		// Send a list command
 		out.header.ReqType = tcpGetPredReq
+		out.header.Namespace = ns
 		body := tcpBodyVnode{Vn: vn}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
 
-		// Read in the response
+		// Send it and read in the response
 		resp := tcpBodyVnodeError{}
-		if err := out.dec.Decode(&resp); err != nil {
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
 			errChan <- err
 			return
 		}
-
-		// Return the connection
-		t.returnConn(out)
 		if resp.Err == nil {
 			respChan <- resp.Vnode
 		} else {
@@ -341,7 +990,7 @@ func (t *TCPTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
 	}()
 
 	select {
-	case <-time.After(t.timeout):
+	case <-time.After(timeout):
 		return nil, fmt.Errorf("Command timed out!")
 	case err := <-errChan:
 		return nil, err
@@ -351,109 +1000,124 @@ func (t *TCPTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
 }
 
 // Notify our successor of ourselves
-func (t *TCPTransport) Notify(target, self *Vnode) ([]*Vnode, error) {
+func (t *TCPTransport) Notify(target, self *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	succs, resp, _, err := t.notify("", 0, target, self, payload, nil)
+	return succs, resp, err
+}
+
+// Notify our successor of ourselves, along with our load
+func (t *TCPTransport) NotifyLoad(target, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	return t.notify("", 0, target, self, payload, load)
+}
+
+func (t *TCPTransport) notify(ns string, limit time.Duration, target, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
 	// Get a conn
-	out, err := t.getConn(target.Host)
+	timeout := limitTimeout(t.callTimeout(), limit)
+	out, err := t.getConn(target.Host, timeout)
 	if err != nil {
-		return nil, err
+		return nil, nil, nil, err
 	}
 
-	respChan := make(chan []*Vnode, 1)
+	respChan := make(chan *tcpBodyVnodeListError, 1)
 	errChan := make(chan error, 1)
 
 	go func() {
 		// Send a list command
 		out.header.ReqType = tcpNotifyReq
-		body := tcpBodyTwoVnode{Target: target, Vn: self}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
+		out.header.Namespace = ns
+		body := tcpBodyTwoVnode{Target: target, Vn: self, Payload: payload, Load: load}
 
-		// Read in the response
+		// Send it and read in the response
 		resp := tcpBodyVnodeListError{}
-		if err := out.dec.Decode(&resp); err != nil {
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
 			errChan <- err
 			return
 		}
-
-		// Return the connection
-		t.returnConn(out)
 		if resp.Err == nil {
-			respChan <- resp.Vnodes
+			respChan <- &resp
 		} else {
 			errChan <- resp.Err
 		}
 	}()
 
 	select {
-	case <-time.After(t.timeout):
-		return nil, fmt.Errorf("Command timed out!")
+	case <-time.After(timeout):
+		return nil, nil, nil, fmt.Errorf("Command timed out!")
 	case err := <-errChan:
-		return nil, err
+		return nil, nil, nil, err
 	case res := <-respChan:
-		return res, nil
+		return res.Vnodes, res.Payload, res.Load, nil
 	}
 }
 
-// Find a successor
-func (t *TCPTransport) FindSuccessors(vn *Vnode, n int, k []byte) ([]*Vnode, error) {
+// Find a successor. The path returned is the visited vnodes, followed
+// by the vnode that answered.
+func (t *TCPTransport) FindSuccessors(vn *Vnode, n int, k []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	return t.findSuccessors("", 0, vn, n, k, visited, false)
+}
+
+// Find a successor, returning every vnode that handled the lookup if
+// it is traced
+func (t *TCPTransport) FindSuccessorsTrace(vn *Vnode, n int, k []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	return t.findSuccessors("", 0, vn, n, k, visited, trace)
+}
+
+func (t *TCPTransport) findSuccessors(ns string, limit time.Duration, vn *Vnode, n int, k []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
 	// Get a conn
-	out, err := t.getConn(vn.Host)
+	timeout := limitTimeout(t.callTimeout(), limit)
+	out, err := t.getConn(vn.Host, timeout)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	respChan := make(chan []*Vnode, 1)
+	respChan := make(chan *tcpBodyVnodeListError, 1)
 	errChan := make(chan error, 1)
 
 	go func() {
 		// Send a list command
 		out.header.ReqType = tcpFindSucReq
-		body := tcpBodyFindSuc{Target: vn, Num: n, Key: k}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
+		out.header.Namespace = ns
+		body := tcpBodyFindSuc{Target: vn, Num: n, Key: k, Visited: visited, Trace: trace}
 
-		// Read in the response
+		// Send it and read in the response
 		resp := tcpBodyVnodeListError{}
-		if err := out.dec.Decode(&resp); err != nil {
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
 			errChan <- err
 			return
 		}
-
-		// Return the connection
-		t.returnConn(out)
 		if resp.Err == nil {
-			respChan <- resp.Vnodes
+			respChan <- &resp
 		} else {
 			errChan <- resp.Err
 		}
 	}()
 
 	select {
-	case <-time.After(t.timeout):
-		return nil, fmt.Errorf("Command timed out!")
+	case <-time.After(timeout):
+		return nil, nil, fmt.Errorf("Command timed out!")
 	case err := <-errChan:
-		return nil, err
+		return nil, nil, err
 	case res := <-respChan:
-		return res, nil
+		if trace {
+			return res.Vnodes, res.Path, nil
+		}
+
+		// Only the vnode that answered is sent back
+		path := make([]*Vnode, len(visited), len(visited)+len(res.Path))
+		copy(path, visited)
+		return res.Vnodes, append(path, res.Path...), nil
 	}
 }
 
 // Clears a predecessor if it matches a given vnode. Used to leave.
 func (t *TCPTransport) ClearPredecessor(target, self *Vnode) error {
+	return t.clearPredecessor("", 0, target, self)
+}
+
+func (t *TCPTransport) clearPredecessor(ns string, limit time.Duration, target, self *Vnode) error {
 	// Get a conn
-	out, err := t.getConn(target.Host)
+	timeout := limitTimeout(t.callTimeout(), limit)
+	out, err := t.getConn(target.Host, timeout)
 	if err != nil {
 		return err
 	}
@@ -464,25 +1128,15 @@ func (t *TCPTransport) ClearPredecessor(target, self *Vnode) error {
 	go func() {
 		// Send a list command
 		out.header.ReqType = tcpClearPredReq
+		out.header.Namespace = ns
 		body := tcpBodyTwoVnode{Target: target, Vn: self}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
 
-		// Read in the response
+		// Send it and read in the response
 		resp := tcpBodyError{}
-		if err := out.dec.Decode(&resp); err != nil {
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
 			errChan <- err
 			return
 		}
-
-		// Return the connection
-		t.returnConn(out)
 		if resp.Err == nil {
 			respChan <- true
 		} else {
@@ -491,7 +1145,7 @@ func (t *TCPTransport) ClearPredecessor(target, self *Vnode) error {
 	}()
 
 	select {
-	case <-time.After(t.timeout):
+	case <-time.After(timeout):
 		return fmt.Errorf("Command timed out!")
 	case err := <-errChan:
 		return err
@@ -502,8 +1156,13 @@ func (t *TCPTransport) ClearPredecessor(target, self *Vnode) error {
 
 // Instructs a node to skip a given successor. Used to leave.
 func (t *TCPTransport) SkipSuccessor(target, self *Vnode) error {
+	return t.skipSuccessor("", 0, target, self)
+}
+
+func (t *TCPTransport) skipSuccessor(ns string, limit time.Duration, target, self *Vnode) error {
 	// Get a conn
-	out, err := t.getConn(target.Host)
+	timeout := limitTimeout(t.callTimeout(), limit)
+	out, err := t.getConn(target.Host, timeout)
 	if err != nil {
 		return err
 	}
@@ -514,25 +1173,15 @@ func (t *TCPTransport) SkipSuccessor(target, self *Vnode) error {
 	go func() {
 		// Send a list command
 		out.header.ReqType = tcpSkipSucReq
+		out.header.Namespace = ns
 		body := tcpBodyTwoVnode{Target: target, Vn: self}
-		if err := out.enc.Encode(&out.header); err != nil {
-			errChan <- err
-			return
-		}
-		if err := out.enc.Encode(&body); err != nil {
-			errChan <- err
-			return
-		}
 
-		// Read in the response
+		// Send it and read in the response
 		resp := tcpBodyError{}
-		if err := out.dec.Decode(&resp); err != nil {
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
 			errChan <- err
 			return
 		}
-
-		// Return the connection
-		t.returnConn(out)
 		if resp.Err == nil {
 			respChan <- true
 		} else {
@@ -541,7 +1190,7 @@ func (t *TCPTransport) SkipSuccessor(target, self *Vnode) error {
 	}()
 
 	select {
-	case <-time.After(t.timeout):
+	case <-time.After(timeout):
 		return fmt.Errorf("Command timed out!")
 	case err := <-errChan:
 		return err
@@ -550,17 +1199,111 @@ func (t *TCPTransport) SkipSuccessor(target, self *Vnode) error {
 	}
 }
 
+// Request the health of a vnode
+func (t *TCPTransport) Health(vn *Vnode) (*VnodeHealth, error) {
+	return t.health("", 0, vn)
+}
+
+func (t *TCPTransport) health(ns string, limit time.Duration, vn *Vnode) (*VnodeHealth, error) {
+	// Get a conn
+	timeout := limitTimeout(t.callTimeout(), limit)
+	out, err := t.getConn(vn.Host, timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	respChan := make(chan *VnodeHealth, 1)
+	errChan := make(chan error, 1)
+
+	go func() {
+		// Send a list command
+		out.header.ReqType = tcpHealthReq
+		out.header.Namespace = ns
+		body := tcpBodyVnode{Vn: vn}
+
+		// Send it and read in the response
+		resp := tcpBodyHealthError{}
+		if err := t.roundTrip(out, timeout, &body, &resp); err != nil {
+			errChan <- err
+			return
+		}
+		if resp.Err == nil {
+			respChan <- resp.Health
+		} else {
+			errChan <- resp.Err
+		}
+	}()
+
+	select {
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("Command timed out!")
+	case err := <-errChan:
+		return nil, err
+	case res := <-respChan:
+		return res, nil
+	}
+}
+
 // Register for an RPC callbacks
 func (t *TCPTransport) Register(v *Vnode, o VnodeRPC) {
+	t.register("", v, o)
+}
+
+// Deregister stops serving a vnode, which is then confirmed dead to
+// any pings
+func (t *TCPTransport) Deregister(v *Vnode) {
+	t.deregister("", v)
+}
+
+func (t *TCPTransport) deregister(ns string, v *Vnode) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.local[ns], v.String())
+}
+
+func (t *TCPTransport) register(ns string, v *Vnode, o VnodeRPC) {
 	key := v.String()
 	t.lock.Lock()
-	t.local[key] = &localRPC{v, o}
-	t.lock.Unlock()
+	defer t.lock.Unlock()
+	local, ok := t.local[ns]
+	if !ok {
+		local = make(map[string]*localRPC)
+		t.local[ns] = local
+	}
+	local[key] = &localRPC{v, o}
 }
 
-// Shutdown the TCP transport
+// Checks if vnodes of a host are registered in a namespace
+func (t *TCPTransport) registeredIn(ns, host string) bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+	for _, rpc := range t.local[ns] {
+		if rpc.vnode.Host == host {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *TCPTransport) registered(host string) bool {
+	return t.registeredIn("", host)
+}
+
+// Namespace returns a Transport which uses the TCP transport to serve
+// an independent ring. Vnodes registered in one namespace are not
+// visible to the other namespaces, allowing several rings to share a
+// single listener even if their vnode IDs collide. The TCPTransport
+// itself uses the empty namespace.
+func (t *TCPTransport) Namespace(ns string) Transport {
+	return &tcpNamespace{t: t, ns: ns}
+}
+
+// Shutdown the TCP transport. It is safe to call more than once.
 func (t *TCPTransport) Shutdown() {
-	atomic.StoreInt32(&t.shutdown, 1)
+	if !atomic.CompareAndSwapInt32(&t.shutdown, 0, 1) {
+		return
+	}
+	close(t.shutdownCh)
 	t.sock.Close()
 
 	// Close all the inbound connections
@@ -574,7 +1317,7 @@ func (t *TCPTransport) Shutdown() {
 	t.poolLock.Lock()
 	for _, conns := range t.pool {
 		for _, out := range conns {
-			out.sock.Close()
+			t.closeConn(out)
 		}
 	}
 	t.pool = nil
@@ -584,11 +1327,12 @@ func (t *TCPTransport) Shutdown() {
 // Closes old outbound connections
 func (t *TCPTransport) reapOld() {
 	for {
-		if atomic.LoadInt32(&t.shutdown) == 1 {
+		select {
+		case <-time.After(30 * time.Second):
+			t.reapOnce()
+		case <-t.shutdownCh:
 			return
 		}
-		time.Sleep(30 * time.Second)
-		t.reapOnce()
 	}
 }
 
@@ -599,7 +1343,7 @@ func (t *TCPTransport) reapOnce() {
 		max := len(conns)
 		for i := 0; i < max; i++ {
 			if time.Since(conns[i].used) > t.maxIdle {
-				conns[i].sock.Close()
+				t.closeConn(conns[i])
 				conns[i], conns[max-1] = conns[max-1], nil
 				max--
 				i--
@@ -612,16 +1356,31 @@ func (t *TCPTransport) reapOnce() {
 
 // Listens for inbound connections
 func (t *TCPTransport) listen() {
+	var delay time.Duration
 	for {
 		conn, err := t.sock.AcceptTCP()
 		if err != nil {
 			if atomic.LoadInt32(&t.shutdown) == 0 {
 				fmt.Printf("[ERR] Error accepting TCP connection! %s", err)
+
+				// Back off on repeated errors, such as running out
+				// of file descriptors, rather than spinning
+				if delay == 0 {
+					delay = acceptBackoffMin
+				} else if delay *= 2; delay > acceptBackoffMax {
+					delay = acceptBackoffMax
+				}
+				select {
+				case <-time.After(delay):
+				case <-t.shutdownCh:
+					return
+				}
 				continue
 			} else {
 				return
 			}
 		}
+		delay = 0
 
 		// Setup the conn
 		t.setupConn(conn)
@@ -648,10 +1407,12 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 
 	dec := gob.NewDecoder(conn)
 	enc := gob.NewEncoder(conn)
-	header := tcpHeader{}
+	ctx := withRemoteAddr(context.Background(), conn.RemoteAddr().String())
 	var sendResp interface{}
 	for {
-		// Get the header
+		// Get the header. Use a fresh header each time, since
+		// gob does not transmit zero valued fields.
+		header := tcpHeader{}
 		if err := dec.Decode(&header); err != nil {
 			if atomic.LoadInt32(&t.shutdown) == 0 && err.Error() != "EOF" {
 				log.Printf("[ERR] Failed to decode TCP header! Got %s", err)
@@ -659,37 +1420,73 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			return
 		}
 
+		// Check the signature, and decode the body from the signed bytes
+		bodyDec := dec
+		if t.opts.Secret != "" {
+			if len(header.Sig) == 0 {
+				log.Printf("[ERR] Rejected unsigned TCP request from %s!", conn.RemoteAddr())
+				return
+			}
+			signed := tcpBodySigned{}
+			if err := dec.Decode(&signed); err != nil {
+				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+				return
+			}
+			if !hmac.Equal(header.Sig, signRequest(t.opts.Secret, &header, signed.Body)) {
+				log.Printf("[ERR] Rejected TCP request with a bad signature from %s!", conn.RemoteAddr())
+				return
+			}
+			if skew := time.Since(time.Unix(0, header.Time)); skew > tcpSignatureWindow || skew < -tcpSignatureWindow {
+				log.Printf("[ERR] Rejected TCP request sent %s away from our clock by %s!", skew, conn.RemoteAddr())
+				return
+			}
+			bodyDec = gob.NewDecoder(bytes.NewReader(signed.Body))
+		}
+
 		// Read in the body and process request
 		switch header.ReqType {
 		case tcpPing:
 			body := tcpBodyVnode{}
-			if err := dec.Decode(&body); err != nil {
+			if err := bodyDec.Decode(&body); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
 
-			// Generate a response
-			_, ok := t.get(body.Vn)
-			if ok {
-				sendResp = tcpBodyBoolError{B: ok, Err: nil}
-			} else {
-				sendResp = tcpBodyBoolError{B: ok, Err: fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Vn.Host, body.Vn.String())}
+			// Generate a response, an unknown vnode is
+			// confirmed dead since we were reachable
+			_, ok := t.get(header.Namespace, body.Vn)
+			sendResp = tcpBodyBoolError{B: ok, Err: nil}
+
+		case tcpBatchPingReq:
+			body := tcpBodyVnodeList{}
+			if err := bodyDec.Decode(&body); err != nil {
+				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+				return
+			}
+
+			// Check each vnode, as with a single ping
+			alive := make([]bool, len(body.Vnodes))
+			for idx, vn := range body.Vnodes {
+				if vn != nil {
+					_, alive[idx] = t.get(header.Namespace, vn)
+				}
 			}
+			sendResp = tcpBodyBoolListError{B: alive, Err: nil}
 
 		case tcpListReq:
 			body := tcpBodyString{}
-			if err := dec.Decode(&body); err != nil {
+			if err := bodyDec.Decode(&body); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
 
 			// Generate all the local clients
-			res := make([]*Vnode, 0, len(t.local))
+			t.lock.RLock()
+			local := t.local[header.Namespace]
+			res := make([]*Vnode, 0, len(local))
 
 			// Build list
-			t.lock.RLock()
-			for _, v := range t.local {
+			for _, v := range local {
 				res = append(res, v.vnode)
 			}
 			t.lock.RUnlock()
@@ -697,29 +1494,48 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			// Make response
 			sendResp = tcpBodyVnodeListError{Vnodes: trimSlice(res)}
 
+		case tcpListRangeReq:
+			body := tcpBodyRange{}
+			if err := bodyDec.Decode(&body); err != nil {
+				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+				return
+			}
+
+			// Build the list of local vnodes in the range
+			t.lock.RLock()
+			var res []*Vnode
+			for _, v := range t.local[header.Namespace] {
+				if betweenRightIncl(body.Start, body.End, v.vnode.Id) {
+					res = append(res, v.vnode)
+				}
+			}
+			t.lock.RUnlock()
+
+			// Make response
+			sendResp = tcpBodyVnodeListError{Vnodes: res}
+
 		case tcpGetPredReq:
 			body := tcpBodyVnode{}
-			if err := dec.Decode(&body); err != nil {
+			if err := bodyDec.Decode(&body); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Vn)
+			obj, err := t.getRouting(ctx, header.Namespace, body.Vn)
 			resp := tcpBodyVnodeError{}
 			sendResp = &resp
-			if ok {
+			if err == nil {
 				node, err := obj.GetPredecessor()
 				resp.Vnode = node
 				resp.Err = err
 			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Vn.Host, body.Vn.String())
+				resp.Err = err
 			}
 
 		case tcpNotifyReq:
 			body := tcpBodyTwoVnode{}
-			if err := dec.Decode(&body); err != nil {
+			if err := bodyDec.Decode(&body); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
@@ -728,47 +1544,51 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, err := t.getRouting(ctx, header.Namespace, body.Target)
 			resp := tcpBodyVnodeListError{}
 			sendResp = &resp
-			if ok {
-				nodes, err := obj.Notify(body.Vn)
+			if err == nil {
+				nodes, payload, load, err := rpcNotifyLoad(obj, body.Vn, body.Payload, body.Load)
 				resp.Vnodes = trimSlice(nodes)
+				resp.Payload = payload
+				resp.Load = load
 				resp.Err = err
 			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Target.Host, body.Target.String())
+				resp.Err = err
 			}
 
 		case tcpFindSucReq:
 			body := tcpBodyFindSuc{}
-			if err := dec.Decode(&body); err != nil {
+			if err := bodyDec.Decode(&body); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, err := t.getRouting(ctx, header.Namespace, body.Target)
 			resp := tcpBodyVnodeListError{}
 			sendResp = &resp
-			if ok {
-				nodes, err := obj.FindSuccessors(body.Num, body.Key)
+			if err == nil {
+				nodes, path, err := rpcFindSuccessorsTrace(obj, body.Num, body.Key, body.Visited, body.Trace)
+				if !body.Trace && len(path) > 0 {
+					path = path[len(path)-1:]
+				}
 				resp.Vnodes = trimSlice(nodes)
+				resp.Path = path
 				resp.Err = err
 			} else {
-				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
-					body.Target.Host, body.Target.String())
+				resp.Err = err
 			}
 
 		case tcpClearPredReq:
 			body := tcpBodyTwoVnode{}
-			if err := dec.Decode(&body); err != nil {
+			if err := bodyDec.Decode(&body); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := t.getContext(ctx, header.Namespace, body.Target)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -780,13 +1600,13 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 
 		case tcpSkipSucReq:
 			body := tcpBodyTwoVnode{}
-			if err := dec.Decode(&body); err != nil {
+			if err := bodyDec.Decode(&body); err != nil {
 				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
 				return
 			}
 
 			// Generate a response
-			obj, ok := t.get(body.Target)
+			obj, ok := t.getContext(ctx, header.Namespace, body.Target)
 			resp := tcpBodyError{}
 			sendResp = &resp
 			if ok {
@@ -796,19 +1616,139 @@ func (t *TCPTransport) handleConn(conn *net.TCPConn) {
 					body.Target.Host, body.Target.String())
 			}
 
+		case tcpHealthReq:
+			body := tcpBodyVnode{}
+			if err := bodyDec.Decode(&body); err != nil {
+				log.Printf("[ERR] Failed to decode TCP body! Got %s", err)
+				return
+			}
+
+			// Generate a response
+			obj, ok := t.getContext(ctx, header.Namespace, body.Vn)
+			resp := tcpBodyHealthError{}
+			sendResp = &resp
+			if ok {
+				health, err := obj.Health()
+				resp.Health = health
+				resp.Err = err
+			} else {
+				resp.Err = fmt.Errorf("Target VN not found! Target %s:%s",
+					body.Vn.Host, body.Vn.String())
+			}
+
 		default:
 			log.Printf("[ERR] Unknown request type! Got %d", header.ReqType)
 			return
 		}
 
-		// Send the response
-		if err := enc.Encode(sendResp); err != nil {
+		// Send the response, with any error in a form gob can encode
+		switch resp := sendResp.(type) {
+		case *tcpBodyError:
+			resp.Err = remoteError(resp.Err)
+		case *tcpBodyVnodeError:
+			resp.Err = remoteError(resp.Err)
+		case *tcpBodyVnodeListError:
+			resp.Err = remoteError(resp.Err)
+		case *tcpBodyHealthError:
+			resp.Err = remoteError(resp.Err)
+		}
+		if err := t.sendResponse(enc, &header, sendResp); err != nil {
 			log.Printf("[ERR] Failed to send TCP body! Got %s", err)
 			return
 		}
 	}
 }
 
+// Sends the response to a request. With a secret, the response is
+// encoded on its own and signed along with the signature of the request.
+func (t *TCPTransport) sendResponse(enc *gob.Encoder, header *tcpHeader, resp interface{}) error {
+	if t.opts.Secret == "" {
+		return enc.Encode(resp)
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(resp); err != nil {
+		return err
+	}
+	sig := signResponse(t.opts.Secret, header.Sig, buf.Bytes())
+	return enc.Encode(&tcpBodySigned{Body: buf.Bytes(), Sig: sig})
+}
+
+// Wraps a TCPTransport to serve a namespace
+type tcpNamespace struct {
+	t     *TCPTransport
+	ns    string
+	limit time.Duration // Caps the timeout of each call, zero uses the transport timeout
+}
+
+func (n *tcpNamespace) PoolStats() map[string]TCPPoolStats {
+	return n.t.PoolStats()
+}
+
+func (n *tcpNamespace) ListVnodes(host string) ([]*Vnode, error) {
+	return n.t.listVnodes(n.ns, n.limit, host, nil)
+}
+
+func (n *tcpNamespace) ListVnodesInRange(host string, start, end []byte) ([]*Vnode, error) {
+	return n.t.listVnodes(n.ns, n.limit, host, &tcpBodyRange{S: host, Start: start, End: end})
+}
+
+func (n *tcpNamespace) Ping(vn *Vnode) (bool, error) {
+	return n.t.ping(n.ns, n.limit, vn)
+}
+
+func (n *tcpNamespace) BatchPing(vns []*Vnode) ([]bool, error) {
+	return n.t.batchPing(n.ns, n.limit, vns)
+}
+
+func (n *tcpNamespace) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	return n.t.getPredecessor(n.ns, n.limit, vn)
+}
+
+func (n *tcpNamespace) Notify(target, self *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	succs, resp, _, err := n.t.notify(n.ns, n.limit, target, self, payload, nil)
+	return succs, resp, err
+}
+
+func (n *tcpNamespace) NotifyLoad(target, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	return n.t.notify(n.ns, n.limit, target, self, payload, load)
+}
+
+func (n *tcpNamespace) FindSuccessors(vn *Vnode, num int, k []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	return n.t.findSuccessors(n.ns, n.limit, vn, num, k, visited, false)
+}
+
+func (n *tcpNamespace) FindSuccessorsTrace(vn *Vnode, num int, k []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	return n.t.findSuccessors(n.ns, n.limit, vn, num, k, visited, trace)
+}
+
+func (n *tcpNamespace) ClearPredecessor(target, self *Vnode) error {
+	return n.t.clearPredecessor(n.ns, n.limit, target, self)
+}
+
+func (n *tcpNamespace) SkipSuccessor(target, self *Vnode) error {
+	return n.t.skipSuccessor(n.ns, n.limit, target, self)
+}
+
+func (n *tcpNamespace) Health(vn *Vnode) (*VnodeHealth, error) {
+	return n.t.health(n.ns, n.limit, vn)
+}
+
+func (n *tcpNamespace) Register(v *Vnode, o VnodeRPC) {
+	n.t.register(n.ns, v, o)
+}
+
+func (n *tcpNamespace) Deregister(v *Vnode) {
+	n.t.deregister(n.ns, v)
+}
+
+func (n *tcpNamespace) registered(host string) bool {
+	return n.t.registeredIn(n.ns, host)
+}
+
+func (n *tcpNamespace) withCallTimeout(timeout time.Duration) Transport {
+	return &tcpNamespace{t: n.t, ns: n.ns, limit: timeout}
+}
+
 // Trims the slice to remove nil elements
 func trimSlice(vn []*Vnode) []*Vnode {
 	if vn == nil {
@@ -817,7 +1757,7 @@ func trimSlice(vn []*Vnode) []*Vnode {
 
 	// Find a non-nil index
 	idx := len(vn) - 1
-	for vn[idx] == nil {
+	for idx >= 0 && vn[idx] == nil {
 		idx--
 	}
 	return vn[:idx+1]
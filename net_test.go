@@ -1,7 +1,15 @@
 package chord
 
 import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -84,9 +92,1079 @@ func TestTCPLeave(t *testing.T) {
 
 	// Verify r2 ring is still in tact
 	for _, vn := range r2.vnodes {
-		if vn.successors[0].Host != r2.config.Hostname {
-			t.Fatalf("bad successor! Got:%s:%s", vn.successors[0].Host,
-				vn.successors[0])
+		vn.lock.Lock()
+		succ := vn.successors[0]
+		vn.lock.Unlock()
+		if succ.Host != r2.config.Hostname {
+			t.Fatalf("bad successor! Got:%s:%s", succ.Host, succ)
 		}
 	}
 }
+
+func TestTCPPingTimeout(t *testing.T) {
+	_, t1, err := prepRing(10029)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	t1.SetTimeout(time.Second)
+	t1.SetPingTimeout(20 * time.Millisecond)
+
+	// Listener which never responds
+	list, err := net.Listen("tcp", "localhost:10030")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer list.Close()
+
+	start := time.Now()
+	vn := &Vnode{Id: []byte{1}, Host: "localhost:10030"}
+	if _, err := t1.Ping(vn); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if time.Since(start) >= t1.callTimeout() {
+		t.Fatalf("ping should use the ping timeout")
+	}
+}
+
+func TestTCPSetTimeout(t *testing.T) {
+	trans, err := InitTCPTransport("localhost:0", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+
+	// Listener which never responds
+	list, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer list.Close()
+	vn := &Vnode{Id: []byte{1}, Host: list.Addr().String()}
+
+	// Later calls use the new timeout, and pings follow it
+	for _, timeout := range []time.Duration{20 * time.Millisecond, 100 * time.Millisecond} {
+		trans.SetTimeout(timeout)
+		start := time.Now()
+		if _, err := trans.GetPredecessor(vn); err == nil {
+			t.Fatalf("expected err!")
+		}
+		if _, err := trans.Ping(vn); err == nil {
+			t.Fatalf("expected err!")
+		}
+		if d := time.Since(start); d < 2*timeout || d > 2*timeout+50*time.Millisecond {
+			t.Fatalf("expected a timeout of %v, took %v", timeout, d)
+		}
+	}
+
+	// Invalid timeouts revert to the one given at Init
+	for _, timeout := range []time.Duration{0, -time.Second} {
+		trans.SetTimeout(timeout)
+		if d := trans.callTimeout(); d != 20*time.Millisecond {
+			t.Fatalf("expected the init timeout, got %v", d)
+		}
+	}
+}
+
+func TestTCPShutdownReaper(t *testing.T) {
+	numGo := runtime.NumGoroutine()
+	_, t1, err := prepRing(10031)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	t1.Shutdown()
+
+	// Listener and reaper should exit promptly, allow for
+	// background routines started by other tests
+	var after int
+	for i := 0; i < 10; i++ {
+		<-time.After(10 * time.Millisecond)
+		after = runtime.NumGoroutine()
+		if after <= numGo {
+			return
+		}
+	}
+	t.Fatalf("unexpected routines! A:%d B:%d", after, numGo)
+}
+
+func TestTCPPingMissing(t *testing.T) {
+	_, t1, err := prepRing(10032)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	_, t2, err := prepRing(10033)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	// Live host, missing vnode is confirmed dead
+	vn := &Vnode{Id: []byte{1}, Host: "localhost:10033"}
+	if res, err := t1.Ping(vn); res || err != nil {
+		t.Fatalf("expected dead vnode. %v %v", res, err)
+	}
+
+	// Registered vnode is alive
+	t2.Register(vn, &MockVnodeRPC{})
+	if res, err := t1.Ping(vn); !res || err != nil {
+		t.Fatalf("expected live vnode. %v %v", res, err)
+	}
+}
+
+func TestTCPClose(t *testing.T) {
+	c1, t1, err := prepRing(10050)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c2, t2, err := prepRing(10051)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r1, err := Create(c1, t1)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2, err := Join(c2, t2, c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join! Got %s", err)
+	}
+
+	// Leave then close, and close the other directly
+	if err := r2.Leave(); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2.Close()
+	r1.Close()
+
+	// Both transports should be shutdown
+	if atomic.LoadInt32(&t1.shutdown) != 1 || atomic.LoadInt32(&t2.shutdown) != 1 {
+		t.Fatalf("expected transports to be shutdown")
+	}
+
+	// Shutting down again is safe
+	t1.Shutdown()
+	t2.Shutdown()
+}
+
+func TestTCPBatchPing(t *testing.T) {
+	_, t1, err := prepRing(10040)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	_, t2, err := prepRing(10041)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	// Mix of live, missing and unreachable vnodes
+	live := &Vnode{Id: []byte{1}, Host: "localhost:10041"}
+	missing := &Vnode{Id: []byte{2}, Host: "localhost:10041"}
+	live2 := &Vnode{Id: []byte{3}, Host: "localhost:10041"}
+	unreach := &Vnode{Id: []byte{4}, Host: "localhost:10042"}
+	t2.Register(live, &MockVnodeRPC{})
+	t2.Register(live2, &MockVnodeRPC{})
+
+	res, err := t1.BatchPing([]*Vnode{live, missing, unreach, live2})
+	if err == nil {
+		t.Fatalf("expected err for unreachable host")
+	}
+	if len(res) != 4 || !res[0] || res[1] || res[2] || !res[3] {
+		t.Fatalf("bad results: %v", res)
+	}
+
+	// Without the unreachable host there is no error
+	res, err = t1.BatchPing([]*Vnode{missing, live})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if res[0] || !res[1] {
+		t.Fatalf("bad results: %v", res)
+	}
+}
+
+func TestTCPOptions(t *testing.T) {
+	opts := TCPOptions{NoDelay: false, KeepAlive: false}
+	t1, err := InitTCPTransportWithOptions("localhost:10043", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	if t1.opts != opts {
+		t.Fatalf("bad options: %v", t1.opts)
+	}
+	_, t2, err := prepRing(10044)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+	if t2.opts != DefaultTCPOptions() {
+		t.Fatalf("bad default options: %v", t2.opts)
+	}
+
+	// Connections work without keepalives
+	vn := &Vnode{Id: []byte{1}, Host: "localhost:10044"}
+	t2.Register(vn, &MockVnodeRPC{})
+	if res, err := t1.Ping(vn); !res || err != nil {
+		t.Fatalf("expected live vnode. %v %v", res, err)
+	}
+}
+
+func TestTCPNotifyPayload(t *testing.T) {
+	_, t1, err := prepRing(10047)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	_, t2, err := prepRing(10048)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	vn := &Vnode{Id: []byte{1}, Host: "localhost:10048"}
+	self := &Vnode{Id: []byte{2}, Host: "localhost:10047"}
+	succ := &Vnode{Id: []byte{3}, Host: "localhost:10049"}
+	mock := &MockVnodeRPC{succ_list: []*Vnode{succ}}
+	t2.Register(vn, mock)
+
+	// The mock echoes the payload back
+	succs, payload, err := t1.Notify(vn, self, []byte("load"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(succs) != 1 || succs[0].String() != succ.String() {
+		t.Fatalf("bad successors %v", succs)
+	}
+	if string(mock.payload) != "load" || string(payload) != "load" {
+		t.Fatalf("bad payload %q %q", mock.payload, payload)
+	}
+
+	// A nil payload stays nil
+	if _, payload, err = t1.Notify(vn, self, nil); err != nil || payload != nil {
+		t.Fatalf("unexpected payload %q %v", payload, err)
+	}
+
+	// A load is sent apart from the payload, and the mock doubles it
+	lvn := &Vnode{Id: []byte{4}, Host: "localhost:10048"}
+	lmock := &MockLoadVnodeRPC{}
+	t2.Register(lvn, lmock)
+	load := 1.5
+	_, payload, respLoad, err := t1.NotifyLoad(lvn, self, []byte("payload"), &load)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if string(lmock.payload) != "payload" || string(payload) != "payload" {
+		t.Fatalf("bad payload %q %q", lmock.payload, payload)
+	}
+	if lmock.load == nil || *lmock.load != 1.5 || respLoad == nil || *respLoad != 3 {
+		t.Fatalf("bad load %v %v", lmock.load, respLoad)
+	}
+
+	// Vnodes that do not exchange loads return none
+	if _, _, respLoad, err = t1.NotifyLoad(vn, self, nil, &load); err != nil || respLoad != nil {
+		t.Fatalf("unexpected load %v %v", respLoad, err)
+	}
+}
+
+// Records the load sent with Notify, and responds with twice the load
+type MockLoadVnodeRPC struct {
+	MockVnodeRPC
+	load *float64
+}
+
+func (mv *MockLoadVnodeRPC) NotifyLoad(vn *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	mv.load = load
+	succs, resp, err := mv.Notify(vn, payload)
+	if load == nil {
+		return succs, resp, nil, err
+	}
+	double := *load * 2
+	return succs, resp, &double, err
+}
+
+// Records the remote address of inbound RPCs
+type MockContextVnodeRPC struct {
+	MockVnodeRPC
+	addrs []string
+}
+
+func (mv *MockContextVnodeRPC) record(ctx context.Context) {
+	addr, _ := RemoteAddrFromContext(ctx)
+	mv.addrs = append(mv.addrs, addr)
+}
+func (mv *MockContextVnodeRPC) GetPredecessorContext(ctx context.Context) (*Vnode, error) {
+	mv.record(ctx)
+	return mv.GetPredecessor()
+}
+func (mv *MockContextVnodeRPC) NotifyContext(ctx context.Context, vn *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	mv.record(ctx)
+	return mv.Notify(vn, payload)
+}
+func (mv *MockContextVnodeRPC) FindSuccessorsContext(ctx context.Context, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	mv.record(ctx)
+	return mv.FindSuccessors(n, key, visited)
+}
+func (mv *MockContextVnodeRPC) ClearPredecessorContext(ctx context.Context, p *Vnode) error {
+	mv.record(ctx)
+	return mv.ClearPredecessor(p)
+}
+func (mv *MockContextVnodeRPC) SkipSuccessorContext(ctx context.Context, s *Vnode) error {
+	mv.record(ctx)
+	return mv.SkipSuccessor(s)
+}
+func (mv *MockContextVnodeRPC) HealthContext(ctx context.Context) (*VnodeHealth, error) {
+	mv.record(ctx)
+	return mv.Health()
+}
+
+func TestTCPRemoteAddr(t *testing.T) {
+	_, t1, err := prepRing(10045)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	_, t2, err := prepRing(10046)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	vn := &Vnode{Id: []byte{1}, Host: "localhost:10046"}
+	self := &Vnode{Id: []byte{2}, Host: "localhost:10045"}
+	mock := &MockContextVnodeRPC{}
+	mock.path = []*Vnode{self, vn}
+	t2.Register(vn, mock)
+
+	if _, err := t1.GetPredecessor(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	_, path, err := t1.FindSuccessors(vn, 1, []byte{3}, []*Vnode{self})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(mock.visited) != 1 || !mock.visited[0].Equal(self) {
+		t.Fatalf("bad visited! %v", mock.visited)
+	}
+	if len(path) != 2 || !path[0].Equal(self) || !path[1].Equal(vn) {
+		t.Fatalf("bad path! %v", path)
+	}
+	if err := t1.SkipSuccessor(vn, self); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if mock.skip == nil || mock.skip.String() != self.String() {
+		t.Fatalf("bad skip! %v", mock.skip)
+	}
+
+	if len(mock.addrs) != 3 {
+		t.Fatalf("expected 3 calls, got %v", mock.addrs)
+	}
+	for _, addr := range mock.addrs {
+		if !strings.HasPrefix(addr, "127.0.0.1:") && !strings.HasPrefix(addr, "[::1]:") {
+			t.Fatalf("bad remote addr! %s", addr)
+		}
+	}
+}
+
+func TestTCPFindSuccessorsTrace(t *testing.T) {
+	t1, err := InitTCPTransport("localhost:0", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	t2, err := InitTCPTransport("localhost:0", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	vn := &Vnode{Id: []byte{1}, Host: t2.LocalAddr().String()}
+	self := &Vnode{Id: []byte{2}, Host: t1.LocalAddr().String()}
+	answer := &Vnode{Id: []byte{3}, Host: "remote"}
+	mock := &MockVnodeRPC{path: []*Vnode{self, vn, answer}}
+	t2.Register(vn, mock)
+
+	// Only the vnode that answered is sent back by default
+	_, path, err := t1.FindSuccessors(vn, 1, []byte{3}, []*Vnode{self})
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(path) != 2 || !path[0].Equal(self) || !path[1].Equal(answer) {
+		t.Fatalf("bad path! %v", path)
+	}
+
+	// A traced lookup returns every hop
+	_, path, err = t1.FindSuccessorsTrace(vn, 1, []byte{3}, []*Vnode{self}, true)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(path) != 3 || !path[0].Equal(self) || !path[1].Equal(vn) || !path[2].Equal(answer) {
+		t.Fatalf("bad path! %v", path)
+	}
+}
+
+func TestTCPCreateTwice(t *testing.T) {
+	trans, err := InitTCPTransport("localhost:0", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	conf := DefaultConfig(trans.LocalAddr().String())
+	conf.StabilizeMin = 15 * time.Millisecond
+	conf.StabilizeMax = 45 * time.Millisecond
+	host := conf.Hostname
+	r, err := Create(conf, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+
+	// The host is refused without dialing ourselves
+	if _, err := Create(conf, trans); err == nil {
+		t.Fatalf("expected err")
+	}
+	if stats := trans.PoolStats()[host]; stats.Open != 0 {
+		t.Fatalf("expected no conns. %v", stats)
+	}
+
+	// Another namespace is a separate ring
+	r2, err := Create(conf, trans.Namespace("other"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r2.Shutdown()
+}
+
+func TestTCPNamespace(t *testing.T) {
+	// Prepare to create 2 nodes
+	c1, t1, err := prepRing(10034)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	c2, t2, err := prepRing(10035)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	defer t2.Shutdown()
+
+	// Leave room for the race detector
+	t1.SetTimeout(200 * time.Millisecond)
+	t2.SetTimeout(200 * time.Millisecond)
+
+	// Create two rings on the same transport, with colliding IDs
+	c1b := *c1
+	r1a, err := Create(c1, t1.Namespace("a"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	r1b, err := Create(&c1b, t1.Namespace("b"))
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// Join only the first ring
+	r2a, err := Join(c2, t2.Namespace("a"), c1.Hostname)
+	if err != nil {
+		t.Fatalf("failed to join local node! Got %s", err)
+	}
+
+	// Each namespace should only list its own vnodes
+	list, err := t2.Namespace("b").ListVnodes(c1.Hostname)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(list) != c1.NumVnodes {
+		t.Fatalf("bad vnode list! %v", list)
+	}
+	list, err = t2.ListVnodes(c1.Hostname)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(list) != 0 {
+		t.Fatalf("expected no vnodes in default namespace! %v", list)
+	}
+
+	// Wait for some stabilization
+	<-time.After(100 * time.Millisecond)
+
+	// The second ring should not know about the joined node
+	for _, vn := range r1b.vnodes {
+		vn.lock.Lock()
+		succ := vn.successors[0]
+		vn.lock.Unlock()
+		if succ.Host != c1.Hostname {
+			t.Fatalf("bad successor! Got:%s:%s", succ.Host, succ)
+		}
+	}
+
+	// Shutdown
+	r1a.Shutdown()
+	r1b.Shutdown()
+	r2a.Shutdown()
+}
+
+func TestTCPCircuitBreaker(t *testing.T) {
+	opts := DefaultTCPOptions()
+	opts.MaxDialFailures = 2
+	opts.BreakerCooldown = 50 * time.Millisecond
+	t1, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+
+	// Nothing is listening on this host
+	host := "localhost:10037"
+	for i := 0; i < 2; i++ {
+		_, err := t1.getConn(host, t1.callTimeout())
+		if err == nil || strings.HasPrefix(err.Error(), "Circuit open") {
+			t.Fatalf("expected dial err. %v", err)
+		}
+	}
+
+	// Should now fail fast
+	_, err = t1.getConn(host, t1.callTimeout())
+	if err == nil || !strings.HasPrefix(err.Error(), "Circuit open") {
+		t.Fatalf("expected circuit err. %v", err)
+	}
+
+	// Should retry after the cooldown
+	<-time.After(60 * time.Millisecond)
+	_, err = t1.getConn(host, t1.callTimeout())
+	if err == nil || strings.HasPrefix(err.Error(), "Circuit open") {
+		t.Fatalf("expected dial err. %v", err)
+	}
+}
+
+func TestTCPHealth(t *testing.T) {
+	_, t1, err := prepRing(10038)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	_, t2, err := prepRing(10039)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+
+	// Leave room for the race detector
+	t1.SetTimeout(200 * time.Millisecond)
+
+	vn := &Vnode{Id: []byte{1}, Host: "localhost:10039"}
+	suc := []*Vnode{&Vnode{Id: []byte{40}}, &Vnode{Id: []byte{41}}}
+	t2.Register(vn, &MockVnodeRPC{succ_list: suc})
+
+	health, err := t1.Health(vn)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if health.Successors != 2 {
+		t.Fatalf("bad health. %v", health)
+	}
+}
+
+func TestTrimSlice(t *testing.T) {
+	v1 := &Vnode{Id: []byte{1}}
+	res := trimSlice([]*Vnode{v1, nil, nil})
+	if len(res) != 1 || res[0] != v1 {
+		t.Fatalf("bad trim. %v", res)
+	}
+	res = trimSlice([]*Vnode{nil, nil})
+	if len(res) != 0 {
+		t.Fatalf("bad trim. %v", res)
+	}
+	if trimSlice(nil) != nil {
+		t.Fatalf("bad trim")
+	}
+}
+
+func TestTCPPoolStats(t *testing.T) {
+	_, t1, err := prepRing(10052)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	_, t2, err := prepRing(10053)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+	vn := &Vnode{Id: []byte{1}, Host: "localhost:10053"}
+	t2.Register(vn, &MockVnodeRPC{})
+
+	if stats := t1.PoolStats(); len(stats) != 0 {
+		t.Fatalf("expected no conns. %v", stats)
+	}
+	if _, err := t1.Ping(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	stats := t1.PoolStats()["localhost:10053"]
+	if stats.Open != 1 || stats.Idle != 1 || stats.LastUsed.IsZero() {
+		t.Fatalf("bad stats. %v", stats)
+	}
+
+	// Reaped conns are no longer open
+	t1.maxIdle = 0
+	t1.reapOnce()
+	if stats := t1.PoolStats(); len(stats) != 0 {
+		t.Fatalf("expected no conns. %v", stats)
+	}
+}
+
+func TestTCPReconnectJitter(t *testing.T) {
+	opts := DefaultTCPOptions()
+	opts.MaxDialFailures = 1
+	opts.BreakerCooldown = 10 * time.Millisecond
+	opts.ReconnectJitter = 50 * time.Millisecond
+	t1, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+
+	// Nothing is listening on this host yet
+	host := "localhost:10055"
+	start := time.Now()
+	if _, err := t1.getConn(host, t1.callTimeout()); err == nil {
+		t.Fatalf("expected dial err")
+	}
+	if !t1.reconnecting(host) {
+		t.Fatalf("expected reconnecting host")
+	}
+
+	// The cooldown is extended by the jitter
+	open := t1.breakers[host].open
+	if open.Before(start.Add(10*time.Millisecond)) || open.After(time.Now().Add(60*time.Millisecond)) {
+		t.Fatalf("cooldown out of the jitter window")
+	}
+
+	// A successful dial clears the failure
+	_, t2, err := prepRing(10055)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+	<-time.After(60 * time.Millisecond)
+	out, err := t1.getConn(host, t1.callTimeout())
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	t1.returnConn(out)
+	if t1.reconnecting(host) {
+		t.Fatalf("unexpected reconnecting host")
+	}
+}
+
+func TestTransportVnodeKeys(t *testing.T) {
+	tcp, err := InitTCPTransport("localhost:10056", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer tcp.Shutdown()
+	transports := map[string]Transport{
+		"local": InitLocalTransport(nil),
+		"inmem": initInmemTransport(),
+		"tcp":   tcp,
+	}
+	for name, trans := range transports {
+		vn := &Vnode{Id: []byte{1, 2, 3}, Host: "localhost:10056"}
+		trans.Register(vn, &MockVnodeRPC{})
+
+		// Every transport keys vnodes by their ID, so an equal vnode
+		// finds the registered one
+		other := &Vnode{Id: []byte{1, 2, 3}, Host: vn.Host}
+		if ok, err := trans.Ping(other); !ok || err != nil {
+			t.Fatalf("%s: expected live vnode. %v %v", name, ok, err)
+		}
+		trans.(deregisterer).Deregister(other)
+		if ok, _ := trans.Ping(other); ok {
+			t.Fatalf("%s: expected deregistered vnode", name)
+		}
+	}
+}
+
+func TestTCPBindIP(t *testing.T) {
+	opts := DefaultTCPOptions()
+	opts.BindIP = "127.0.0.1"
+	trans, err := InitTCPTransportWithOptions("chord.example.com:10057", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	if addr := trans.sock.Addr().String(); addr != "127.0.0.1:10057" {
+		t.Fatalf("bad listen addr! %s", addr)
+	}
+
+	// Addresses of other hosts are refused
+	opts.BindIP = "192.0.2.1"
+	if _, err := InitTCPTransportWithOptions("localhost:10058", 20*time.Millisecond, opts); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestTCPLocalAddr(t *testing.T) {
+	trans, err := InitTCPTransport("localhost:0", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	addr, ok := trans.LocalAddr().(*net.TCPAddr)
+	if !ok || addr.Port == 0 {
+		t.Fatalf("bad local addr! %v", trans.LocalAddr())
+	}
+
+	// The chosen port can be advertised
+	conf := DefaultConfig(fmt.Sprintf("localhost:%d", addr.Port))
+	conf.ManualStabilize = true
+	r, err := Create(conf, trans)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer r.Shutdown()
+	other, err := InitTCPTransport("localhost:0", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer other.Shutdown()
+	if vns, err := other.ListVnodes(conf.Hostname); err != nil || len(vns) != conf.NumVnodes {
+		t.Fatalf("bad vnodes! %v %v", vns, err)
+	}
+}
+
+func TestTransportListVnodesInRange(t *testing.T) {
+	tcp, err := InitTCPTransport("localhost:10059", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer tcp.Shutdown()
+	transports := map[string]Transport{
+		"local": InitLocalTransport(nil),
+		"inmem": initInmemTransport(),
+		"tcp":   tcp,
+	}
+	host := "localhost:10059"
+	for name, trans := range transports {
+		for _, id := range []byte{10, 20, 30} {
+			trans.Register(&Vnode{Id: []byte{id}, Host: host}, &MockVnodeRPC{})
+		}
+		vnodes, err := listVnodesInRange(trans, host, []byte{10}, []byte{30})
+		if err != nil {
+			t.Fatalf("%s: unexpected err. %s", name, err)
+		}
+		if len(vnodes) != 2 {
+			t.Fatalf("%s: expected 2 vnodes. %v", name, vnodes)
+		}
+		for _, vn := range vnodes {
+			if vn.Id[0] == 10 {
+				t.Fatalf("%s: range start should be excluded", name)
+			}
+		}
+
+		// The range may wrap around the ring
+		vnodes, err = listVnodesInRange(trans, host, []byte{30}, []byte{10})
+		if err != nil {
+			t.Fatalf("%s: unexpected err. %s", name, err)
+		}
+		if len(vnodes) != 1 || vnodes[0].Id[0] != 10 {
+			t.Fatalf("%s: expected only vnode 10. %v", name, vnodes)
+		}
+	}
+}
+
+func TestTCPSecret(t *testing.T) {
+	opts := DefaultTCPOptions()
+	opts.Secret = "foo"
+	trans, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	host := trans.LocalAddr().String()
+	vn := &Vnode{Id: []byte{1}, Host: host}
+	trans.Register(vn, &MockVnodeRPC{})
+
+	// Requests signed with the secret are served
+	signed, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer signed.Shutdown()
+	if ok, err := signed.Ping(vn); !ok || err != nil {
+		t.Fatalf("expected live vnode. %v %v", ok, err)
+	}
+	if vns, err := signed.ListVnodes(host); err != nil || len(vns) != 1 {
+		t.Fatalf("bad vnodes! %v %v", vns, err)
+	}
+
+	// Unsigned and mis-signed requests are rejected
+	unsigned, err := InitTCPTransport("localhost:0", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer unsigned.Shutdown()
+	if _, err := unsigned.Ping(vn); err == nil {
+		t.Fatalf("expected err")
+	}
+	opts.Secret = "bar"
+	wrong, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer wrong.Shutdown()
+	if err := wrong.SkipSuccessor(vn, vn); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestTCPSecretReplay(t *testing.T) {
+	opts := DefaultTCPOptions()
+	opts.Secret = "foo"
+	trans, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	vn := &Vnode{Id: []byte{1}, Host: trans.LocalAddr().String()}
+	trans.Register(vn, &MockVnodeRPC{})
+
+	// Send signed pings, one sent now and one outside the window
+	send := func(sent time.Time) error {
+		conn, err := net.Dial("tcp", vn.Host)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(time.Second))
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&tcpBodyVnode{Vn: vn}); err != nil {
+			return err
+		}
+		header := tcpHeader{ReqType: tcpPing, Time: sent.UnixNano()}
+		header.Sig = signRequest(opts.Secret, &header, buf.Bytes())
+		enc := gob.NewEncoder(conn)
+		if err := enc.Encode(&header); err != nil {
+			return err
+		}
+		if err := enc.Encode(&tcpBodySigned{Body: buf.Bytes()}); err != nil {
+			return err
+		}
+		resp := tcpBodySigned{}
+		return gob.NewDecoder(conn).Decode(&resp)
+	}
+	if err := send(time.Now()); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if err := send(time.Now().Add(-2 * tcpSignatureWindow)); err == nil {
+		t.Fatalf("expected stale request to be rejected")
+	}
+}
+
+func TestTCPSecretResponse(t *testing.T) {
+	opts := DefaultTCPOptions()
+	opts.Secret = "foo"
+	trans, err := InitTCPTransportWithOptions("localhost:0", time.Second, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+
+	// Answer a request with a response that is not signed properly
+	list, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer list.Close()
+	go func() {
+		conn, err := list.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		dec := gob.NewDecoder(conn)
+		header := tcpHeader{}
+		signed := tcpBodySigned{}
+		if dec.Decode(&header) != nil || dec.Decode(&signed) != nil {
+			return
+		}
+		var buf bytes.Buffer
+		gob.NewEncoder(&buf).Encode(&tcpBodyBoolError{B: true})
+		gob.NewEncoder(conn).Encode(&tcpBodySigned{Body: buf.Bytes(), Sig: []byte("forged")})
+		time.Sleep(100 * time.Millisecond)
+	}()
+
+	vn := &Vnode{Id: []byte{1}, Host: list.Addr().String()}
+	if ok, err := trans.Ping(vn); ok || err == nil || !strings.Contains(err.Error(), "bad signature") {
+		t.Fatalf("expected forged response to be rejected. %v %v", ok, err)
+	}
+}
+
+func TestTCPMaxConns(t *testing.T) {
+	server, err := InitTCPTransport("localhost:0", 20*time.Millisecond)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer server.Shutdown()
+	host := server.LocalAddr().String()
+	vn := &Vnode{Id: []byte{1}, Host: host}
+	server.Register(vn, &MockVnodeRPC{})
+
+	opts := DefaultTCPOptions()
+	opts.MaxConns = 1
+	trans, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+
+	// Callers wait for the connection in use, up to their timeout
+	out, err := trans.getConn(host, trans.callTimeout())
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, err := trans.Ping(vn); err == nil {
+		t.Fatalf("expected err")
+	}
+	go func() {
+		time.Sleep(5 * time.Millisecond)
+		trans.returnConn(out)
+	}()
+	if ok, err := trans.Ping(vn); !ok || err != nil {
+		t.Fatalf("expected live vnode. %v %v", ok, err)
+	}
+	if stats := trans.PoolStats()[host]; stats.Open != 1 {
+		t.Fatalf("expected a single conn. %v", stats)
+	}
+}
+
+func TestTCPAbandonedConn(t *testing.T) {
+	// Accept requests without ever responding
+	list, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	opts := DefaultTCPOptions()
+	opts.MaxConns = 1
+	trans, err := InitTCPTransportWithOptions("localhost:0", 20*time.Millisecond, opts)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	host := list.Addr().String()
+	if _, err := trans.Ping(&Vnode{Id: []byte{1}, Host: host}); err == nil {
+		t.Fatalf("expected err")
+	}
+
+	// The abandoned request frees its slot once the deadline passes
+	if err := trans.acquireSlot(host, 100*time.Millisecond); err != nil {
+		t.Fatalf("expected slot to be freed. %s", err)
+	}
+	trans.releaseSlot(host)
+}
+
+func TestTCPStaleConn(t *testing.T) {
+	t1, err := InitTCPTransport("localhost:0", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	t2, err := InitTCPTransport("localhost:0", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+	host := t2.LocalAddr().String()
+	vn := &Vnode{Id: []byte{1}, Host: host}
+	t2.Register(vn, &MockVnodeRPC{})
+	if _, err := t1.Ping(vn); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// A pooled conn closed by the peer is redialed
+	t2.lock.RLock()
+	for conn := range t2.inbound {
+		conn.Close()
+	}
+	t2.lock.RUnlock()
+	time.Sleep(20 * time.Millisecond)
+	if ok, err := t1.Ping(vn); !ok || err != nil {
+		t.Fatalf("expected live vnode. %v %v", ok, err)
+	}
+	if stats := t1.PoolStats()[host]; stats.Open != 1 || stats.Idle != 1 {
+		t.Fatalf("bad stats. %v", stats)
+	}
+
+	// A broken pooled conn is redialed once
+	out, err := t1.getConn(host, t1.callTimeout())
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !out.reused {
+		t.Fatalf("expected a pooled conn")
+	}
+	out.sock.Close()
+	out.header.ReqType = tcpPing
+	resp := tcpBodyBoolError{}
+	if err := t1.roundTrip(out, t1.callTimeout(), &tcpBodyVnode{Vn: vn}, &resp); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !resp.B {
+		t.Fatalf("expected alive")
+	}
+	if stats := t1.PoolStats()[host]; stats.Open != 1 || stats.Idle != 1 {
+		t.Fatalf("bad stats. %v", stats)
+	}
+}
+
+func TestTCPDrainingVnode(t *testing.T) {
+	t1, err := InitTCPTransport("localhost:0", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t1.Shutdown()
+	t2, err := InitTCPTransport("localhost:0", time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer t2.Shutdown()
+	vn := makeVnode()
+	vn.Id = []byte{1}
+	vn.Host = t2.LocalAddr().String()
+	vn.successors = []*Vnode{{Id: []byte{2}, Host: vn.Host}}
+	t2.Register(&vn.Vnode, vn)
+
+	// Remote errors are returned to the caller
+	if _, _, err := t1.FindSuccessors(&vn.Vnode, 0, []byte{2}, nil); err == nil ||
+		!strings.Contains(err.Error(), "Invalid number of successors") {
+		t.Fatalf("expected remote err. %v", err)
+	}
+	if _, err := t1.GetPredecessor(&vn.Vnode); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// A leaving vnode refuses routing requests, but is still alive
+	vn.draining.Store(true)
+	if _, err := t1.GetPredecessor(&vn.Vnode); !errors.Is(err, ErrVnodeDraining) {
+		t.Fatalf("expected draining err. %v", err)
+	}
+	if _, _, err := t1.FindSuccessors(&vn.Vnode, 1, []byte{2}, nil); !errors.Is(err, ErrVnodeDraining) {
+		t.Fatalf("expected draining err. %v", err)
+	}
+	if alive, err := t1.Ping(&vn.Vnode); !alive || err != nil {
+		t.Fatalf("expected alive. %v", err)
+	}
+}
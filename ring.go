@@ -2,16 +2,39 @@ package chord
 
 import (
 	"bytes"
+	"fmt"
 	"log"
 	"sort"
+	"time"
 )
 
+// Size of the delegate queue when DelegateQueueSize is zero
+const defaultDelegateQueueSize = 32
+
+// Returns the size of the delegate queue. Zero uses the default, and a
+// negative size queues a single event.
+func delegateQueueSize(conf *Config) int {
+	switch {
+	case conf.DelegateQueueSize == 0:
+		return defaultDelegateQueueSize
+	case conf.DelegateQueueSize < 0:
+		return 1
+	}
+	return conf.DelegateQueueSize
+}
+
 func (r *Ring) init(conf *Config, trans Transport) {
 	// Set our variables
 	r.config = conf
 	r.vnodes = make([]*localVnode, conf.NumVnodes)
 	r.transport = InitLocalTransport(trans)
-	r.delegateCh = make(chan func(), 32)
+	r.transport.(*LocalTransport).setRemoteTimeout(conf.RemoteTimeout)
+	r.base = trans
+	r.delegateCh = make(chan func(), delegateQueueSize(conf))
+	if conf.LookupCacheTTL > 0 {
+		r.cache = &lookupCache{}
+		r.cache.init(conf.LookupCacheTTL, conf.LookupCacheSize)
+	}
 
 	// Initializes the vnodes
 	for i := 0; i < conf.NumVnodes; i++ {
@@ -25,7 +48,20 @@ func (r *Ring) init(conf *Config, trans Transport) {
 	sort.Sort(r)
 }
 
-// Len is the number of vnodes
+// Returns a snapshot of the local vnodes, in sorted order. The
+// snapshot is safe to use without holding the vnodes lock, so that
+// callers may invoke the vnodes without blocking any changes.
+func (r *Ring) localVnodes() []*localVnode {
+	r.vnodesLock.RLock()
+	defer r.vnodesLock.RUnlock()
+	vnodes := make([]*localVnode, len(r.vnodes))
+	copy(vnodes, r.vnodes)
+	return vnodes
+}
+
+// Len is the number of vnodes. Len, Less and Swap implement sort.Interface,
+// and the caller must hold the vnodes lock for writing when sorting a
+// ring that is in use.
 func (r *Ring) Len() int {
 	return len(r.vnodes)
 }
@@ -41,58 +77,335 @@ func (r *Ring) Swap(i, j int) {
 	r.vnodes[i], r.vnodes[j] = r.vnodes[j], r.vnodes[i]
 }
 
+// Contains returns whether the given ID belongs to one of our local
+// vnodes. The vnodes are kept sorted, so this is a binary search.
+func (r *Ring) Contains(id []byte) bool {
+	r.vnodesLock.RLock()
+	defer r.vnodesLock.RUnlock()
+	idx := sort.Search(len(r.vnodes), func(i int) bool {
+		return bytes.Compare(r.vnodes[i].Id, id) >= 0
+	})
+	return idx < len(r.vnodes) && bytes.Equal(r.vnodes[idx].Id, id)
+}
+
+// VnodeLinks returns the current predecessor and first successor of
+// the local vnode with the given ID. Either may be nil if it is not yet
+// known. An error is returned if there is no such local vnode.
+func (r *Ring) VnodeLinks(id []byte) (*Vnode, *Vnode, error) {
+	vn := r.localVnode(id)
+	if vn == nil {
+		return nil, nil, fmt.Errorf("Vnode %x is not a local vnode!", id)
+	}
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	return vn.predecessor, vn.successors[0], nil
+}
+
+// Returns the local vnode with the given ID, or nil
+func (r *Ring) localVnode(id []byte) *localVnode {
+	r.vnodesLock.RLock()
+	defer r.vnodesLock.RUnlock()
+	idx := sort.Search(len(r.vnodes), func(i int) bool {
+		return bytes.Compare(r.vnodes[i].Id, id) >= 0
+	})
+	if idx < len(r.vnodes) && bytes.Equal(r.vnodes[idx].Id, id) {
+		return r.vnodes[idx]
+	}
+	return nil
+}
+
 // Returns the nearest local vnode to the key
 func (r *Ring) nearestVnode(key []byte) *localVnode {
-	for i := len(r.vnodes) - 1; i >= 0; i-- {
+	return r.nearestVnodes(key, 1)[0]
+}
+
+// Returns up to count local vnodes nearest to the key, walking back
+// around the ring from the key, so the nearest is first
+func (r *Ring) nearestVnodes(key []byte, count int) []*localVnode {
+	r.vnodesLock.RLock()
+	defer r.vnodesLock.RUnlock()
+	num := len(r.vnodes)
+
+	// Start from the last vnode if none precede the key
+	start := num - 1
+	for i := num - 1; i >= 0; i-- {
 		if bytes.Compare(r.vnodes[i].Id, key) == -1 {
-			return r.vnodes[i]
+			start = i
+			break
 		}
 	}
-	// Return the last vnode
-	return r.vnodes[len(r.vnodes)-1]
+	res := make([]*localVnode, min(max(count, 0), num))
+	for i := range res {
+		res[i] = r.vnodes[(start-i+num)%num]
+	}
+	return res
+}
+
+// NearestLocalVnodes returns up to count local vnodes nearest to the
+// key in ring order, starting with the vnode Lookup enters the ring
+// through. The rest precede it, so they can be used as other entry
+// points with LookupFrom, if a lookup through the first fails.
+func (r *Ring) NearestLocalVnodes(key []byte, count int) []*Vnode {
+	vnodes := r.nearestVnodes(key, count)
+	res := make([]*Vnode, len(vnodes))
+	for i, vn := range vnodes {
+		res[i] = &vn.Vnode
+	}
+	return res
 }
 
 // Schedules each vnode in the ring
 func (r *Ring) schedule() {
-	if r.config.Delegate != nil {
-		go r.delegateHandler()
+	r.delegateLock.Lock()
+	r.startDelegate()
+	r.delegateLock.Unlock()
+	if r.config.ManualStabilize {
+		return
 	}
-	for i := 0; i < len(r.vnodes); i++ {
-		r.vnodes[i].schedule()
+	for _, vn := range r.localVnodes() {
+		vn.schedule()
 	}
 }
 
 // Wait for all the vnodes to shutdown
 func (r *Ring) stopVnodes() {
-	r.shutdown = make(chan bool, r.config.NumVnodes)
-	for i := 0; i < r.config.NumVnodes; i++ {
-		<-r.shutdown
+	r.release()
+	num := len(r.localVnodes())
+	shutdown := make(chan bool, num)
+	r.stopLock.Lock()
+	r.shutdown = shutdown
+	r.stopLock.Unlock()
+	if r.config.ManualStabilize {
+		// No timers to wait for
+		return
+	}
+	for i := 0; i < num; i++ {
+		<-shutdown
 	}
 }
 
-// Stops the delegate handler
+// Returns the channel the vnodes signal once they stop, which is
+// nil until the ring is shutdown
+func (r *Ring) stopping() chan bool {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+	return r.shutdown
+}
+
+// Deregisters our vnodes from the transport, so that a stopped ring
+// is no longer served and its vnodes are confirmed dead to pings
+func (r *Ring) deregister() {
+	d, ok := r.transport.(deregisterer)
+	if !ok {
+		return
+	}
+	for _, vn := range r.localVnodes() {
+		d.Deregister(&vn.Vnode)
+	}
+}
+
+// Returns our vnodes to the process wide budget
+func (r *Ring) release() {
+	r.stopLock.Lock()
+	defer r.stopLock.Unlock()
+	releaseVnodes(r.reserved)
+	r.reserved = 0
+}
+
+// Maximum time to wait for the queued delegate events to be delivered
+// when stopping the delegate handler
+var delegateDrainTimeout = 5 * time.Second
+
+// Stops the delegate handler. The events already queued are delivered
+// first, followed by Shutdown. If the delegate does not get through them
+// within the drain timeout, we stop waiting, and the handler delivers
+// the rest in the background.
 func (r *Ring) stopDelegate() {
-	if r.config.Delegate != nil {
-		// Wait for all delegate messages to be processed
-		<-r.invokeDelegate(r.config.Delegate.Shutdown)
+	// Wait for all delegate messages to be processed
+	timeout := time.NewTimer(delegateDrainTimeout)
+	defer timeout.Stop()
+	if done := r.queueDelegate(func(d Delegate) { d.Shutdown() }, true); done != nil {
+		select {
+		case <-done:
+		case <-timeout.C:
+			log.Printf("[WARN] Timed out delivering the queued delegate events")
+		}
+	}
+	r.delegateLock.Lock()
+	if !r.delegateStopped {
 		close(r.delegateCh)
+		r.delegateStopped = true
+	}
+	r.delegateLock.Unlock()
+}
+
+// Starts the delegate handler if there is a delegate, unless it is
+// already running or has been stopped. The caller must hold the
+// delegate lock for writing.
+func (r *Ring) startDelegate() {
+	if r.config.Delegate == nil || r.delegateRunning || r.delegateStopped {
+		return
 	}
+	r.delegateRunning = true
+	go r.delegateHandler()
 }
 
 // Initializes the vnodes with their local successors
 func (r *Ring) setLocalSuccessors() {
-	numV := len(r.vnodes)
+	vnodes := r.localVnodes()
+	numV := len(vnodes)
 	numSuc := min(r.config.NumSuccessors, numV-1)
-	for idx, vnode := range r.vnodes {
+	for idx, vnode := range vnodes {
+		vnode.lock.Lock()
+		for i := range vnode.successors {
+			vnode.successors[i] = nil
+		}
 		for i := 0; i < numSuc; i++ {
-			vnode.successors[i] = &r.vnodes[(idx+i+1)%numV].Vnode
+			vnode.successors[i] = &vnodes[(idx+i+1)%numV].Vnode
+		}
+		vnode.lock.Unlock()
+	}
+}
+
+// Queries the remote vnodes for the successors of each local vnode,
+// and replaces the successor lists. The lists are only updated once
+// successors have been found for every vnode. A small ring may return
+// fewer successors than we keep, so the vnodes of the seed host and the
+// local vnodes are merged in, filling every slot in ring order.
+//
+// With a JoinQuorum, only that many vnodes must find their successors.
+// The rest start from the vnodes of the seed host and the local vnodes,
+// and are repaired by stabilization.
+func (r *Ring) joinSuccessors(hosts []*Vnode) error {
+	vnodes := r.localVnodes()
+	found := make([][]*Vnode, len(vnodes))
+	quorum := r.config.JoinQuorum
+	if quorum <= 0 || quorum > len(vnodes) {
+		quorum = len(vnodes)
+	}
+	failed := make(map[int]error)
+	for idx, vn := range vnodes {
+		succs, err := r.findJoinSuccessors(vn, hosts)
+		if err != nil {
+			failed[idx] = err
+			if len(vnodes)-len(failed) < quorum {
+				return err
+			}
+			continue
+		}
+		found[idx] = mergeSuccessors(vn, append(succs, hosts...), vnodes, r.config.NumSuccessors)
+	}
+
+	// Fall back on the known vnodes for the failures
+	for idx, err := range failed {
+		vn := vnodes[idx]
+		log.Printf("[WARN] Vnode %s joining with the seed vnodes: %s", vn.String(), err)
+		found[idx] = mergeSuccessors(vn, hosts, vnodes, r.config.NumSuccessors)
+	}
+
+	// Assign the successors
+	for idx, vn := range vnodes {
+		vn.lock.Lock()
+		for i := range vn.successors {
+			vn.successors[i] = nil
+		}
+		copy(vn.successors, found[idx])
+		vn.lock.Unlock()
+	}
+	return nil
+}
+
+// Generates a random stabilization time, using the configured source.
+// The source is shared by all the vnodes, so it is locked.
+func (r *Ring) randStabilize() time.Duration {
+	source := r.config.StabilizeRand
+	if source == nil {
+		return randStabilize(r.config, nil)
+	}
+	r.randLock.Lock()
+	defer r.randLock.Unlock()
+	return randStabilize(r.config, source)
+}
+
+// Queries the nearest remote vnode for the successors of a joining
+// vnode, excluding the vnode itself
+func (r *Ring) findJoinSuccessors(vn *localVnode, hosts []*Vnode) ([]*Vnode, error) {
+	// Get the nearest remote vnode
+	nearest := nearestVnodeToKey(hosts, vn.Id)
+
+	// Query for a list of successors to this Vnode
+	succs, _, err := r.transport.FindSuccessors(nearest, r.config.NumSuccessors, vn.Id, nil)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to find successor for vnodes! Got %s", err)
+	}
+
+	// Ensure we don't set ourselves as a successor, which
+	// is possible if the seed has not routed around us yet
+	var found []*Vnode
+	for _, s := range succs {
+		if s != nil && !s.Equal(&vn.Vnode) {
+			found = append(found, s)
 		}
 	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("Failed to find successor for vnodes! Got no vnodes!")
+	}
+	return found, nil
 }
 
-// Invokes a function on the delegate and returns completion channel
-func (r *Ring) invokeDelegate(f func()) chan struct{} {
-	if r.config.Delegate == nil {
+// Merges the local vnodes into the known successors of a vnode. The
+// result is ordered by distance after the vnode, and holds at most num
+// vnodes.
+func mergeSuccessors(vn *localVnode, found []*Vnode, local []*localVnode, num int) []*Vnode {
+	merged := make([]*Vnode, 0, len(found)+len(local))
+	add := func(s *Vnode) {
+		if s.Equal(&vn.Vnode) {
+			return
+		}
+		for _, o := range merged {
+			if o.Equal(s) {
+				return
+			}
+		}
+		merged = append(merged, s)
+	}
+	for _, s := range found {
+		add(s)
+	}
+	for _, l := range local {
+		add(&l.Vnode)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		return between(vn.Id, merged[j].Id, merged[i].Id)
+	})
+	if len(merged) > num {
+		merged = merged[:num]
+	}
+	return merged
+}
+
+// Invokes a function on the delegate and returns completion channel.
+// This never blocks, if the delegate queue is full the event is dropped
+// and a nil channel is returned. Events are suppressed once the ring is
+// leaving quietly.
+func (r *Ring) invokeDelegate(f func(Delegate)) chan struct{} {
+	if r.quiet.Load() {
+		return nil
+	}
+	return r.queueDelegate(f, false)
+}
+
+// Queues a function for the delegate, optionally blocking until there
+// is room in the queue, for up to the drain timeout. The function is
+// passed the delegate installed when it was queued. Once the delegate
+// handler is stopped, the function is discarded and a nil channel is
+// returned, since the vnodes may still be reached by requests after a
+// shutdown.
+func (r *Ring) queueDelegate(f func(Delegate), block bool) chan struct{} {
+	r.delegateLock.RLock()
+	defer r.delegateLock.RUnlock()
+	d := r.config.Delegate
+	if d == nil || r.delegateStopped {
 		return nil
 	}
 
@@ -101,11 +414,25 @@ func (r *Ring) invokeDelegate(f func()) chan struct{} {
 		defer func() {
 			ch <- struct{}{}
 		}()
-		f()
+		f(d)
 	}
 
-	r.delegateCh <- wrapper
-	return ch
+	if block {
+		select {
+		case r.delegateCh <- wrapper:
+			return ch
+		case <-time.After(delegateDrainTimeout):
+			r.dropped.Add(1)
+			return nil
+		}
+	}
+	select {
+	case r.delegateCh <- wrapper:
+		return ch
+	default:
+		r.dropped.Add(1)
+		return nil
+	}
 }
 
 // This handler runs in a go routine to invoke methods on the delegate
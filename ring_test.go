@@ -3,6 +3,7 @@ package chord
 import (
 	"bytes"
 	"crypto/sha1"
+	"math/rand"
 	"sort"
 	"testing"
 	"time"
@@ -10,15 +11,62 @@ import (
 
 type MockDelegate struct {
 	shutdown bool
+	failed   []*Vnode
+	ranges   [][2][]byte
+	payloads [][]byte
+	draining []*Vnode
+	isolated int
+	joined   int
+	leaving  int
+	reclaims []reclaimEvent
+}
+
+// Ensure the mock receives every optional event
+var (
+	_ RangeDelegate     = &MockDelegate{}
+	_ DrainDelegate     = &MockDelegate{}
+	_ FailureDelegate   = &MockDelegate{}
+	_ IsolationDelegate = &MockDelegate{}
+	_ ReclaimDelegate   = &MockDelegate{}
+	_ PayloadDelegate   = &MockDelegate{}
+)
+
+type reclaimEvent struct {
+	local, from *Vnode
+	start, end  []byte
 }
 
 func (m *MockDelegate) NewPredecessor(local, remoteNew, remotePrev *Vnode) {
 }
+func (m *MockDelegate) NewPredecessorRange(local, remoteNew, remotePrev *Vnode, start, end []byte) {
+	m.ranges = append(m.ranges, [2][]byte{start, end})
+}
 func (m *MockDelegate) Leaving(local, pred, succ *Vnode) {
+	m.leaving++
+}
+func (m *MockDelegate) Draining(local, pred, succ *Vnode) {
+	m.draining = append(m.draining, local)
 }
 func (m *MockDelegate) PredecessorLeaving(local, remote *Vnode) {
+	m.leaving++
 }
 func (m *MockDelegate) SuccessorLeaving(local, remote *Vnode) {
+	m.leaving++
+}
+func (m *MockDelegate) PeerFailed(local, dead *Vnode) {
+	m.failed = append(m.failed, dead)
+}
+func (m *MockDelegate) Isolated(local *Vnode) {
+	m.isolated++
+}
+func (m *MockDelegate) Joined(local *Vnode) {
+	m.joined++
+}
+func (m *MockDelegate) NotifyPayload(local, remote *Vnode, payload []byte) {
+	m.payloads = append(m.payloads, payload)
+}
+func (m *MockDelegate) ReclaimRange(local *Vnode, start, end []byte, from *Vnode) {
+	m.reclaims = append(m.reclaims, reclaimEvent{local, from, start, end})
 }
 func (m *MockDelegate) Shutdown() {
 	m.shutdown = true
@@ -26,12 +74,13 @@ func (m *MockDelegate) Shutdown() {
 
 func makeRing() *Ring {
 	conf := &Config{
-		NumVnodes:     5,
-		NumSuccessors: 8,
-		HashFunc:      sha1.New,
-		hashBits:      160,
-		StabilizeMin:  time.Second,
-		StabilizeMax:  5 * time.Second,
+		NumVnodes:         5,
+		NumSuccessors:     8,
+		HashFunc:          sha1.New,
+		hashBits:          160,
+		StabilizeMin:      time.Second,
+		StabilizeMax:      5 * time.Second,
+		DelegateQueueSize: 32,
 	}
 
 	ring := &Ring{}
@@ -112,6 +161,104 @@ func TestRingNearest(t *testing.T) {
 	}
 }
 
+func TestRingNearestLocalVnodes(t *testing.T) {
+	ring := makeRing()
+	ring.vnodes[0].Id = []byte{2}
+	ring.vnodes[1].Id = []byte{4}
+	ring.vnodes[2].Id = []byte{7}
+	ring.vnodes[3].Id = []byte{10}
+	ring.vnodes[4].Id = []byte{14}
+
+	// Walks back around the ring from the key
+	near := ring.NearestLocalVnodes([]byte{6}, 3)
+	if len(near) != 3 {
+		t.Fatalf("expected 3 vnodes. %d", len(near))
+	}
+	for i, idx := range []int{1, 0, 4} {
+		if near[i] != &ring.vnodes[idx].Vnode {
+			t.Fatalf("got wrong node back at %d!", i)
+		}
+	}
+
+	// Limited to the local vnodes
+	near = ring.NearestLocalVnodes([]byte{0}, 10)
+	if len(near) != len(ring.vnodes) {
+		t.Fatalf("expected every vnode. %d", len(near))
+	}
+	if near[0] != &ring.vnodes[4].Vnode {
+		t.Fatalf("got wrong node back!")
+	}
+	if len(ring.NearestLocalVnodes([]byte{6}, 0)) != 0 {
+		t.Fatalf("expected no vnodes")
+	}
+}
+
+func TestRingContains(t *testing.T) {
+	ring := makeRing()
+	ring.vnodes[0].Id = []byte{2}
+	ring.vnodes[1].Id = []byte{4}
+	ring.vnodes[2].Id = []byte{7}
+	ring.vnodes[3].Id = []byte{10}
+	ring.vnodes[4].Id = []byte{14}
+
+	for _, vn := range ring.vnodes {
+		if !ring.Contains(vn.Id) {
+			t.Fatalf("expected to contain %v", vn.Id)
+		}
+	}
+	for _, id := range [][]byte{{0}, {3}, {15}, {4, 0}, nil} {
+		if ring.Contains(id) {
+			t.Fatalf("unexpected contains %v", id)
+		}
+	}
+}
+
+func TestRingVnodeLinks(t *testing.T) {
+	ring := makeRing()
+	sort.Sort(ring)
+	ring.setLocalSuccessors()
+	vn := ring.vnodes[1]
+	vn.predecessor = &ring.vnodes[0].Vnode
+
+	pred, succ, err := ring.VnodeLinks(vn.Id)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if pred != &ring.vnodes[0].Vnode || succ != &ring.vnodes[2].Vnode {
+		t.Fatalf("bad links! %v %v", pred, succ)
+	}
+	if _, _, err := ring.VnodeLinks([]byte{0}); err == nil {
+		t.Fatalf("expected err")
+	}
+}
+
+func TestRingVnodesLock(t *testing.T) {
+	ring := makeRing()
+	sort.Sort(ring)
+
+	// Reorder the vnodes while they are being read
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			ring.vnodesLock.Lock()
+			ring.Swap(0, 1)
+			sort.Sort(ring)
+			ring.vnodesLock.Unlock()
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		vnodes := ring.localVnodes()
+		if len(vnodes) != 5 {
+			t.Fatalf("bad snapshot")
+		}
+		if !ring.Contains(vnodes[0].Id) || ring.nearestVnode(vnodes[0].Id) == nil {
+			t.Fatalf("expected local vnode")
+		}
+	}
+	<-done
+}
+
 func TestRingSchedule(t *testing.T) {
 	ring := makeRing()
 	ring.setLocalSuccessors()
@@ -162,7 +309,7 @@ func TestRingDelegate(t *testing.T) {
 	ring.schedule()
 
 	var b bool
-	f := func() {
+	f := func(Delegate) {
 		println("run!")
 		b = true
 	}
@@ -184,3 +331,142 @@ func TestRingDelegate(t *testing.T) {
 		t.Fatalf("delegate did not get shutdown")
 	}
 }
+
+func TestRingSetDelegate(t *testing.T) {
+	ring := makeRing()
+	ring.setLocalSuccessors()
+	ring.schedule()
+
+	// Nothing is queued without a delegate
+	if ch := ring.invokeDelegate(func(Delegate) {}); ch != nil {
+		t.Fatalf("unexpected chan")
+	}
+
+	// Events are delivered once a delegate is installed
+	d := &MockDelegate{}
+	ring.SetDelegate(d)
+	ring.SetDelegate(d)
+	var got Delegate
+	ch := ring.invokeDelegate(func(d Delegate) { got = d })
+	if ch == nil {
+		t.Fatalf("expected chan")
+	}
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatalf("timeout")
+	}
+	if got != d {
+		t.Fatalf("bad delegate. %v", got)
+	}
+
+	// A delegate can not be installed after shutdown
+	ring.stopDelegate()
+	if !d.shutdown {
+		t.Fatalf("delegate did not get shutdown")
+	}
+	ring.SetDelegate(&MockDelegate{})
+	if ring.config.Delegate != d {
+		t.Fatalf("unexpected delegate change")
+	}
+}
+
+func TestRingDelegateQueueSize(t *testing.T) {
+	for size, expect := range map[int]int{0: 32, -1: 1, 1: 1, 100: 100} {
+		ring := makeRing()
+		ring.config.DelegateQueueSize = size
+		ring.init(ring.config, nil)
+		if n := cap(ring.delegateCh); n != expect {
+			t.Fatalf("bad queue size for %d. %d", size, n)
+		}
+	}
+}
+
+func TestRingDelegateDropped(t *testing.T) {
+	d := &MockDelegate{}
+	ring := makeRing()
+	ring.config.Delegate = d
+	ring.config.DelegateQueueSize = 2
+	ring.init(ring.config, nil)
+
+	// Without a handler running the queue fills up
+	for i := 0; i < 2; i++ {
+		if ch := ring.invokeDelegate(func(Delegate) {}); ch == nil {
+			t.Fatalf("expected chan")
+		}
+	}
+	if ch := ring.invokeDelegate(func(Delegate) {}); ch != nil {
+		t.Fatalf("expected dropped event")
+	}
+	if n := ring.DelegateDropped(); n != 1 {
+		t.Fatalf("expected 1 dropped, got %d", n)
+	}
+
+	// Shutdown is never dropped
+	go ring.delegateHandler()
+	ring.stopDelegate()
+	if !d.shutdown {
+		t.Fatalf("delegate did not get shutdown")
+	}
+}
+
+func TestRingDelegateDrain(t *testing.T) {
+	d := &MockDelegate{}
+	ring := makeRing()
+	ring.config.Delegate = d
+	ring.init(ring.config, nil)
+
+	// Queue events before the handler is running
+	var delivered int
+	for i := 0; i < 20; i++ {
+		if ch := ring.invokeDelegate(func(Delegate) {
+			time.Sleep(time.Millisecond)
+			delivered++
+		}); ch == nil {
+			t.Fatalf("expected chan")
+		}
+	}
+	go ring.delegateHandler()
+	ring.stopDelegate()
+	if delivered != 20 || !d.shutdown {
+		t.Fatalf("expected all events delivered! %d %v", delivered, d.shutdown)
+	}
+
+	// A stuck delegate does not block the shutdown forever
+	old := delegateDrainTimeout
+	delegateDrainTimeout = 10 * time.Millisecond
+	defer func() { delegateDrainTimeout = old }()
+	ring = makeRing()
+	ring.config.Delegate = &MockDelegate{}
+	ring.init(ring.config, nil)
+	block := make(chan struct{})
+	defer close(block)
+	ring.invokeDelegate(func(Delegate) { <-block })
+	go ring.delegateHandler()
+	start := time.Now()
+	ring.stopDelegate()
+	if time.Since(start) > time.Second {
+		t.Fatalf("stop took too long")
+	}
+}
+
+func TestRingRandStabilize(t *testing.T) {
+	ring := makeRing()
+	ring.config.StabilizeRand = rand.New(rand.NewSource(42))
+	var times []time.Duration
+	for i := 0; i < 10; i++ {
+		after := ring.randStabilize()
+		if after < ring.config.StabilizeMin || after > ring.config.StabilizeMax {
+			t.Fatalf("bad stabilize time! %v", after)
+		}
+		times = append(times, after)
+	}
+
+	// The same seed gives the same times
+	ring.config.StabilizeRand = rand.New(rand.NewSource(42))
+	for i := 0; i < 10; i++ {
+		if after := ring.randStabilize(); after != times[i] {
+			t.Fatalf("expected %v. Got %v", times[i], after)
+		}
+	}
+}
@@ -1,8 +1,10 @@
 package chord
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
 // Wraps vnode and object
@@ -11,14 +13,64 @@ type localRPC struct {
 	obj   VnodeRPC
 }
 
+// Adapts a ContextVnodeRPC to a VnodeRPC, invoking the context
+// variants of each method with a fixed context
+type contextRPC struct {
+	ctx context.Context
+	obj ContextVnodeRPC
+}
+
+// Returns a VnodeRPC which passes the context onto obj, if it
+// implements ContextVnodeRPC. Otherwise obj is returned as is.
+func withContextRPC(ctx context.Context, obj VnodeRPC) VnodeRPC {
+	if c, ok := obj.(ContextVnodeRPC); ok {
+		return &contextRPC{ctx, c}
+	}
+	return obj
+}
+
+func (c *contextRPC) GetPredecessor() (*Vnode, error) {
+	return c.obj.GetPredecessorContext(c.ctx)
+}
+
+func (c *contextRPC) Notify(vn *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	return c.obj.NotifyContext(c.ctx, vn, payload)
+}
+
+func (c *contextRPC) FindSuccessors(n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	return c.obj.FindSuccessorsContext(c.ctx, n, key, visited)
+}
+
+func (c *contextRPC) ClearPredecessor(vn *Vnode) error {
+	return c.obj.ClearPredecessorContext(c.ctx, vn)
+}
+
+func (c *contextRPC) SkipSuccessor(vn *Vnode) error {
+	return c.obj.SkipSuccessorContext(c.ctx, vn)
+}
+
+func (c *contextRPC) Health() (*VnodeHealth, error) {
+	return c.obj.HealthContext(c.ctx)
+}
+
 // LocalTransport is used to provides fast routing to Vnodes running
 // locally using direct method calls. For any non-local vnodes, the
-// request is passed on to another transport.
+// request is passed on to another transport. With a timeout set, calls
+// passed on are bounded by it, so that a remote that hangs cannot hang
+// the caller.
 type LocalTransport struct {
-	host   string
-	remote Transport
-	lock   sync.RWMutex
-	local  map[string]*localRPC
+	host     string
+	remote   Transport
+	lock     sync.RWMutex
+	local    map[string]*localRPC
+	timeout  time.Duration
+	wrapLock sync.Mutex // Serializes wrapRemote
+}
+
+// Implemented by transports that can bound each call to a timeout,
+// returning a view of the transport that does so
+type callLimiter interface {
+	withCallTimeout(timeout time.Duration) Transport
 }
 
 // Creates a local transport to wrap a remote transport
@@ -62,9 +114,34 @@ func (lt *LocalTransport) ListVnodes(host string) ([]*Vnode, error) {
 	}
 
 	// Pass onto remote
-	return lt.remote.ListVnodes(host)
+	var res []*Vnode
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { res, err = trans.ListVnodes(host) }); terr != nil {
+		return nil, terr
+	}
+	return res, err
+}
+
+// ListVnodesInRange lists the local vnodes in the range (start, end]
+// directly, and passes other hosts onto the remote
+func (lt *LocalTransport) ListVnodesInRange(host string, start, end []byte) ([]*Vnode, error) {
+	if host == lt.host {
+		vnodes, _ := lt.ListVnodes(host)
+		return filterRange(vnodes, start, end), nil
+	}
+
+	// Pass onto remote
+	var res []*Vnode
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { res, err = listVnodesInRange(trans, host, start, end) }); terr != nil {
+		return nil, terr
+	}
+	return res, err
 }
 
+// Ping returns true for registered local vnodes, and false without
+// an error for unknown vnodes on the local host, since those are
+// confirmed dead. Vnodes on other hosts are passed onto the remote.
 func (lt *LocalTransport) Ping(vn *Vnode) (bool, error) {
 	// Look for it locally
 	_, ok := lt.get(vn)
@@ -74,8 +151,61 @@ func (lt *LocalTransport) Ping(vn *Vnode) (bool, error) {
 		return true, nil
 	}
 
+	// Check if this is a missing local vnode
+	lt.lock.RLock()
+	isLocal := vn.Host == lt.host
+	lt.lock.RUnlock()
+	if isLocal {
+		return false, nil
+	}
+
 	// Pass onto remote
-	return lt.remote.Ping(vn)
+	var res bool
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { res, err = trans.Ping(vn) }); terr != nil {
+		return false, terr
+	}
+	return res, err
+}
+
+// BatchPing checks local vnodes directly, and passes any vnodes on
+// other hosts onto the remote as a single batch.
+func (lt *LocalTransport) BatchPing(vns []*Vnode) ([]bool, error) {
+	res := make([]bool, len(vns))
+	var remote []*Vnode
+	var remoteIdx []int
+	for idx, vn := range vns {
+		// Look for it locally
+		if _, ok := lt.get(vn); ok {
+			res[idx] = true
+			continue
+		}
+
+		// Check if this is a missing local vnode
+		lt.lock.RLock()
+		isLocal := vn.Host == lt.host
+		lt.lock.RUnlock()
+		if !isLocal {
+			remote = append(remote, vn)
+			remoteIdx = append(remoteIdx, idx)
+		}
+	}
+	if len(remote) == 0 {
+		return res, nil
+	}
+
+	// Pass onto remote
+	var alive []bool
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { alive, err = trans.BatchPing(remote) }); terr != nil {
+		return res, terr
+	}
+	for i, idx := range remoteIdx {
+		if i < len(alive) {
+			res[idx] = alive[i]
+		}
+	}
+	return res, err
 }
 
 func (lt *LocalTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
@@ -88,33 +218,91 @@ func (lt *LocalTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
 	}
 
 	// Pass onto remote
-	return lt.remote.GetPredecessor(vn)
+	var res *Vnode
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { res, err = trans.GetPredecessor(vn) }); terr != nil {
+		return nil, terr
+	}
+	return res, err
+}
+
+func (lt *LocalTransport) Notify(vn, self *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		return obj.Notify(self, payload)
+	}
+
+	// Pass onto remote
+	var succs []*Vnode
+	var resp []byte
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { succs, resp, err = trans.Notify(vn, self, payload) }); terr != nil {
+		return nil, nil, terr
+	}
+	return succs, resp, err
 }
 
-func (lt *LocalTransport) Notify(vn, self *Vnode) ([]*Vnode, error) {
+func (lt *LocalTransport) NotifyLoad(vn, self *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
 	// Look for it locally
 	obj, ok := lt.get(vn)
 
 	// If it exists locally, handle it
 	if ok {
-		return obj.Notify(self)
+		return rpcNotifyLoad(obj, self, payload, load)
 	}
 
 	// Pass onto remote
-	return lt.remote.Notify(vn, self)
+	var succs []*Vnode
+	var resp []byte
+	var respLoad *float64
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) {
+		succs, resp, respLoad, err = notifyLoad(trans, vn, self, payload, load)
+	}); terr != nil {
+		return nil, nil, nil, terr
+	}
+	return succs, resp, respLoad, err
 }
 
-func (lt *LocalTransport) FindSuccessors(vn *Vnode, n int, key []byte) ([]*Vnode, error) {
+func (lt *LocalTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
 	// Look for it locally
 	obj, ok := lt.get(vn)
 
 	// If it exists locally, handle it
 	if ok {
-		return obj.FindSuccessors(n, key)
+		return obj.FindSuccessors(n, key, visited)
 	}
 
 	// Pass onto remote
-	return lt.remote.FindSuccessors(vn, n, key)
+	var succs, path []*Vnode
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { succs, path, err = trans.FindSuccessors(vn, n, key, visited) }); terr != nil {
+		return nil, nil, terr
+	}
+	return succs, path, err
+}
+
+func (lt *LocalTransport) FindSuccessorsTrace(vn *Vnode, n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		return rpcFindSuccessorsTrace(obj, n, key, visited, trace)
+	}
+
+	// Pass onto remote
+	var succs, path []*Vnode
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) {
+		succs, path, err = findSuccessorsTrace(trans, vn, n, key, visited, trace)
+	}); terr != nil {
+		return nil, nil, terr
+	}
+	return succs, path, err
 }
 
 func (lt *LocalTransport) ClearPredecessor(target, self *Vnode) error {
@@ -127,7 +315,11 @@ func (lt *LocalTransport) ClearPredecessor(target, self *Vnode) error {
 	}
 
 	// Pass onto remote
-	return lt.remote.ClearPredecessor(target, self)
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { err = trans.ClearPredecessor(target, self) }); terr != nil {
+		return terr
+	}
+	return err
 }
 
 func (lt *LocalTransport) SkipSuccessor(target, self *Vnode) error {
@@ -140,7 +332,29 @@ func (lt *LocalTransport) SkipSuccessor(target, self *Vnode) error {
 	}
 
 	// Pass onto remote
-	return lt.remote.SkipSuccessor(target, self)
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { err = trans.SkipSuccessor(target, self) }); terr != nil {
+		return terr
+	}
+	return err
+}
+
+func (lt *LocalTransport) Health(vn *Vnode) (*VnodeHealth, error) {
+	// Look for it locally
+	obj, ok := lt.get(vn)
+
+	// If it exists locally, handle it
+	if ok {
+		return obj.Health()
+	}
+
+	// Pass onto remote
+	var res *VnodeHealth
+	var err error
+	if terr := lt.withTimeout(func(trans Transport) { res, err = trans.Health(vn) }); terr != nil {
+		return nil, terr
+	}
+	return res, err
 }
 
 func (lt *LocalTransport) Register(v *Vnode, o VnodeRPC) {
@@ -152,7 +366,63 @@ func (lt *LocalTransport) Register(v *Vnode, o VnodeRPC) {
 	lt.lock.Unlock()
 
 	// Register with remote transport
-	lt.remote.Register(v, o)
+	lt.getRemote().Register(v, o)
+}
+
+// Sets the timeout for calls passed onto the remote transport. Zero
+// waits for the remote to return, which is the default.
+func (lt *LocalTransport) setRemoteTimeout(timeout time.Duration) {
+	lt.timeout = timeout
+}
+
+// Runs a call to the remote transport, returning an error if it does
+// not complete within the timeout. A remote that can bound its own calls
+// is given the timeout, so that a call to a hung peer is cancelled.
+// Otherwise the call is abandoned once the timeout expires, and its
+// results must only be used if no error is returned, since it still
+// runs to completion in the background.
+func (lt *LocalTransport) withTimeout(call func(Transport)) error {
+	remote := lt.getRemote()
+	if lt.timeout <= 0 {
+		call(remote)
+		return nil
+	}
+	if cl, ok := remote.(callLimiter); ok {
+		call(cl.withCallTimeout(lt.timeout))
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		call(remote)
+		close(done)
+	}()
+	timer := time.NewTimer(lt.timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return fmt.Errorf("Remote call timed out after %v!", lt.timeout)
+	}
+}
+
+// Returns the remote transport
+func (lt *LocalTransport) getRemote() Transport {
+	lt.lock.RLock()
+	defer lt.lock.RUnlock()
+	return lt.remote
+}
+
+// Replaces the remote transport with a wrapped version of itself. The
+// wrap function is invoked without holding the lock, so that it may use
+// the transport, and requests keep using the old remote until it returns.
+func (lt *LocalTransport) wrapRemote(wrap func(Transport) Transport) {
+	lt.wrapLock.Lock()
+	defer lt.wrapLock.Unlock()
+	wrapped := wrap(lt.getRemote())
+	lt.lock.Lock()
+	lt.remote = wrapped
+	lt.lock.Unlock()
 }
 
 func (lt *LocalTransport) Deregister(v *Vnode) {
@@ -160,6 +430,11 @@ func (lt *LocalTransport) Deregister(v *Vnode) {
 	lt.lock.Lock()
 	delete(lt.local, key)
 	lt.lock.Unlock()
+
+	// Deregister with remote transport, if supported
+	if d, ok := lt.getRemote().(deregisterer); ok {
+		d.Deregister(v)
+	}
 }
 
 // BlackholeTransport is used to provide an implemenation of the Transport that
@@ -171,20 +446,26 @@ func (*BlackholeTransport) ListVnodes(host string) ([]*Vnode, error) {
 	return nil, fmt.Errorf("Failed to connect! Blackhole: %s.", host)
 }
 
+// Ping always returns an error, since the host cannot be reached
 func (*BlackholeTransport) Ping(vn *Vnode) (bool, error) {
-	return false, nil
+	return false, fmt.Errorf("Failed to connect! Blackhole: %s.", vn.String())
+}
+
+// BatchPing reports every vnode as dead, since no host can be reached
+func (*BlackholeTransport) BatchPing(vns []*Vnode) ([]bool, error) {
+	return make([]bool, len(vns)), fmt.Errorf("Failed to connect! Blackhole: %d vnodes.", len(vns))
 }
 
 func (*BlackholeTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
 	return nil, fmt.Errorf("Failed to connect! Blackhole: %s.", vn.String())
 }
 
-func (*BlackholeTransport) Notify(vn, self *Vnode) ([]*Vnode, error) {
-	return nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
+func (*BlackholeTransport) Notify(vn, self *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	return nil, nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
 }
 
-func (*BlackholeTransport) FindSuccessors(vn *Vnode, n int, key []byte) ([]*Vnode, error) {
-	return nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
+func (*BlackholeTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	return nil, nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
 }
 
 func (*BlackholeTransport) ClearPredecessor(target, self *Vnode) error {
@@ -195,5 +476,9 @@ func (*BlackholeTransport) SkipSuccessor(target, self *Vnode) error {
 	return fmt.Errorf("Failed to connect! Blackhole: %s", target.String())
 }
 
+func (*BlackholeTransport) Health(vn *Vnode) (*VnodeHealth, error) {
+	return nil, fmt.Errorf("Failed to connect! Blackhole: %s", vn.String())
+}
+
 func (*BlackholeTransport) Register(v *Vnode, o VnodeRPC) {
 }
@@ -2,7 +2,27 @@ package chord
 
 import (
 	"bytes"
+	"net"
+	"strings"
 	"testing"
+	"time"
+)
+
+// Ensure the transports and vnodes pass on traced lookups and loads
+var (
+	_ TracingTransport = &LocalTransport{}
+	_ TracingTransport = &TCPTransport{}
+	_ TracingTransport = &tcpNamespace{}
+	_ TracingTransport = &FaultTransport{}
+	_ TracingTransport = &inmemTransport{}
+	_ TracingVnodeRPC  = &localVnode{}
+	_ LoadTransport    = &LocalTransport{}
+	_ LoadTransport    = &TCPTransport{}
+	_ LoadTransport    = &tcpNamespace{}
+	_ LoadTransport    = &FaultTransport{}
+	_ LoadTransport    = &inmemTransport{}
+	_ LoadVnodeRPC     = &localVnode{}
+	_ LoadVnodeRPC     = &MockLoadVnodeRPC{}
 )
 
 type MockVnodeRPC struct {
@@ -13,18 +33,23 @@ type MockVnodeRPC struct {
 	key       []byte
 	succ      []*Vnode
 	skip      *Vnode
+	payload   []byte
+	visited   []*Vnode
+	path      []*Vnode
 }
 
 func (mv *MockVnodeRPC) GetPredecessor() (*Vnode, error) {
 	return mv.pred, mv.err
 }
-func (mv *MockVnodeRPC) Notify(vn *Vnode) ([]*Vnode, error) {
+func (mv *MockVnodeRPC) Notify(vn *Vnode, payload []byte) ([]*Vnode, []byte, error) {
 	mv.not_pred = vn
-	return mv.succ_list, mv.err
+	mv.payload = payload
+	return mv.succ_list, payload, mv.err
 }
-func (mv *MockVnodeRPC) FindSuccessors(n int, key []byte) ([]*Vnode, error) {
+func (mv *MockVnodeRPC) FindSuccessors(n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
 	mv.key = key
-	return mv.succ, mv.err
+	mv.visited = visited
+	return mv.succ, mv.path, mv.err
 }
 
 func (mv *MockVnodeRPC) ClearPredecessor(p *Vnode) error {
@@ -37,6 +62,10 @@ func (mv *MockVnodeRPC) SkipSuccessor(s *Vnode) error {
 	return nil
 }
 
+func (mv *MockVnodeRPC) Health() (*VnodeHealth, error) {
+	return &VnodeHealth{Successors: len(mv.succ_list)}, mv.err
+}
+
 func makeLocal() *LocalTransport {
 	return InitLocalTransport(nil).(*LocalTransport)
 }
@@ -62,7 +91,7 @@ func TestLocalList(t *testing.T) {
 		t.Fatalf("unexpected err. %s", err)
 	}
 	if len(list) != 1 || list[0] != vn {
-		t.Fatalf("local list failed", list)
+		t.Fatalf("local list failed: %v", list)
 	}
 }
 
@@ -101,6 +130,38 @@ func TestLocalMissingPing(t *testing.T) {
 	}
 }
 
+func TestLocalRemotePing(t *testing.T) {
+	l := makeLocal()
+	vn := &Vnode{Id: []byte{2}, Host: "test"}
+	mockVN := &MockVnodeRPC{}
+	l.Register(vn, mockVN)
+
+	// Unreachable remote should surface the error
+	vn2 := &Vnode{Id: []byte{3}, Host: "remote"}
+	if res, err := l.Ping(vn2); res || err == nil {
+		t.Fatalf("expected ping err")
+	}
+}
+
+func TestLocalBatchPing(t *testing.T) {
+	l := makeLocal()
+	vn := &Vnode{Id: []byte{2}, Host: "test"}
+	mockVN := &MockVnodeRPC{}
+	l.Register(vn, mockVN)
+
+	// Missing local vnodes are dead, remote ones are unreachable
+	vn2 := &Vnode{Id: []byte{3}, Host: "test"}
+	vn3 := &Vnode{Id: []byte{4}, Host: "remote"}
+	res, err := l.BatchPing([]*Vnode{vn, vn2})
+	if err != nil || !res[0] || res[1] {
+		t.Fatalf("bad results: %v %v", res, err)
+	}
+	res, err = l.BatchPing([]*Vnode{vn3, vn})
+	if err == nil || res[0] || !res[1] {
+		t.Fatalf("bad results: %v %v", res, err)
+	}
+}
+
 func TestLocalGetPredecessor(t *testing.T) {
 	l := makeLocal()
 	pred := &Vnode{Id: []byte{10}}
@@ -136,10 +197,13 @@ func TestLocalNotify(t *testing.T) {
 	l.Register(vn, mockVN)
 
 	self := &Vnode{Id: []byte{60}}
-	res, err := l.Notify(vn, self)
+	res, payload, err := l.Notify(vn, self, []byte("load"))
 	if err != nil {
 		t.Fatalf("local notify failed")
 	}
+	if string(mockVN.payload) != "load" || string(payload) != "load" {
+		t.Fatalf("bad payload! %q %q", mockVN.payload, payload)
+	}
 	if res == nil || res[0] != suc1 || res[1] != suc2 || res[2] != suc3 {
 		t.Fatalf("got wrong successor list")
 	}
@@ -148,7 +212,7 @@ func TestLocalNotify(t *testing.T) {
 	}
 
 	unknown := &Vnode{Id: []byte{1}}
-	res, err = l.Notify(unknown, self)
+	res, _, err = l.Notify(unknown, self, nil)
 	if err == nil {
 		t.Fatalf("remote notify should fail")
 	}
@@ -163,7 +227,7 @@ func TestLocalFindSucc(t *testing.T) {
 	l.Register(vn, mockVN)
 
 	key := []byte("test")
-	res, err := l.FindSuccessors(vn, 1, key)
+	res, _, err := l.FindSuccessors(vn, 1, key, nil)
 	if err != nil {
 		t.Fatalf("local FindSuccessor failed")
 	}
@@ -175,7 +239,7 @@ func TestLocalFindSucc(t *testing.T) {
 	}
 
 	unknown := &Vnode{Id: []byte{1}}
-	res, err = l.FindSuccessors(unknown, 1, key)
+	res, _, err = l.FindSuccessors(unknown, 1, key, nil)
 	if err == nil {
 		t.Fatalf("remote find should fail")
 	}
@@ -240,6 +304,79 @@ func TestLocalDeregister(t *testing.T) {
 	}
 }
 
+// Hangs every GetPredecessor call until released
+type hangingTransport struct {
+	BlackholeTransport
+	release chan struct{}
+}
+
+func (ht *hangingTransport) GetPredecessor(vn *Vnode) (*Vnode, error) {
+	<-ht.release
+	return nil, nil
+}
+
+func TestLocalRemoteTimeout(t *testing.T) {
+	ht := &hangingTransport{release: make(chan struct{})}
+	defer close(ht.release)
+	l := InitLocalTransport(ht).(*LocalTransport)
+	l.setRemoteTimeout(10 * time.Millisecond)
+
+	// Remote calls are abandoned
+	start := time.Now()
+	if _, err := l.GetPredecessor(&Vnode{Id: []byte{1}, Host: "remote"}); err == nil {
+		t.Fatalf("expected err")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("call took too long")
+	}
+
+	// Calls that return in time are passed back
+	if _, _, err := l.FindSuccessors(&Vnode{Id: []byte{1}, Host: "remote"}, 1, []byte{2}, nil); err == nil ||
+		strings.Contains(err.Error(), "timed out") {
+		t.Fatalf("expected remote err. %v", err)
+	}
+}
+
+func TestLocalRemoteTimeoutTCP(t *testing.T) {
+	// Accept requests without ever responding
+	list, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer list.Close()
+	go func() {
+		for {
+			conn, err := list.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	trans, err := InitTCPTransport("localhost:0", 10*time.Second)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	defer trans.Shutdown()
+	l := InitLocalTransport(trans).(*LocalTransport)
+	l.setRemoteTimeout(20 * time.Millisecond)
+
+	// The TCP call is bounded by the remote timeout, not abandoned
+	host := list.Addr().String()
+	start := time.Now()
+	if _, err := l.GetPredecessor(&Vnode{Id: []byte{1}, Host: host}); err == nil {
+		t.Fatalf("expected err")
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("call took too long")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if stats := trans.PoolStats()[host]; stats.Open != 0 {
+		t.Fatalf("expected the conn to be closed. %v", stats)
+	}
+}
+
 func TestBHList(t *testing.T) {
 	bh := BlackholeTransport{}
 	res, err := bh.ListVnodes("test")
@@ -252,7 +389,7 @@ func TestBHPing(t *testing.T) {
 	bh := BlackholeTransport{}
 	vn := &Vnode{Id: []byte{12}}
 	res, err := bh.Ping(vn)
-	if res || err != nil {
+	if res || err == nil || !strings.HasPrefix(err.Error(), "Failed to connect!") {
 		t.Fatalf("expected fail")
 	}
 }
@@ -261,7 +398,7 @@ func TestBHGetPred(t *testing.T) {
 	bh := BlackholeTransport{}
 	vn := &Vnode{Id: []byte{12}}
 	_, err := bh.GetPredecessor(vn)
-	if err.Error()[:18] != "Failed to connect!" {
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to connect!") {
 		t.Fatalf("expected fail")
 	}
 }
@@ -270,8 +407,8 @@ func TestBHNotify(t *testing.T) {
 	bh := BlackholeTransport{}
 	vn := &Vnode{Id: []byte{12}}
 	vn2 := &Vnode{Id: []byte{42}}
-	_, err := bh.Notify(vn, vn2)
-	if err.Error()[:18] != "Failed to connect!" {
+	_, _, err := bh.Notify(vn, vn2, nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to connect!") {
 		t.Fatalf("expected fail")
 	}
 }
@@ -279,8 +416,8 @@ func TestBHNotify(t *testing.T) {
 func TestBHFindSuccessors(t *testing.T) {
 	bh := BlackholeTransport{}
 	vn := &Vnode{Id: []byte{12}}
-	_, err := bh.FindSuccessors(vn, 1, []byte("test"))
-	if err.Error()[:18] != "Failed to connect!" {
+	_, _, err := bh.FindSuccessors(vn, 1, []byte("test"), nil)
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to connect!") {
 		t.Fatalf("expected fail")
 	}
 }
@@ -290,7 +427,7 @@ func TestBHClearPred(t *testing.T) {
 	vn := &Vnode{Id: []byte{12}}
 	s := &Vnode{Id: []byte{50}}
 	err := bh.ClearPredecessor(vn, s)
-	if err.Error()[:18] != "Failed to connect!" {
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to connect!") {
 		t.Fatalf("expected fail")
 	}
 }
@@ -300,7 +437,38 @@ func TestBHSkipSucc(t *testing.T) {
 	vn := &Vnode{Id: []byte{12}}
 	s := &Vnode{Id: []byte{50}}
 	err := bh.SkipSuccessor(vn, s)
-	if err.Error()[:18] != "Failed to connect!" {
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to connect!") {
+		t.Fatalf("expected fail")
+	}
+}
+
+func TestLocalHealth(t *testing.T) {
+	l := makeLocal()
+	suc := []*Vnode{&Vnode{Id: []byte{40}}}
+	mockVN := &MockVnodeRPC{succ_list: suc}
+	vn := &Vnode{Id: []byte{12}}
+	l.Register(vn, mockVN)
+
+	health, err := l.Health(vn)
+	if err != nil {
+		t.Fatalf("local Health failed")
+	}
+	if health.Successors != 1 {
+		t.Fatalf("bad health")
+	}
+
+	unknown := &Vnode{Id: []byte{1}}
+	_, err = l.Health(unknown)
+	if err == nil {
+		t.Fatalf("remote health should fail")
+	}
+}
+
+func TestBHHealth(t *testing.T) {
+	bh := BlackholeTransport{}
+	vn := &Vnode{Id: []byte{12}}
+	_, err := bh.Health(vn)
+	if err == nil || !strings.HasPrefix(err.Error(), "Failed to connect!") {
 		t.Fatalf("expected fail")
 	}
 }
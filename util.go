@@ -8,11 +8,18 @@ import (
 	"time"
 )
 
-// Generates a random stabilization time
-func randStabilize(conf *Config) time.Duration {
+// Generates a random stabilization time using the given source, or the
+// global source if nil. A source that is shared must be locked by the
+// caller.
+func randStabilize(conf *Config, source *rand.Rand) time.Duration {
 	min := conf.StabilizeMin
 	max := conf.StabilizeMax
-	r := rand.Float64()
+	var r float64
+	if source != nil {
+		r = source.Float64()
+	} else {
+		r = rand.Float64()
+	}
 	return time.Duration((r * float64(max-min)) + float64(min))
 }
 
@@ -41,12 +48,25 @@ func betweenRightIncl(id1, id2, key []byte) bool {
 		bytes.Compare(id2, key) >= 0
 }
 
-// Computes the offset by (n + 2^exp) % (2^mod)
-func powerOffset(id []byte, exp int, mod int) []byte {
-	// Copy the existing slice
-	off := make([]byte, len(id))
-	copy(off, id)
+// Between reports whether key is strictly between id1 and id2, going
+// clockwise around the ring from id1. The interval wraps around the ring
+// if id1 is greater than id2, and is empty if they are equal. These are
+// the predicates used for routing, so applications reasoning about key
+// ranges agree with the ring.
+func Between(id1, key, id2 []byte) bool {
+	return between(id1, id2, key)
+}
 
+// BetweenRightIncl reports whether key is in the interval (id1, id2],
+// as with Between but including id2. This is the range of keys owned
+// by the vnode id2 when its predecessor is id1.
+func BetweenRightIncl(id1, key, id2 []byte) bool {
+	return betweenRightIncl(id1, id2, key)
+}
+
+// Computes the offset by (n + 2^exp) % (2^mod). The result is padded
+// to the length of id, so that it compares with IDs of the same ring.
+func powerOffset(id []byte, exp int, mod int) []byte {
 	// Convert the ID to a bigint
 	idInt := big.Int{}
 	idInt.SetBytes(id)
@@ -67,8 +87,53 @@ func powerOffset(id []byte, exp int, mod int) []byte {
 	// Apply the mod
 	idInt.Mod(&sum, &ceil)
 
-	// Add together
-	return idInt.Bytes()
+	// Pad to the length of the ID
+	off := idInt.Bytes()
+	if len(off) < len(id) {
+		padded := make([]byte, len(id))
+		copy(padded[len(id)-len(off):], off)
+		off = padded
+	}
+	return off
+}
+
+// Computes (id + idx * 2^mod / num) % 2^mod, for evenly spacing num IDs
+// around the ring. Unlike powerOffset, the result is padded to the
+// length of id.
+func spreadOffset(id []byte, idx, num, mod int) []byte {
+	// Convert the ID to a bigint
+	idInt := big.Int{}
+	idInt.SetBytes(id)
+
+	// Get the ceiling
+	ceil := big.Int{}
+	ceil.Exp(big.NewInt(2), big.NewInt(int64(mod)), nil)
+
+	// Get the offset
+	offset := big.Int{}
+	offset.Mul(&ceil, big.NewInt(int64(idx)))
+	offset.Div(&offset, big.NewInt(int64(num)))
+
+	// Sum and apply the mod
+	idInt.Add(&idInt, &offset)
+	idInt.Mod(&idInt, &ceil)
+
+	// Pad to the original length
+	out := make([]byte, len(id))
+	return idInt.FillBytes(out)
+}
+
+// Computes (id - 1) % 2^mod, the position just before an ID. The result
+// is padded to the length of id.
+func prevPosition(id []byte, mod int) []byte {
+	idInt := big.Int{}
+	idInt.SetBytes(id)
+	ceil := big.Int{}
+	ceil.Exp(big.NewInt(2), big.NewInt(int64(mod)), nil)
+	idInt.Sub(&idInt, big.NewInt(1))
+	idInt.Mod(&idInt, &ceil)
+	out := make([]byte, len(id))
+	return idInt.FillBytes(out)
 }
 
 // max returns the max of two ints
@@ -89,24 +154,39 @@ func min(a, b int) int {
 	}
 }
 
-// Returns the vnode nearest a key
+// Returns the vnode nearest a key, which is the closest vnode preceeding
+// the key, wrapping around to the highest vnode if there is none. The
+// vnodes do not need to be sorted, since remote lists are unordered.
+// Returns nil if there are no vnodes.
 func nearestVnodeToKey(vnodes []*Vnode, key []byte) *Vnode {
-	for i := len(vnodes) - 1; i >= 0; i-- {
-		if bytes.Compare(vnodes[i].Id, key) == -1 {
-			return vnodes[i]
+	var nearest, last *Vnode
+	for _, vn := range vnodes {
+		if vn == nil {
+			continue
+		}
+		if bytes.Compare(vn.Id, key) == -1 &&
+			(nearest == nil || bytes.Compare(vn.Id, nearest.Id) == 1) {
+			nearest = vn
+		}
+		if last == nil || bytes.Compare(vn.Id, last.Id) == 1 {
+			last = vn
 		}
 	}
-	// Return the last vnode
-	return vnodes[len(vnodes)-1]
+	if nearest != nil {
+		return nearest
+	}
+
+	// Wrap around to the last vnode
+	return last
 }
 
-// Merges errors together
-func mergeErrors(err1, err2 error) error {
-	if err1 == nil {
-		return err2
-	} else if err2 == nil {
-		return err1
-	} else {
-		return fmt.Errorf("%s\n%s", err1, err2)
+// Checks that the vnodes belong to the ring with the given ID
+func checkRingID(ring string, vnodes []*Vnode) error {
+	for _, vn := range vnodes {
+		if vn != nil && vn.Ring != ring {
+			return fmt.Errorf("Ring ID mismatch! Expected %q, got %q from %s",
+				ring, vn.Ring, vn.Host)
+		}
 	}
+	return nil
 }
@@ -1,7 +1,7 @@
 package chord
 
 import (
-	"errors"
+	"bytes"
 	"testing"
 	"time"
 )
@@ -15,7 +15,7 @@ func TestRandStabilize(t *testing.T) {
 
 	var times []time.Duration
 	for i := 0; i < 1000; i++ {
-		after := randStabilize(conf)
+		after := randStabilize(conf, nil)
 		times = append(times, after)
 		if after < min {
 			t.Fatalf("after below min")
@@ -91,6 +91,49 @@ func TestBetweenRightInclWrap(t *testing.T) {
 	}
 }
 
+func TestBetweenExported(t *testing.T) {
+	lo := []byte{0x10, 0}
+	hi := []byte{0xf0, 0}
+	cases := []struct {
+		id1, key, id2 []byte
+		between, incl bool
+	}{
+		{lo, []byte{0x80, 0}, hi, true, true},
+		{lo, hi, hi, false, true},
+		{lo, lo, hi, false, false},
+		{lo, []byte{0xf8, 0}, hi, false, false},
+
+		// The interval wraps around the ring
+		{hi, []byte{0xf8, 0}, lo, true, true},
+		{hi, []byte{0, 0}, lo, true, true},
+		{hi, lo, lo, false, true},
+		{hi, []byte{0x80, 0}, lo, false, false},
+
+		// Equal endpoints are an empty interval
+		{lo, []byte{0x80, 0}, lo, false, false},
+		{lo, lo, lo, false, false},
+	}
+	for idx, c := range cases {
+		if b := Between(c.id1, c.key, c.id2); b != c.between {
+			t.Fatalf("case %d: expected Between %v", idx, c.between)
+		}
+		if b := BetweenRightIncl(c.id1, c.key, c.id2); b != c.incl {
+			t.Fatalf("case %d: expected BetweenRightIncl %v", idx, c.incl)
+		}
+	}
+}
+
+func TestPrevPosition(t *testing.T) {
+	if val := prevPosition([]byte{1, 0}, 16); !bytes.Equal(val, []byte{0, 0xff}) {
+		t.Fatalf("unexpected val! %v", val)
+	}
+
+	// Wraps around the ring
+	if val := prevPosition([]byte{0, 0}, 12); !bytes.Equal(val, []byte{0x0f, 0xff}) {
+		t.Fatalf("unexpected val! %v", val)
+	}
+}
+
 func TestPowerOffset(t *testing.T) {
 	id := []byte{0, 0, 0, 0}
 	exp := 30
@@ -109,6 +152,44 @@ func TestPowerOffset(t *testing.T) {
 	}
 }
 
+func TestRingMod(t *testing.T) {
+	// Keeps the low 20 bits in 3 bytes
+	pos := ringMod([]byte{0xab, 0xcd, 0xef, 0x12}, 20)
+	if !bytes.Equal(pos, []byte{0x0d, 0xef, 0x12}) {
+		t.Fatalf("unexpected pos! %x", pos)
+	}
+
+	// Short positions are padded
+	pos = ringMod([]byte{0xff}, 20)
+	if !bytes.Equal(pos, []byte{0, 0, 0xff}) {
+		t.Fatalf("unexpected pos! %x", pos)
+	}
+
+	// Offsets keep the width of the ring
+	off := powerOffset([]byte{0x0f, 0xff, 0xff}, 0, 20)
+	if !bytes.Equal(off, []byte{0, 0, 0}) {
+		t.Fatalf("unexpected offset! %x", off)
+	}
+}
+
+func TestSpreadOffset(t *testing.T) {
+	id := []byte{0x10, 0, 0, 0}
+	mod := 32
+	expect := []byte{0x10, 0x50, 0x90, 0xd0}
+	for idx, high := range expect {
+		val := spreadOffset(id, idx, 4, mod)
+		if len(val) != 4 || val[0] != high || val[1] != 0 {
+			t.Fatalf("unexpected val at %d! %v", idx, val)
+		}
+	}
+
+	// Wraps around, and keeps leading zeros
+	val := spreadOffset([]byte{0xff, 0, 0, 0}, 1, 256, mod)
+	if len(val) != 4 || val[0] != 0 {
+		t.Fatalf("unexpected val! %v", val)
+	}
+}
+
 func TestMax(t *testing.T) {
 	if max(-10, 10) != 10 {
 		t.Fatalf("bad max")
@@ -148,20 +229,41 @@ func TestNearestVnodesKey(t *testing.T) {
 	}
 }
 
-func TestMergeErrors(t *testing.T) {
-	e1 := errors.New("test1")
-	e2 := errors.New("test2")
+func TestNearestVnodesKeyUnsorted(t *testing.T) {
+	vnodes := make([]*Vnode, 5)
+	vnodes[0] = &Vnode{Id: []byte{10}}
+	vnodes[1] = &Vnode{Id: []byte{2}}
+	vnodes[2] = &Vnode{Id: []byte{14}}
+	vnodes[3] = &Vnode{Id: []byte{4}}
+	vnodes[4] = &Vnode{Id: []byte{7}}
 
-	if mergeErrors(e1, nil) != e1 {
-		t.Fatalf("bad merge")
+	near := nearestVnodeToKey(vnodes, []byte{6})
+	if near != vnodes[3] {
+		t.Fatalf("got wrong node back!")
 	}
-	if mergeErrors(nil, e1) != e1 {
-		t.Fatalf("bad merge")
+
+	// Wraps around to the highest vnode
+	near = nearestVnodeToKey(vnodes, []byte{1})
+	if near != vnodes[2] {
+		t.Fatalf("got wrong node back!")
+	}
+
+	// Exact match is not a predecessor
+	near = nearestVnodeToKey(vnodes, []byte{2})
+	if near != vnodes[2] {
+		t.Fatalf("got wrong node back!")
 	}
-	if mergeErrors(nil, nil) != nil {
-		t.Fatalf("bad merge")
+}
+
+func TestNearestVnodesKeySingle(t *testing.T) {
+	vnodes := []*Vnode{&Vnode{Id: []byte{5}}}
+	if nearestVnodeToKey(vnodes, []byte{6}) != vnodes[0] {
+		t.Fatalf("got wrong node back!")
+	}
+	if nearestVnodeToKey(vnodes, []byte{1}) != vnodes[0] {
+		t.Fatalf("got wrong node back!")
 	}
-	if mergeErrors(e1, e2).Error() != "test1\ntest2" {
-		t.Fatalf("bad merge")
+	if nearestVnodeToKey(nil, []byte{1}) != nil {
+		t.Fatalf("expected no node!")
 	}
 }
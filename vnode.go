@@ -1,7 +1,9 @@
 package chord
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"time"
@@ -12,17 +14,41 @@ func (vn *Vnode) String() string {
 	return fmt.Sprintf("%x", vn.Id)
 }
 
+var errExhaustedPreceeding = errors.New("Exhausted all preceeding nodes!")
+
+// Number of consecutive failed finger repairs between warnings
+const fingerWarnRounds = 10
+
+// Number of recent stabilize durations reported by Health
+const stabilizeWindow = 16
+
+// Checks if two vnodes have the same ID and host
+func (vn *Vnode) Equal(other *Vnode) bool {
+	if vn == nil || other == nil {
+		return vn == other
+	}
+	return bytes.Equal(vn.Id, other.Id) && vn.Host == other.Host
+}
+
+// Compares the IDs of two vnodes, returning -1, 0 or 1
+func (vn *Vnode) Compare(other *Vnode) int {
+	return bytes.Compare(vn.Id, other.Id)
+}
+
 // Initializes a local vnode
 func (vn *localVnode) init(idx int) {
 	// Generate an ID
+	vn.index = idx
 	vn.genId(uint16(idx))
 
-	// Set our host
+	// Set our host and ring
 	vn.Host = vn.ring.config.Hostname
+	vn.Ring = vn.ring.config.RingID
 
 	// Initialize all state
 	vn.successors = make([]*Vnode, vn.ring.config.NumSuccessors)
 	vn.finger = make([]*Vnode, vn.ring.config.hashBits)
+	vn.isolated = true
 
 	// Register with the RPC mechanism
 	vn.ring.transport.Register(&vn.Vnode, vn)
@@ -31,57 +57,241 @@ func (vn *localVnode) init(idx int) {
 // Schedules the Vnode to do regular maintenence
 func (vn *localVnode) schedule() {
 	// Setup our stabilize timer
-	vn.timer = time.AfterFunc(randStabilize(vn.ring.config), vn.stabilize)
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if vn.removed {
+		return
+	}
+	vn.timer = time.AfterFunc(vn.ring.randStabilize(), vn.stabilize)
 }
 
-// Generates an ID for the node
+// Stops the vnode from stabilizing, once removed from the ring
+func (vn *localVnode) stop() {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	vn.removed = true
+	if vn.timer != nil {
+		vn.timer.Stop()
+		vn.timer = nil
+	}
+}
+
+// Generates an ID for the node. With SpreadVnodes, only the hostname
+// is hashed, and the vnodes are placed at even offsets from it. Hashed
+// IDs of a single host may cluster by chance, leaving the host with a
+// few large ranges in a small ring. Evenly spaced IDs cover the ring
+// uniformly, so the keys a host owns are spread across the ring in equal
+// sized ranges. The share each host owns still depends on how the hosts
+// are offset from each other.
 func (vn *localVnode) genId(idx uint16) {
 	// Use the hash funciton
 	conf := vn.ring.config
 	hash := conf.HashFunc()
 	hash.Write([]byte(conf.Hostname))
+	if conf.SpreadVnodes {
+		vn.Id = spreadOffset(hashSum(conf, hash), int(idx), conf.NumVnodes, conf.hashBits)
+		return
+	}
 	binary.Write(hash, binary.BigEndian, idx)
 
 	// Use the hash as the ID
-	vn.Id = hash.Sum(nil)
+	vn.Id = hashSum(conf, hash)
 }
 
 // Called to periodically stabilize the vnode
 func (vn *localVnode) stabilize() {
 	// Clear the timer
+	vn.lock.Lock()
 	vn.timer = nil
+	removed := vn.removed
+	vn.lock.Unlock()
+	if removed {
+		return
+	}
 
 	// Check for shutdown
-	if vn.ring.shutdown != nil {
-		vn.ring.shutdown <- true
+	if shutdown := vn.ring.stopping(); shutdown != nil {
+		shutdown <- true
 		return
 	}
 
 	// Setup the next stabilize timer
 	defer vn.schedule()
+	vn.stabilizeOnce()
+}
+
+// Runs a single round of stabilization
+func (vn *localVnode) stabilizeOnce() {
+	start := time.Now()
+	defer func() {
+		vn.recordStabilize(time.Since(start))
+		vn.countChanges()
+	}()
 
 	// Check for new successor
 	if err := vn.checkNewSuccessor(); err != nil {
-		log.Printf("[ERR] Error checking for new successor: %s", err)
+		vn.stabilizeError(PhaseCheckNewSuccessor, err)
 	}
 
 	// Notify the successor
 	if err := vn.notifySuccessor(); err != nil {
-		log.Printf("[ERR] Error notifying successor: %s", err)
+		vn.stabilizeError(PhaseNotifySuccessor, err)
 	}
 
 	// Finger table fix up
 	if err := vn.fixFingerTable(); err != nil {
-		log.Printf("[ERR] Error fixing finger table: %s", err)
+		vn.stabilizeError(PhaseFixFingerTable, err)
 	}
 
 	// Check the predecessor
 	if err := vn.checkPredecessor(); err != nil {
-		log.Printf("[ERR] Error checking predecessor: %s", err)
+		vn.stabilizeError(PhaseCheckPredecessor, err)
 	}
 
-	// Set the last stabilized time
+	// Check if we are alone
+	vn.checkIsolated()
+
+	// Repair the order of our successors
+	vn.normalizeSuccessors()
+
+	// Set the last stabilized time, and check short lookups again
+	vn.lock.Lock()
 	vn.stabilized = time.Now()
+	vn.lock.Unlock()
+	vn.ring.wholeRing.Store(0)
+
+	// Verify our state is consistent
+	if vn.ring.config.StrictChecks {
+		vn.lock.Lock()
+		err := vn.validate()
+		vn.lock.Unlock()
+		if err != nil {
+			vn.stabilizeError(PhaseValidate, err)
+		}
+	}
+}
+
+// Drops any successors that are out of ring order, along with gaps,
+// duplicates and ourself, so that the list only moves forward around
+// the ring from us. The first successor is always kept. Logs a warning
+// if the list was corrected.
+func (vn *localVnode) normalizeSuccessors() {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	known := vn.knownSuccessors()
+	if known == 0 {
+		return
+	}
+	kept, dropped := 1, 0
+	for i := 1; i < known; i++ {
+		s := vn.successors[i]
+		if s == nil {
+			continue
+		}
+		if s.Equal(&vn.Vnode) || !between(vn.successors[kept-1].Id, vn.Id, s.Id) {
+			dropped++
+			continue
+		}
+		vn.successors[kept] = s
+		kept++
+	}
+	for i := kept; i < known; i++ {
+		vn.successors[i] = nil
+	}
+	if dropped > 0 {
+		log.Printf("[WARN] Vnode %s dropped %d successors out of ring order", vn.String(), dropped)
+	}
+}
+
+// Counts a stabilize run, and whether our first successor or predecessor
+// changed since the previous run, either by stabilizing or by an RPC
+func (vn *localVnode) countChanges() {
+	vn.lock.Lock()
+	succ, pred := vn.successors[0], vn.predecessor
+	succChanged := !succ.Equal(vn.lastSucc)
+	predChanged := !pred.Equal(vn.lastPred)
+	vn.lastSucc, vn.lastPred = succ, pred
+	vn.lock.Unlock()
+	vn.stabilizes.Add(1)
+	if succChanged {
+		vn.succChanges.Add(1)
+	}
+	if predChanged {
+		vn.predChanges.Add(1)
+	}
+}
+
+// Records the duration of a stabilize run, and passes it to the
+// configured timer
+func (vn *localVnode) recordStabilize(d time.Duration) {
+	vn.lock.Lock()
+	if len(vn.durations) == stabilizeWindow {
+		copy(vn.durations, vn.durations[1:])
+		vn.durations = vn.durations[:stabilizeWindow-1]
+	}
+	vn.durations = append(vn.durations, d)
+	vn.lock.Unlock()
+	if timer := vn.ring.config.StabilizeTimer; timer != nil {
+		timer(&vn.Vnode, d)
+	}
+}
+
+// Informs the delegate when the vnode becomes isolated, with only
+// successors on the local host, or when it has remote successors again.
+// Only the successors up to where the list wraps around the ring past
+// us are considered, since the rest are left over from earlier rounds.
+func (vn *localVnode) checkIsolated() {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	isolated := true
+	var prev *Vnode
+	for _, s := range vn.successors {
+		if s == nil || prev != nil && !between(prev.Id, vn.Id, s.Id) {
+			break
+		}
+		if s.Host != vn.Host {
+			isolated = false
+			break
+		}
+		prev = s
+	}
+	if isolated == vn.isolated {
+		return
+	}
+	vn.isolated = isolated
+
+	vn.ring.invokeDelegate(func(d Delegate) {
+		id, ok := d.(IsolationDelegate)
+		if !ok {
+			return
+		}
+		if isolated {
+			id.Isolated(&vn.Vnode)
+		} else {
+			id.Joined(&vn.Vnode)
+		}
+	})
+}
+
+// Handles an error from a phase of stabilization, using the configured
+// handler or logging it otherwise
+func (vn *localVnode) stabilizeError(phase string, err error) {
+	if handler := vn.ring.config.StabilizeErrorHandler; handler != nil {
+		handler(&vn.Vnode, phase, err)
+		return
+	}
+	switch phase {
+	case PhaseCheckNewSuccessor:
+		log.Printf("[ERR] Error checking for new successor: %s", err)
+	case PhaseNotifySuccessor:
+		log.Printf("[ERR] Error notifying successor: %s", err)
+	case PhaseFixFingerTable:
+		log.Printf("[ERR] Error fixing finger table: %s", err)
+	case PhaseCheckPredecessor:
+		log.Printf("[ERR] Error checking predecessor: %s", err)
+	case PhaseValidate:
+		log.Printf("[ERR] Vnode %s failed validation: %s", vn.String(), err)
+	}
 }
 
 // Checks for a new successor
@@ -90,41 +300,108 @@ func (vn *localVnode) checkNewSuccessor() error {
 	trans := vn.ring.transport
 
 CHECK_NEW_SUC:
+	vn.lock.Lock()
 	succ := vn.successors[0]
+	vn.lock.Unlock()
 	if succ == nil {
 		panic("Node has no successor!")
 	}
 	maybe_suc, err := trans.GetPredecessor(succ)
 	if err != nil {
 		// Check if we have succ list, try to contact next live succ
+		vn.lock.Lock()
 		known := vn.knownSuccessors()
+		checked := make([]*Vnode, known)
+		copy(checked, vn.successors)
+		vn.lock.Unlock()
 		if known > 1 {
-			for i := 0; i < known; i++ {
-				if alive, _ := trans.Ping(vn.successors[0]); !alive {
-					// Don't eliminate the last successor we know of
-					if i+1 == known {
-						return fmt.Errorf("All known successors dead!")
-					}
-
-					// Advance the successors list past the dead one
-					copy(vn.successors[0:], vn.successors[1:])
-					vn.successors[known-1-i] = nil
-				} else {
-					// Found live successor, check for new one
-					goto CHECK_NEW_SUC
+			// Check the liveness of all known successors at once
+			alive, _ := trans.BatchPing(checked)
+
+			// Give up on this round if the successors changed while
+			// we were checking them
+			vn.lock.Lock()
+			if vn.knownSuccessors() != known || !hasPrefix(vn.successors, checked) {
+				vn.lock.Unlock()
+				return err
+			}
+			live := -1
+			for i := 0; i < known && i < len(alive); i++ {
+				if alive[i] {
+					live = i
+					break
 				}
 			}
+
+			// Count the failures of the dead successors before the
+			// live one. Counts of any other successors are reset.
+			limit := live
+			if live == -1 {
+				limit = known
+			}
+			fails := make(map[string]int, limit)
+			for i := 0; i < limit; i++ {
+				key := vn.successors[i].String()
+				fails[key] = vn.succFails[key] + 1
+			}
+			vn.succFails = fails
+
+			// Evict the dead successors that reached the threshold, but
+			// don't eliminate the last successor we know of
+			conf := vn.ring.config
+			threshold := max(conf.SuccessorFailThreshold, 1)
+			drop := 0
+			for drop < limit && drop < known-1 && fails[vn.successors[drop].String()] >= threshold {
+				drop++
+			}
+
+			// Inform the delegate of the failures
+			for i := 0; i < drop; i++ {
+				dead := vn.successors[i]
+				delete(vn.succFails, dead.String())
+				vn.ring.cache.invalidateVnode(dead)
+				vn.ring.forgetLoad(dead.Host)
+				vn.peerFailed(dead)
+			}
+
+			// Advance the successors list past the dead ones
+			copy(vn.successors[0:], vn.successors[drop:])
+			for i := known - drop; i < known; i++ {
+				vn.successors[i] = nil
+			}
+			vn.lock.Unlock()
+
+			if live == -1 && drop == known-1 {
+				return fmt.Errorf("All known successors dead!")
+			} else if live > 0 && drop == live {
+				// Found live successor, check for new one
+				goto CHECK_NEW_SUC
+			}
+		} else if recovered, rerr := vn.recoverSuccessor(succ); recovered {
+			goto CHECK_NEW_SUC
+		} else if rerr != nil {
+			return rerr
 		}
 		return err
 	}
 
+	// Our successor is alive, reset any failure counts
+	vn.lock.Lock()
+	vn.succFails = nil
+	vn.lock.Unlock()
+
 	// Check if we should replace our successor
 	if maybe_suc != nil && between(vn.Id, succ.Id, maybe_suc.Id) {
 		// Check if new successor is alive before switching
 		alive, err := trans.Ping(maybe_suc)
 		if alive && err == nil {
-			copy(vn.successors[1:], vn.successors[0:len(vn.successors)-1])
-			vn.successors[0] = maybe_suc
+			vn.lock.Lock()
+			defer vn.lock.Unlock()
+			if vn.successors[0].Equal(succ) {
+				copy(vn.successors[1:], vn.successors[0:len(vn.successors)-1])
+				vn.successors[0] = maybe_suc
+				vn.ring.cache.invalidateRange(vn.Id, maybe_suc.Id)
+			}
 		} else {
 			return err
 		}
@@ -132,73 +409,278 @@ CHECK_NEW_SUC:
 	return nil
 }
 
+// Checks if a list starts with the given vnodes
+func hasPrefix(list, prefix []*Vnode) bool {
+	if len(prefix) > len(list) {
+		return false
+	}
+	for i, vn := range prefix {
+		if !vn.Equal(list[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Recovers from the failure of our only known successor, which always
+// happens when NumSuccessors is 1. There is no successor list to fall
+// back on, so once the failure threshold is reached, the closest live
+// finger or local vnode becomes our successor. Stabilization then walks
+// back through its predecessors to our true successor. Returns if the
+// successor was replaced.
+func (vn *localVnode) recoverSuccessor(dead *Vnode) (bool, error) {
+	trans := vn.ring.transport
+	if alive, _ := trans.Ping(dead); alive {
+		return false, nil
+	}
+
+	// Count the failure, and gather the candidates in order of their
+	// distance after us
+	vn.lock.Lock()
+	if !vn.successors[0].Equal(dead) || vn.knownSuccessors() != 1 {
+		vn.lock.Unlock()
+		return false, nil
+	}
+	key := dead.String()
+	fails := vn.succFails[key] + 1
+	vn.succFails = map[string]int{key: fails}
+	var candidates []*Vnode
+	add := func(c *Vnode) {
+		if c == nil || c.Equal(dead) || c.Equal(&vn.Vnode) {
+			return
+		}
+		for _, o := range candidates {
+			if o.Equal(c) {
+				return
+			}
+		}
+		candidates = append(candidates, c)
+	}
+	for _, f := range vn.finger {
+		add(f)
+	}
+	vn.lock.Unlock()
+	if fails < max(vn.ring.config.SuccessorFailThreshold, 1) {
+		return false, nil
+	}
+
+	// Local vnodes are always live, so they are the last resort
+	local := vn.ring.localVnodes()
+	for i := range local {
+		if local[i] == vn {
+			for j := 1; j < len(local); j++ {
+				add(&local[(i+j)%len(local)].Vnode)
+			}
+			break
+		}
+	}
+
+	for _, c := range candidates {
+		if alive, err := trans.Ping(c); !alive || err != nil {
+			continue
+		}
+		vn.lock.Lock()
+		defer vn.lock.Unlock()
+		if !vn.successors[0].Equal(dead) {
+			return false, nil
+		}
+		delete(vn.succFails, key)
+		vn.ring.cache.invalidateVnode(dead)
+		vn.ring.forgetLoad(dead.Host)
+		vn.peerFailed(dead)
+		vn.successors[0] = c
+		for i, f := range vn.finger {
+			if f.Equal(dead) {
+				vn.finger[i] = nil
+			}
+		}
+		return true, nil
+	}
+	return false, fmt.Errorf("All known successors dead!")
+}
+
 // RPC: Invoked to return out predecessor
 func (vn *localVnode) GetPredecessor() (*Vnode, error) {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
 	return vn.predecessor, nil
 }
 
+// Finds the range a rejoining vnode reclaims, returning the delegate
+// event to invoke, or nil. While we were away, our keys were owned by
+// our first remote successor. We take back those after its predecessor,
+// or after the preceding local vnode if that is closer, which are not
+// ours to reclaim. Nothing is reclaimed if it already knows of us.
+func (vn *localVnode) reclaimRange(local []*localVnode) (func(Delegate), error) {
+	vn.lock.Lock()
+	var from *Vnode
+	for _, s := range vn.successors {
+		if s != nil && s.Host != vn.Host {
+			from = s
+			break
+		}
+	}
+	vn.lock.Unlock()
+	if from == nil {
+		return nil, nil
+	}
+	pred, err := vn.ring.transport.GetPredecessor(from)
+	if err != nil {
+		return nil, err
+	}
+
+	start := from.Id
+	if pred != nil {
+		if pred.Equal(&vn.Vnode) || !between(from.Id, vn.Id, pred.Id) {
+			return nil, nil
+		}
+		start = pred.Id
+	}
+	for i := range local {
+		if local[i] == vn {
+			prev := local[(i+len(local)-1)%len(local)]
+			if between(start, vn.Id, prev.Id) {
+				start = prev.Id
+			}
+			break
+		}
+	}
+	return func(d Delegate) {
+		if rd, ok := d.(ReclaimDelegate); ok {
+			rd.ReclaimRange(&vn.Vnode, start, vn.Id, from)
+		}
+	}, nil
+}
+
 // Notifies our successor of us, updates successor list
 func (vn *localVnode) notifySuccessor() error {
 	// Notify successor
+	vn.lock.Lock()
 	succ := vn.successors[0]
-	succ_list, err := vn.ring.transport.Notify(succ, &vn.Vnode)
+	vn.lock.Unlock()
+	succ_list, payload, load, err := notifyLoad(vn.ring.transport, succ, &vn.Vnode,
+		vn.ring.notifyPayload(), vn.ring.reportLoad())
 	if err != nil {
 		return err
 	}
+	vn.ring.recordLoad(succ, load)
 
-	// Trim the successors list if too long
-	max_succ := vn.ring.config.NumSuccessors
-	if len(succ_list) > max_succ-1 {
-		succ_list = succ_list[:max_succ-1]
+	// Pass on any payload of our successor
+	if payload != nil {
+		vn.ring.invokeDelegate(func(d Delegate) {
+			if pd, ok := d.(PayloadDelegate); ok {
+				pd.NotifyPayload(&vn.Vnode, succ, payload)
+			}
+		})
 	}
 
-	// Update local successors list
-	for idx, s := range succ_list {
-		if s == nil {
+	// Update local successors list, unless our successor changed
+	// while we were notifying it
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if !vn.successors[0].Equal(succ) {
+		return nil
+	}
+	max_succ := len(vn.successors)
+	idx := 1
+	for _, s := range succ_list {
+		if idx >= max_succ {
 			break
 		}
-		// Ensure we don't set ourselves as a successor!
-		if s == nil || s.String() == vn.String() {
-			break
+		// Ensure we don't set ourselves as a successor! In a
+		// small ring we may appear anywhere in the list.
+		if s == nil || s.Equal(&vn.Vnode) {
+			continue
 		}
-		vn.successors[idx+1] = s
+		vn.successors[idx] = s
+		idx++
+	}
+
+	// Clear any stale successors
+	for ; idx < max_succ; idx++ {
+		vn.successors[idx] = nil
 	}
 	return nil
 }
 
 // RPC: Notify is invoked when a Vnode gets notified
-func (vn *localVnode) Notify(maybe_pred *Vnode) ([]*Vnode, error) {
+func (vn *localVnode) Notify(maybe_pred *Vnode, payload []byte) ([]*Vnode, []byte, error) {
+	succs, resp, _, err := vn.NotifyLoad(maybe_pred, payload, nil)
+	return succs, resp, err
+}
+
+// Handles a Notify along with the load of the notifying host, which is
+// nil if it did not report one. Returns our successors, payload and load.
+func (vn *localVnode) NotifyLoad(maybe_pred *Vnode, payload []byte, load *float64) ([]*Vnode, []byte, *float64, error) {
+	// Refuse vnodes from other rings
+	if err := checkRingID(vn.Ring, []*Vnode{maybe_pred}); err != nil {
+		return nil, nil, nil, err
+	}
+	resp := vn.ring.notifyPayload()
+	respLoad := vn.ring.reportLoad()
+
 	// Check if we should update our predecessor
-	if vn.predecessor == nil || between(vn.predecessor.Id, vn.Id, maybe_pred.Id) {
-		// Inform the delegate
-		conf := vn.ring.config
-		old := vn.predecessor
-		vn.ring.invokeDelegate(func() {
-			conf.Delegate.NewPredecessor(&vn.Vnode, maybe_pred, old)
-		})
+	if err := vn.updatePredecessor(maybe_pred); err != nil {
+		return nil, nil, nil, err
+	}
+	vn.ring.recordLoad(maybe_pred, load)
 
-		vn.predecessor = maybe_pred
+	// Pass on any payload of the notifying vnode
+	if payload != nil {
+		vn.ring.invokeDelegate(func(d Delegate) {
+			if pd, ok := d.(PayloadDelegate); ok {
+				pd.NotifyPayload(&vn.Vnode, maybe_pred, payload)
+			}
+		})
 	}
 
-	// Return our successors list
-	return vn.successors, nil
+	// Return a copy of our successors list, payload and load
+	vn.lock.Lock()
+	succs := make([]*Vnode, len(vn.successors))
+	copy(succs, vn.successors)
+	vn.lock.Unlock()
+	return succs, resp, respLoad, nil
 }
 
-// Fixes up the finger table
+// Fixes up the finger table, repairing FingersPerStabilize entries
 func (vn *localVnode) fixFingerTable() error {
+	num := max(vn.ring.config.FingersPerStabilize, 1)
+	for i := 0; i < num; i++ {
+		if err := vn.fixFinger(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Fixes up the next entry in the finger table
+func (vn *localVnode) fixFinger() error {
 	// Determine the offset
 	hb := vn.ring.config.hashBits
-	offset := powerOffset(vn.Id, vn.last_finger, hb)
+	vn.lock.Lock()
+	idx := vn.last_finger
+	vn.lock.Unlock()
+	offset := powerOffset(vn.Id, idx, hb)
 
 	// Find the successor
-	nodes, err := vn.FindSuccessors(1, offset)
-	if nodes == nil || len(nodes) == 0 || err != nil {
+	nodes, _, err := vn.FindSuccessors(1, offset, nil)
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if nodes == nil || len(nodes) == 0 || nodes[0] == nil || err != nil {
+		// Warn if the repair appears to be stuck
+		vn.fingerFails++
+		if vn.fingerFails%fingerWarnRounds == 0 {
+			log.Printf("[WARN] Vnode %s failed to repair finger %d for %d consecutive rounds",
+				vn.String(), idx, vn.fingerFails)
+		}
 		return err
 	}
 	node := nodes[0]
+	vn.fingerFails = 0
 
 	// Update the finger table
-	vn.finger[vn.last_finger] = node
+	vn.last_finger = idx
+	vn.finger[idx] = node
 
 	// Try to skip as many finger entries as possible
 	for {
@@ -218,6 +700,7 @@ func (vn *localVnode) fixFingerTable() error {
 	}
 
 	// Increment to the index to repair
+	vn.fingerFixed = vn.last_finger
 	if vn.last_finger+1 == hb {
 		vn.last_finger = 0
 	} else {
@@ -227,122 +710,531 @@ func (vn *localVnode) fixFingerTable() error {
 	return nil
 }
 
-// Checks the health of our predecessor
-func (vn *localVnode) checkPredecessor() error {
-	// Check predecessor
-	if vn.predecessor != nil {
-		res, err := vn.ring.transport.Ping(vn.predecessor)
-		if err != nil {
-			return err
+// Updates our predecessor if the vnode is closer than the current one.
+// A vnode claiming our own ID is ignored, so we never become our own
+// predecessor. A vnode vetoed by the AcceptPredecessor of the config is
+// rejected with an error. The lock must not be held, since it is
+// released while the AcceptPredecessor is invoked, and the vnode is
+// checked again once it returns, in case we were notified meanwhile.
+func (vn *localVnode) updatePredecessor(maybe_pred *Vnode) error {
+	vn.lock.Lock()
+	closer := vn.closerPredecessor(maybe_pred)
+	vn.lock.Unlock()
+	if !closer {
+		return nil
+	}
+	if accept := vn.ring.config.AcceptPredecessor; accept != nil && !accept(&vn.Vnode, maybe_pred) {
+		return fmt.Errorf("%w Vnode %s refused %s at %s", ErrPredecessorRejected, vn.String(), maybe_pred.String(), maybe_pred.Host)
+	}
+
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if !vn.closerPredecessor(maybe_pred) {
+		return nil
+	}
+
+	// Inform the delegate
+	old := vn.predecessor
+	start := vn.Id
+	if old != nil {
+		start = old.Id
+	}
+	vn.ring.invokeDelegate(func(d Delegate) {
+		d.NewPredecessor(&vn.Vnode, maybe_pred, old)
+		if rd, ok := d.(RangeDelegate); ok {
+			rd.NewPredecessorRange(&vn.Vnode, maybe_pred, old, start, maybe_pred.Id)
 		}
+	})
 
-		// Predecessor is dead
-		if !res {
-			vn.predecessor = nil
+	vn.predecessor = maybe_pred
+	vn.predFails = 0
+	vn.predMissing = time.Time{}
+	if old == nil {
+		vn.ring.cache.clear()
+	} else {
+		vn.ring.cache.invalidateRange(old.Id, maybe_pred.Id)
+	}
+	return nil
+}
+
+// Checks if a vnode other than us is closer than our predecessor. The
+// lock must be held.
+func (vn *localVnode) closerPredecessor(maybe_pred *Vnode) bool {
+	if bytes.Equal(maybe_pred.Id, vn.Id) {
+		return false
+	}
+	return vn.predecessor == nil || between(vn.predecessor.Id, vn.Id, maybe_pred.Id)
+}
+
+// Informs the delegate that a remote vnode has failed
+func (vn *localVnode) peerFailed(dead *Vnode) {
+	vn.ring.invokeDelegate(func(d Delegate) {
+		if fd, ok := d.(FailureDelegate); ok {
+			fd.PeerFailed(&vn.Vnode, dead)
 		}
+	})
+}
+
+// Checks the health of our predecessor, or looks for one if we have
+// been without for too long
+func (vn *localVnode) checkPredecessor() error {
+	// Check predecessor
+	vn.lock.Lock()
+	pred := vn.predecessor
+	if pred != nil {
+		vn.predMissing = time.Time{}
+	} else if vn.predMissing.IsZero() {
+		vn.predMissing = time.Now()
+	}
+	missing := vn.predMissing
+	vn.lock.Unlock()
+	if pred == nil {
+		return vn.findPredecessor(missing)
+	}
+	res, err := vn.ring.transport.Ping(pred)
+
+	// Ignore the result if our predecessor changed meanwhile
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if vn.predecessor != pred {
+		return err
+	}
+
+	// Predecessor is alive
+	if res && err == nil {
+		vn.predFails = 0
+		return nil
+	}
+
+	// Predecessor is dead or unreachable, clear it after enough failures
+	vn.predFails++
+	if vn.predFails >= max(vn.ring.config.PredecessorFailThreshold, 1) {
+		// Inform the delegate
+		dead := vn.predecessor
+		vn.peerFailed(dead)
+		vn.ring.cache.invalidateVnode(dead)
+		vn.ring.forgetLoad(dead.Host)
+		vn.predecessor = nil
+		vn.predFails = 0
+	}
+	return err
+}
+
+// Looks up our predecessor once we have been without one for longer
+// than the PredecessorTimeout. A lookup of the position just before our
+// ID is answered by the vnode we are the successor of, which is adopted
+// as our predecessor, as if it had notified us. This heals a missing
+// predecessor when no vnode notifies us, such as at the edge of a
+// sparse ring.
+func (vn *localVnode) findPredecessor(missing time.Time) error {
+	timeout := vn.ring.config.PredecessorTimeout
+	if timeout <= 0 || time.Since(missing) < timeout {
+		return nil
+	}
+	key := prevPosition(vn.Id, vn.ring.config.hashBits)
+	res, path, err := vn.FindSuccessors(1, key, nil)
+	if err == errExhaustedPreceeding {
+		// No other vnode is known yet
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	// Only trust a vnode that answered with us as the successor. Older
+	// peers may not return a path at all.
+	if len(path) == 0 || len(res) == 0 || res[0] == nil || !res[0].Equal(&vn.Vnode) {
+		return nil
+	}
+	found := path[len(path)-1]
+	if found.Equal(&vn.Vnode) {
+		return nil
+	}
+
+	// Ignore the result if we were notified meanwhile
+	vn.lock.Lock()
+	noPred := vn.predecessor == nil
+	vn.lock.Unlock()
+	if noPred {
+		return vn.updatePredecessor(found)
 	}
 	return nil
 }
 
-// Finds next N successors. N must be <= NumSuccessors
-func (vn *localVnode) FindSuccessors(n int, key []byte) ([]*Vnode, error) {
+// Finds next N successors. N must be positive, and is limited to the
+// NumSuccessors we keep, since it may come from a remote request. The
+// visited vnodes have already forwarded the request, and if we are
+// among them the request has looped back to us and an error is
+// returned. The path returned is the visited vnodes, followed by each
+// vnode that handled the request from us onwards.
+func (vn *localVnode) FindSuccessors(n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	return vn.FindSuccessorsTrace(n, key, visited, false)
+}
+
+// Finds next N successors as with FindSuccessors. Unless the lookup is
+// traced, remote vnodes may only return the vnode that answered, rather
+// than every vnode that handled the request after us.
+func (vn *localVnode) FindSuccessorsTrace(n int, key []byte, visited []*Vnode, trace bool) ([]*Vnode, []*Vnode, error) {
+	if n <= 0 {
+		return nil, nil, fmt.Errorf("Invalid number of successors %d! Must be at least 1.", n)
+	}
+	n = min(n, len(vn.successors))
+	path := make([]*Vnode, len(visited), len(visited)+1)
+	copy(path, visited)
+	path = append(path, &vn.Vnode)
+
 	// Check if we are the immediate predecessor
+	vn.lock.Lock()
 	if betweenRightIncl(vn.Id, vn.successors[0].Id, key) {
-		return vn.successors[:n], nil
+		res := make([]*Vnode, min(n, vn.knownSuccessors()))
+		copy(res, vn.successors)
+		vn.lock.Unlock()
+		return res, path, nil
+	}
+	vn.lock.Unlock()
+
+	// Refuse to forward a request a second time
+	for _, v := range visited {
+		if v.Equal(&vn.Vnode) {
+			return nil, nil, fmt.Errorf("Routing loop detected at vnode %s!", vn.String())
+		}
 	}
 
-	// Try the closest preceeding nodes
+	// Try the closest preceeding nodes, as many at once as the fanout
 	cp := closestPreceedingVnodeIterator{}
 	cp.init(vn, key)
+	fanout := max(vn.ring.config.LookupFanout, 1)
 	for {
-		// Get the next closest node
-		closest := cp.Next()
-		if closest == nil {
+		// Get the next closest nodes
+		closest := cp.NextN(fanout)
+		if len(closest) == 0 {
 			break
 		}
 
-		// Try that node, break on success
-		res, err := vn.ring.transport.FindSuccessors(closest, n, key)
-		if err == nil {
-			return res, nil
-		} else {
-			log.Printf("[ERR] Failed to contact %s. Got %s", closest.String(), err)
+		// Try those nodes, break on the first success
+		if res, hops, ok := vn.forwardLookup(&cp, closest, n, key, path, trace); ok {
+			// Never pass on more than requested by the caller
+			if len(res) > n {
+				res = res[:n]
+			}
+			return res, hops, nil
 		}
 	}
 
 	// Determine how many successors we know of
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
 	successors := vn.knownSuccessors()
 
 	// Check if the ID is between us and any non-immediate successors
 	for i := 1; i <= successors-n; i++ {
 		if betweenRightIncl(vn.Id, vn.successors[i].Id, key) {
-			remain := vn.successors[i:]
-			if len(remain) > n {
-				remain = remain[:n]
-			}
-			return remain, nil
+			remain := make([]*Vnode, min(len(vn.successors)-i, n))
+			copy(remain, vn.successors[i:])
+			return remain, path, nil
 		}
 	}
 
 	// Checked all closer nodes and our successors!
-	return nil, fmt.Errorf("Exhausted all preceeding nodes!")
+	return nil, nil, errExhaustedPreceeding
+}
+
+// Forwards a lookup to each of the closest vnodes concurrently, and
+// returns the first successful response. The other responses are ignored
+// once they arrive. Failed hosts are marked on the iterator.
+func (vn *localVnode) forwardLookup(cp *closestPreceedingVnodeIterator, closest []*Vnode, n int, key []byte, path []*Vnode, trace bool) ([]*Vnode, []*Vnode, bool) {
+	type result struct {
+		vn        *Vnode
+		res, hops []*Vnode
+		err       error
+	}
+	results := make(chan result, len(closest))
+	query := func(c *Vnode) {
+		res, hops, err := findSuccessorsTrace(vn.ring.transport, c, n, key, path, trace)
+		results <- result{c, res, hops, err}
+	}
+	if len(closest) == 1 {
+		query(closest[0])
+	} else {
+		for _, c := range closest {
+			go query(c)
+		}
+	}
+	for range closest {
+		r := <-results
+		if r.err == nil {
+			return r.res, r.hops, true
+		}
+		if errors.Is(r.err, ErrVnodeDraining) {
+			// Only this vnode is leaving, its host is still fine
+			continue
+		}
+		log.Printf("[ERR] Failed to contact %s. Got %s", r.vn.String(), r.err)
+
+		// Avoid paying another timeout for each vnode on a
+		// failed remote host during this lookup
+		if r.vn.Host != vn.Host {
+			cp.Fail(r.vn.Host)
+		}
+	}
+	return nil, nil, false
+}
+
+// Finds the next N successors using only the state of the local vnodes.
+// The lookup is forwarded between local vnodes as with FindSuccessors,
+// and ErrRemoteHop is returned if it would be forwarded to a remote one.
+func (vn *localVnode) findSuccessorsLocal(n int, key []byte) ([]*Vnode, error) {
+	// Each hop is closer to the key, so no local vnode is visited twice
+	limit := len(vn.ring.localVnodes())
+	for hops := 0; vn != nil && hops < limit; hops++ {
+		// Check if the key is between us and one of our successors,
+		// with enough known successors following it
+		vn.lock.Lock()
+		known := vn.knownSuccessors()
+		for i := 0; i == 0 || i <= known-n; i++ {
+			if vn.successors[i] != nil && betweenRightIncl(vn.Id, vn.successors[i].Id, key) {
+				res := make([]*Vnode, min(len(vn.successors)-i, n))
+				copy(res, vn.successors[i:])
+				vn.lock.Unlock()
+				return res, nil
+			}
+		}
+		vn.lock.Unlock()
+
+		// Move on to the closest preceeding vnode, if it is local
+		cp := closestPreceedingVnodeIterator{}
+		cp.init(vn, key)
+		closest := cp.Next()
+		if closest == nil {
+			return nil, errExhaustedPreceeding
+		}
+		if closest.Host != vn.Host {
+			return nil, ErrRemoteHop
+		}
+		vn = vn.ring.localVnode(closest.Id)
+	}
+	return nil, ErrRemoteHop
 }
 
 // Instructs the vnode to leave
 func (vn *localVnode) leave() error {
+	// Stop serving routing requests, our state is going stale
+	vn.draining.Store(true)
+
 	// Inform the delegate we are leaving
-	conf := vn.ring.config
+	vn.lock.Lock()
 	pred := vn.predecessor
 	succ := vn.successors[0]
-	vn.ring.invokeDelegate(func() {
-		conf.Delegate.Leaving(&vn.Vnode, pred, succ)
+	vn.lock.Unlock()
+	vn.ring.invokeDelegate(func(d Delegate) {
+		d.Leaving(&vn.Vnode, pred, succ)
 	})
 
 	// Notify predecessor to advance to their next successor
 	var err error
 	trans := vn.ring.transport
-	if vn.predecessor != nil {
-		err = trans.SkipSuccessor(vn.predecessor, &vn.Vnode)
+	if pred != nil {
+		if serr := trans.SkipSuccessor(pred, &vn.Vnode); serr != nil {
+			err = fmt.Errorf("%w Vnode %s at %s: %w", ErrSkipSuccessor, vn.String(), pred.Host, serr)
+		}
 	}
 
 	// Notify successor to clear old predecessor
-	err = mergeErrors(err, trans.ClearPredecessor(vn.successors[0], &vn.Vnode))
+	if cerr := trans.ClearPredecessor(succ, &vn.Vnode); cerr != nil {
+		err = errors.Join(err, fmt.Errorf("%w Vnode %s at %s: %w", ErrClearPredecessor, vn.String(), succ.Host, cerr))
+	}
 	return err
 }
 
+// Checks if the vnode has started to leave
+func (vn *localVnode) isDraining() bool {
+	return vn.draining.Load()
+}
+
 // Used to clear our predecessor when a node is leaving
 func (vn *localVnode) ClearPredecessor(p *Vnode) error {
-	if vn.predecessor != nil && vn.predecessor.String() == p.String() {
+	if err := checkRingID(vn.Ring, []*Vnode{p}); err != nil {
+		return err
+	}
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	if vn.predecessor != nil && vn.predecessor.Equal(p) {
 		// Inform the delegate
-		conf := vn.ring.config
 		old := vn.predecessor
-		vn.ring.invokeDelegate(func() {
-			conf.Delegate.PredecessorLeaving(&vn.Vnode, old)
+		vn.ring.invokeDelegate(func(d Delegate) {
+			d.PredecessorLeaving(&vn.Vnode, old)
 		})
+		vn.ring.cache.invalidateVnode(old)
 		vn.predecessor = nil
+		vn.predFails = 0
+
+		// Keys that were routed to it now belong to us
+		vn.replaceFinger(old, &vn.Vnode)
 	}
 	return nil
 }
 
 // Used to skip a successor when a node is leaving
 func (vn *localVnode) SkipSuccessor(s *Vnode) error {
+	if err := checkRingID(vn.Ring, []*Vnode{s}); err != nil {
+		return err
+	}
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+
 	// Skip if we have a match
-	if vn.successors[0].String() == s.String() {
+	if vn.successors[0].Equal(s) {
 		// Inform the delegate
-		conf := vn.ring.config
 		old := vn.successors[0]
-		vn.ring.invokeDelegate(func() {
-			conf.Delegate.SuccessorLeaving(&vn.Vnode, old)
+		vn.ring.invokeDelegate(func(d Delegate) {
+			d.SuccessorLeaving(&vn.Vnode, old)
 		})
+		vn.ring.cache.invalidateVnode(old)
 
 		known := vn.knownSuccessors()
 		copy(vn.successors[0:], vn.successors[1:])
 		vn.successors[known-1] = nil
+
+		// Hand its fingers over to the next successor, rather than
+		// waiting for each to be fixed
+		vn.replaceFinger(old, vn.successors[0])
+	}
+	return nil
+}
+
+// Replaces every finger pointing at a leaving vnode, which is then
+// succeeded by the replacement. The lock must be held.
+func (vn *localVnode) replaceFinger(old, replacement *Vnode) {
+	for i, f := range vn.finger {
+		if f.Equal(old) {
+			vn.finger[i] = replacement
+		}
+	}
+}
+
+// Drops every successor, finger and predecessor on a host, as if each
+// had been confirmed dead. If no successors are left, the local vnodes
+// take their place until stabilization finds the rest. Without any other
+// local vnodes, the last successor on the host is kept, as when every
+// known successor is dead, so the list is never empty. Returns if any
+// references were dropped.
+func (vn *localVnode) evict(host string, local []*localVnode) (found bool) {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	failed := func(dead *Vnode) {
+		found = true
+		vn.ring.cache.invalidateVnode(dead)
+		vn.peerFailed(dead)
+	}
+
+	if p := vn.predecessor; p != nil && p.Host == host {
+		failed(p)
+		vn.predecessor = nil
+		vn.predFails = 0
+	}
+
+	var kept, evicted []*Vnode
+	for _, s := range vn.successors {
+		if s == nil {
+			continue
+		}
+		if s.Host == host {
+			evicted = append(evicted, s)
+			continue
+		}
+		kept = append(kept, s)
+	}
+	if len(kept) == 0 {
+		kept = mergeSuccessors(vn, nil, local, len(vn.successors))
+	}
+	if len(kept) == 0 && len(evicted) > 0 {
+		kept = evicted[len(evicted)-1:]
+		evicted = evicted[:len(evicted)-1]
+	}
+	for _, s := range evicted {
+		failed(s)
+	}
+	for i := range vn.successors {
+		vn.successors[i] = nil
+	}
+	copy(vn.successors, kept)
+
+	for i, f := range vn.finger {
+		if f != nil && f.Host == host {
+			vn.finger[i] = nil
+			found = true
+		}
+	}
+	return found
+}
+
+// RPC: Returns the health of the vnode
+func (vn *localVnode) Health() (*VnodeHealth, error) {
+	vn.lock.Lock()
+	defer vn.lock.Unlock()
+	health := &VnodeHealth{
+		Vnode:      &vn.Vnode,
+		Stabilized: vn.stabilized,
+		Successors: vn.knownSuccessors(),
+		Draining:   vn.ring.draining.Load(),
+
+		FingerFixed:    vn.fingerFixed,
+		FingerFailures: vn.fingerFails,
+
+		StabilizeCount:     vn.stabilizes.Load(),
+		SuccessorChanges:   vn.succChanges.Load(),
+		PredecessorChanges: vn.predChanges.Load(),
+	}
+	var total time.Duration
+	for i, d := range vn.durations {
+		if i == 0 || d < health.StabilizeMin {
+			health.StabilizeMin = d
+		}
+		if d > health.StabilizeMax {
+			health.StabilizeMax = d
+		}
+		total += d
+	}
+	if len(vn.durations) > 0 {
+		health.StabilizeAvg = total / time.Duration(len(vn.durations))
+	}
+	return health, nil
+}
+
+// Checks that the state of the vnode is internally consistent. The
+// caller must hold the vnode lock.
+func (vn *localVnode) validate() error {
+	hb := vn.ring.config.hashBits
+	known := vn.knownSuccessors()
+	for i := 0; i < known; i++ {
+		s := vn.successors[i]
+		if s == nil {
+			return fmt.Errorf("Successor %d is missing!", i)
+		}
+		if s.Equal(&vn.Vnode) {
+			return fmt.Errorf("Successor %d is ourself!", i)
+		}
+		for j := 0; j < i; j++ {
+			if s.Equal(vn.successors[j]) {
+				return fmt.Errorf("Successor %d is a duplicate of %d!", i, j)
+			}
+		}
+
+		// Ensure the successors are in ring order
+		if i > 0 {
+			prev := RingDistance(vn.Id, vn.successors[i-1].Id, hb)
+			if RingDistance(vn.Id, s.Id, hb).Cmp(prev) <= 0 {
+				return fmt.Errorf("Successor %d is out of order!", i)
+			}
+		}
+	}
+	if vn.predecessor != nil && vn.predecessor.Equal(&vn.Vnode) {
+		return fmt.Errorf("Predecessor is ourself!")
 	}
 	return nil
 }
 
-// Determine how many successors we know of
+// Determine how many successors we know of. The caller must hold the
+// vnode lock.
 func (vn *localVnode) knownSuccessors() (successors int) {
 	for i := 0; i < len(vn.successors); i++ {
 		if vn.successors[i] != nil {
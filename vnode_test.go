@@ -3,6 +3,7 @@ package chord
 import (
 	"bytes"
 	"crypto/sha1"
+	"errors"
 	"sort"
 	"testing"
 	"time"
@@ -21,6 +22,39 @@ func makeVnode() *localVnode {
 	return &localVnode{ring: ring}
 }
 
+func TestVnodeEqual(t *testing.T) {
+	a := &Vnode{Id: []byte{1}, Host: "a"}
+	b := &Vnode{Id: []byte{1}, Host: "a"}
+	c := &Vnode{Id: []byte{1}, Host: "b"}
+	d := &Vnode{Id: []byte{2}, Host: "a"}
+	if !a.Equal(b) {
+		t.Fatalf("expected equal")
+	}
+	if a.Equal(c) {
+		t.Fatalf("different host should not be equal")
+	}
+	if a.Equal(d) {
+		t.Fatalf("different id should not be equal")
+	}
+	if a.Equal(nil) {
+		t.Fatalf("nil should not be equal")
+	}
+}
+
+func TestVnodeCompare(t *testing.T) {
+	a := &Vnode{Id: []byte{1}, Host: "b"}
+	b := &Vnode{Id: []byte{2}, Host: "a"}
+	if a.Compare(b) != -1 {
+		t.Fatalf("expected less")
+	}
+	if b.Compare(a) != 1 {
+		t.Fatalf("expected greater")
+	}
+	if a.Compare(a) != 0 {
+		t.Fatalf("expected same")
+	}
+}
+
 func TestVnodeInit(t *testing.T) {
 	vn := makeVnode()
 	vn.init(0)
@@ -63,6 +97,30 @@ func TestGenId(t *testing.T) {
 	}
 }
 
+func TestGenIdSpread(t *testing.T) {
+	vn := makeVnode()
+	vn.ring.config.SpreadVnodes = true
+	vn.ring.config.NumVnodes = 4
+	vn.ring.config.hashBits = 160
+
+	var ids [][]byte
+	for i := 0; i < 4; i++ {
+		vn.genId(uint16(i))
+		ids = append(ids, vn.Id)
+	}
+
+	// Each vnode is a quarter of the ring after the previous one
+	for i := 1; i < len(ids); i++ {
+		if len(ids[i]) != 20 {
+			t.Fatalf("bad id length! %d", len(ids[i]))
+		}
+		expect := spreadOffset(ids[i-1], 1, 4, 160)
+		if !bytes.Equal(ids[i], expect) {
+			t.Fatalf("unexpected id! %x %x", ids[i], expect)
+		}
+	}
+}
+
 func TestVnodeStabilizeShutdown(t *testing.T) {
 	vn := makeVnode()
 	vn.schedule()
@@ -154,7 +212,7 @@ func TestVnodeCheckNewSuccDead(t *testing.T) {
 	vn1.successors[0] = &Vnode{Id: []byte{0}}
 
 	if err := vn1.checkNewSuccessor(); err == nil {
-		t.Fatalf("err!", err)
+		t.Fatalf("expected err!")
 	}
 
 	if vn1.successors[0].String() != "00" {
@@ -190,6 +248,43 @@ func TestVnodeCheckNewSuccDeadAlternate(t *testing.T) {
 	}
 }
 
+// Checks a dead successor is only evicted after the threshold
+func TestVnodeCheckNewSuccThreshold(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	r.config.SuccessorFailThreshold = 2
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn3 := r.vnodes[2]
+
+	vn1.successors[0] = &vn2.Vnode
+	vn1.successors[1] = &vn3.Vnode
+	vn3.predecessor = &vn1.Vnode
+
+	// Remove vn2
+	(r.transport.(*LocalTransport)).Deregister(&vn2.Vnode)
+
+	// First failure keeps the successor
+	if err := vn1.checkNewSuccessor(); err == nil {
+		t.Fatalf("expected err!")
+	}
+	if vn1.successors[0] != &vn2.Vnode || vn1.succFails[vn2.String()] != 1 {
+		t.Fatalf("unexpected eviction! %v", vn1.succFails)
+	}
+
+	// Second failure evicts it
+	if err := vn1.checkNewSuccessor(); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if vn1.successors[0] != &vn3.Vnode {
+		t.Fatalf("unexpected successor!")
+	}
+	if len(vn1.succFails) != 0 {
+		t.Fatalf("expected counts to reset! %v", vn1.succFails)
+	}
+}
+
 // Checks pinging a dead successor with all dead alternates
 func TestVnodeCheckNewSuccAllDeadAlternates(t *testing.T) {
 	r := makeRing()
@@ -320,6 +415,40 @@ func TestVnodeNotifySucc(t *testing.T) {
 	}
 }
 
+// Test notifying a successor in a 2 node ring, where we are
+// in the successor list that is returned
+func TestVnodeNotifySuccSmallRing(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn1.successors[0] = &vn2.Vnode
+	vn1.successors[1] = &vn2.Vnode
+	vn2.successors[0] = &vn1.Vnode
+	vn2.predecessor = &vn1.Vnode
+
+	if err := vn1.notifySuccessor(); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if vn1.successors[0] != &vn2.Vnode {
+		t.Fatalf("bad succ 0")
+	}
+	if vn1.knownSuccessors() != 1 {
+		t.Fatalf("should only know 1 successor! %v", vn1.successors)
+	}
+
+	// Entries after ourselves should still be used
+	s1 := &Vnode{Id: []byte{1}}
+	vn2.successors[1] = s1
+	if err := vn1.notifySuccessor(); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if vn1.successors[1] != s1 {
+		t.Fatalf("bad succ 1")
+	}
+}
+
 // Test notifying a dead successor
 func TestVnodeNotifySuccDead(t *testing.T) {
 	r := makeRing()
@@ -355,7 +484,7 @@ func TestVnodeNotifySamePred(t *testing.T) {
 	vn2.successors[1] = s2
 	vn2.successors[2] = s3
 
-	succs, err := vn2.Notify(&vn1.Vnode)
+	succs, _, err := vn2.Notify(&vn1.Vnode, nil)
 	if err != nil {
 		t.Fatalf("unexpected error! %s", err)
 	}
@@ -387,7 +516,7 @@ func TestVnodeNotifyNoPred(t *testing.T) {
 	vn2.successors[1] = s2
 	vn2.successors[2] = s3
 
-	succs, err := vn2.Notify(&vn1.Vnode)
+	succs, _, err := vn2.Notify(&vn1.Vnode, nil)
 	if err != nil {
 		t.Fatalf("unexpected error! %s", err)
 	}
@@ -414,7 +543,7 @@ func TestVnodeNotifyNewPred(t *testing.T) {
 	vn3 := r.vnodes[2]
 	vn3.predecessor = &vn1.Vnode
 
-	_, err := vn3.Notify(&vn2.Vnode)
+	_, _, err := vn3.Notify(&vn2.Vnode, nil)
 	if err != nil {
 		t.Fatalf("unexpected error! %s", err)
 	}
@@ -423,6 +552,73 @@ func TestVnodeNotifyNewPred(t *testing.T) {
 	}
 }
 
+func TestVnodeNotifyAcceptPredecessor(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	var asked []*Vnode
+	r.config.AcceptPredecessor = func(local, candidate *Vnode) bool {
+		asked = append(asked, candidate)
+		return candidate.Host != "evil"
+	}
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn3 := r.vnodes[2]
+	vn3.predecessor = &vn1.Vnode
+
+	// A vetoed vnode is refused
+	evil := &Vnode{Id: vn2.Id, Host: "evil"}
+	if _, _, err := vn3.Notify(evil, nil); !errors.Is(err, ErrPredecessorRejected) {
+		t.Fatalf("expected rejection. %v", err)
+	}
+	if vn3.predecessor != &vn1.Vnode {
+		t.Fatalf("unexpected pred")
+	}
+
+	// Only vnodes that would become our predecessor are checked
+	if _, _, err := vn3.Notify(&vn1.Vnode, nil); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if _, _, err := vn3.Notify(&vn2.Vnode, nil); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn3.predecessor != &vn2.Vnode {
+		t.Fatalf("unexpected pred")
+	}
+	if len(asked) != 2 || asked[0] != evil || asked[1] != &vn2.Vnode {
+		t.Fatalf("unexpected checks. %v", asked)
+	}
+}
+
+func TestVnodeAcceptPredecessorUnlocked(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn3 := r.vnodes[2]
+
+	// A closer vnode notifies while the first one is being checked
+	r.config.AcceptPredecessor = func(local, candidate *Vnode) bool {
+		if candidate == &vn1.Vnode {
+			if _, err := vn3.GetPredecessor(); err != nil {
+				t.Fatalf("unexpected err. %s", err)
+			}
+			if _, _, err := vn3.Notify(&vn2.Vnode, nil); err != nil {
+				t.Fatalf("unexpected err. %s", err)
+			}
+		}
+		return true
+	}
+	if _, _, err := vn3.Notify(&vn1.Vnode, nil); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+
+	// The closer vnode is kept
+	if vn3.predecessor != &vn2.Vnode {
+		t.Fatalf("unexpected pred")
+	}
+}
+
 func TestVnodeFixFinger(t *testing.T) {
 	r := makeRing()
 	sort.Sort(r)
@@ -459,6 +655,290 @@ func TestVnodeFixFinger(t *testing.T) {
 	}
 }
 
+func TestVnodeFixFingerFailures(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	vn := r.vnodes[0]
+
+	// Only know of an unreachable successor, just past us
+	vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "dead"}
+	vn.last_finger = 159
+
+	for i := 0; i < 3; i++ {
+		if err := vn.fixFingerTable(); err == nil {
+			t.Fatalf("expected err")
+		}
+	}
+	health, _ := vn.Health()
+	if health.FingerFailures != 3 || vn.last_finger != 159 {
+		t.Fatalf("bad failures! %d %d", health.FingerFailures, vn.last_finger)
+	}
+
+	// Repairing a finger resets the failures
+	vn.last_finger = 0
+	if err := vn.fixFingerTable(); err != nil {
+		t.Fatalf("unexpected err, %s", err)
+	}
+	health, _ = vn.Health()
+	if health.FingerFailures != 0 || health.FingerFixed != vn.last_finger-1 {
+		t.Fatalf("bad progress! %d %d", health.FingerFailures, health.FingerFixed)
+	}
+}
+
+func TestVnodeStabilizeDurations(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	vn := r.vnodes[0]
+	var timed int
+	r.config.StabilizeTimer = func(v *Vnode, d time.Duration) {
+		if v != &vn.Vnode || d <= 0 {
+			t.Fatalf("bad timer args! %v %v", v, d)
+		}
+		timed++
+	}
+	if health, _ := vn.Health(); health.StabilizeMax != 0 {
+		t.Fatalf("expected no durations! %v", health.StabilizeMax)
+	}
+
+	// Only the recent runs are kept
+	r.setLocalSuccessors()
+	for i := 0; i < stabilizeWindow+4; i++ {
+		vn.stabilizeOnce()
+	}
+	if timed != stabilizeWindow+4 || len(vn.durations) != stabilizeWindow {
+		t.Fatalf("bad durations! %d %d", timed, len(vn.durations))
+	}
+	health, _ := vn.Health()
+	if health.StabilizeMin <= 0 || health.StabilizeMin > health.StabilizeAvg ||
+		health.StabilizeAvg > health.StabilizeMax {
+		t.Fatalf("bad durations! %v %v %v", health.StabilizeMin, health.StabilizeAvg, health.StabilizeMax)
+	}
+}
+
+// Counts the FindSuccessors calls to unreachable hosts
+type countingTransport struct {
+	BlackholeTransport
+	calls int
+}
+
+func (ct *countingTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	ct.calls++
+	return ct.BlackholeTransport.FindSuccessors(vn, n, key, visited)
+}
+
+func TestVnodeFindSuccessorsFailedHost(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	ct := &countingTransport{}
+	r.WrapTransport(func(Transport) Transport { return ct })
+	vn := r.vnodes[0]
+
+	// Know of several vnodes on the same dead host
+	vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "dead"}
+	vn.successors[1] = &Vnode{Id: powerOffset(vn.Id, 1, 160), Host: "dead"}
+	vn.finger[100] = &Vnode{Id: powerOffset(vn.Id, 100, 160), Host: "dead"}
+
+	_, _, err := vn.FindSuccessors(1, powerOffset(vn.Id, 159, 160), nil)
+	if err != errExhaustedPreceeding {
+		t.Fatalf("expected exhausted err. %v", err)
+	}
+	if ct.calls != 1 {
+		t.Fatalf("expected 1 call to the dead host, got %d", ct.calls)
+	}
+}
+
+// Refuses FindSuccessors with ErrVnodeDraining, counting the calls
+type drainingTransport struct {
+	BlackholeTransport
+	calls int
+}
+
+func (dt *drainingTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	dt.calls++
+	return nil, nil, ErrVnodeDraining
+}
+
+func TestVnodeFindSuccessorsDraining(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	dt := &drainingTransport{}
+	r.WrapTransport(func(Transport) Transport { return dt })
+	vn := r.vnodes[0]
+
+	// Know of several vnodes on the same live host
+	vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "remote"}
+	vn.successors[1] = &Vnode{Id: powerOffset(vn.Id, 1, 160), Host: "remote"}
+	vn.finger[100] = &Vnode{Id: powerOffset(vn.Id, 100, 160), Host: "remote"}
+
+	// A draining vnode does not fail its host, so each is tried
+	_, _, err := vn.FindSuccessors(1, powerOffset(vn.Id, 159, 160), nil)
+	if err != errExhaustedPreceeding {
+		t.Fatalf("expected exhausted err. %v", err)
+	}
+	if dt.calls != 3 {
+		t.Fatalf("expected 3 calls to the host, got %d", dt.calls)
+	}
+}
+
+// Returns more successors than requested, recording the requested n
+// and the visited vnodes
+type oversizedTransport struct {
+	BlackholeTransport
+	requested []int
+	visited   [][]*Vnode
+}
+
+func (ot *oversizedTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	ot.requested = append(ot.requested, n)
+	ot.visited = append(ot.visited, visited)
+	return []*Vnode{vn, vn, vn}, append(visited, vn), nil
+}
+
+func TestVnodeFindSuccessorsLimit(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	ot := &oversizedTransport{}
+	r.WrapTransport(func(Transport) Transport { return ot })
+	vn := r.vnodes[0]
+	vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "remote"}
+	vn.finger[100] = &Vnode{Id: powerOffset(vn.Id, 100, 160), Host: "remote"}
+
+	res, _, err := vn.FindSuccessors(1, powerOffset(vn.Id, 159, 160), nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(res) != 1 {
+		t.Fatalf("expected 1 successor, got %d", len(res))
+	}
+	for _, n := range ot.requested {
+		if n != 1 {
+			t.Fatalf("expected n of 1 on every hop, got %d", n)
+		}
+	}
+	if len(ot.requested) == 0 {
+		t.Fatalf("expected a remote hop")
+	}
+}
+
+// Answers FindSuccessors with fixed successors, appending the vnode
+// asked to the path
+type answeringTransport struct {
+	BlackholeTransport
+	res []*Vnode
+}
+
+func (at *answeringTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	return at.res, append(visited, vn), nil
+}
+
+func TestVnodeFindPredecessorAnswer(t *testing.T) {
+	r := makeRing()
+	r.config.PredecessorTimeout = time.Millisecond
+	sort.Sort(r)
+	at := &answeringTransport{}
+	r.WrapTransport(func(Transport) Transport { return at })
+	vn := r.vnodes[0]
+	remote := &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "remote"}
+	vn.successors[0] = remote
+
+	// A vnode that does not name us as its successor is not adopted
+	at.res = []*Vnode{remote}
+	if err := vn.findPredecessor(time.Time{}); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn.predecessor != nil {
+		t.Fatalf("expected no predecessor. %v", vn.predecessor)
+	}
+
+	// The vnode answering with us is adopted
+	at.res = []*Vnode{&vn.Vnode}
+	if err := vn.findPredecessor(time.Time{}); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if !vn.predecessor.Equal(remote) {
+		t.Fatalf("expected predecessor %s. %v", remote.String(), vn.predecessor)
+	}
+}
+
+func TestVnodeFindSuccessorsBadN(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+		r.vnodes[i].successors[1] = &r.vnodes[(i+2)%num].Vnode
+	}
+	vn := r.vnodes[0]
+	key := vn.successors[0].Id
+
+	for _, n := range []int{0, -1} {
+		if _, _, err := vn.FindSuccessors(n, key, nil); err == nil {
+			t.Fatalf("expected err for n of %d", n)
+		}
+	}
+
+	// Limited to the known successors, rather than panicking
+	res, _, err := vn.FindSuccessors(1<<30, key, nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 successors, got %d", len(res))
+	}
+}
+
+func TestVnodeFindSuccessorsLoop(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	ot := &oversizedTransport{}
+	r.WrapTransport(func(Transport) Transport { return ot })
+	vn := r.vnodes[0]
+	vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "remote"}
+	vn.finger[100] = &Vnode{Id: powerOffset(vn.Id, 100, 160), Host: "remote"}
+	key := powerOffset(vn.Id, 159, 160)
+
+	// We are added to the visited vnodes when forwarding
+	prev := &Vnode{Id: []byte{1}, Host: "remote"}
+	if _, _, err := vn.FindSuccessors(1, key, []*Vnode{prev}); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	path := ot.visited[0]
+	if len(path) != 2 || path[0] != prev || path[1] != &vn.Vnode {
+		t.Fatalf("bad visited. %v", path)
+	}
+
+	// A request that has looped back is not forwarded again
+	if _, _, err := vn.FindSuccessors(1, key, []*Vnode{prev, &vn.Vnode}); err == nil {
+		t.Fatalf("expected loop err")
+	}
+	if len(ot.visited) != 1 {
+		t.Fatalf("unexpected forward")
+	}
+}
+
+func TestVnodeFixFingerMultiple(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	r.config.FingersPerStabilize = 2
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].init(i)
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+	}
+
+	// Should repair both entries in a single round
+	vn := r.vnodes[0]
+	if err := vn.fixFingerTable(); err != nil {
+		t.Fatalf("unexpected err, %s", err)
+	}
+	if vn.last_finger != 0 {
+		t.Fatalf("unexpected last finger! %d", vn.last_finger)
+	}
+	if vn.finger[159] == nil {
+		t.Fatalf("expected last finger entry!")
+	}
+}
+
 func TestVnodeCheckPredNoPred(t *testing.T) {
 	v := makeVnode()
 	v.init(0)
@@ -502,6 +982,258 @@ func TestVnodeCheckDeadPred(t *testing.T) {
 	}
 }
 
+func TestVnodeNotifyRangeDelegate(t *testing.T) {
+	d := &MockDelegate{}
+	r := makeRing()
+	sort.Sort(r)
+	r.config.Delegate = d
+	go r.delegateHandler()
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn3 := r.vnodes[2]
+
+	// No predecessor, the range starts at our own ID
+	if _, _, err := vn3.Notify(&vn1.Vnode, nil); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Closer predecessor takes the range from the old one
+	if _, _, err := vn3.Notify(&vn2.Vnode, nil); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	r.stopDelegate()
+
+	if len(d.ranges) != 2 {
+		t.Fatalf("expected 2 ranges! %v", d.ranges)
+	}
+	if !bytes.Equal(d.ranges[0][0], vn3.Id) || !bytes.Equal(d.ranges[0][1], vn1.Id) {
+		t.Fatalf("bad first range! %v", d.ranges[0])
+	}
+	if !bytes.Equal(d.ranges[1][0], vn1.Id) || !bytes.Equal(d.ranges[1][1], vn2.Id) {
+		t.Fatalf("bad second range! %v", d.ranges[1])
+	}
+}
+
+func TestVnodeStabilizeErrorHandler(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	var phases []string
+	r.config.StabilizeErrorHandler = func(vn *Vnode, phase string, err error) {
+		if vn != &r.vnodes[0].Vnode || err == nil {
+			t.Fatalf("bad handler args! %v %v", vn, err)
+		}
+		phases = append(phases, phase)
+	}
+
+	// Only know of an unreachable successor and predecessor. The
+	// threshold keeps the successor from being replaced this round.
+	r.config.SuccessorFailThreshold = 2
+	vn := r.vnodes[0]
+	vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "dead"}
+	vn.predecessor = &Vnode{Id: []byte{0}, Host: "dead"}
+	vn.stabilizeOnce()
+
+	expect := []string{PhaseCheckNewSuccessor, PhaseNotifySuccessor, PhaseCheckPredecessor}
+	if len(phases) != len(expect) {
+		t.Fatalf("bad phases! %v", phases)
+	}
+	for i := range expect {
+		if phases[i] != expect[i] {
+			t.Fatalf("bad phases! %v", phases)
+		}
+	}
+}
+
+func TestVnodeNotifyRingID(t *testing.T) {
+	vn := makeVnode()
+	vn.init(0)
+	vn.Ring = "prod"
+
+	other := &Vnode{Id: []byte{1}, Host: "other", Ring: "staging"}
+	if _, _, err := vn.Notify(other, nil); err == nil {
+		t.Fatalf("expected ring ID err")
+	}
+	if vn.predecessor != nil {
+		t.Fatalf("unexpected pred")
+	}
+	if err := vn.ClearPredecessor(other); err == nil {
+		t.Fatalf("expected ring ID err")
+	}
+	if err := vn.SkipSuccessor(other); err == nil {
+		t.Fatalf("expected ring ID err")
+	}
+}
+
+func TestVnodeNotifySelf(t *testing.T) {
+	vn := makeVnode()
+	vn.init(0)
+
+	// A vnode claiming our ID is never our predecessor
+	self := &Vnode{Id: vn.Id, Host: "evil"}
+	if _, _, err := vn.Notify(self, nil); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn.predecessor != nil {
+		t.Fatalf("unexpected pred")
+	}
+
+	// An existing predecessor is kept
+	pred := &Vnode{Id: []byte{1}, Host: "test"}
+	vn.predecessor = pred
+	if _, _, err := vn.Notify(self, nil); err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if vn.predecessor != pred {
+		t.Fatalf("unexpected pred")
+	}
+}
+
+func TestVnodeNotifyPayload(t *testing.T) {
+	d := &MockDelegate{}
+	r := makeRing()
+	sort.Sort(r)
+	r.config.Delegate = d
+	go r.delegateHandler()
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+
+	// No payload by default
+	if _, payload, err := vn2.Notify(&vn1.Vnode, nil); err != nil || payload != nil {
+		t.Fatalf("unexpected payload %v %v", payload, err)
+	}
+
+	// Our payload is returned, and the remote one is delegated
+	r.SetNotifyPayload([]byte("local"))
+	_, payload, err := vn2.Notify(&vn1.Vnode, []byte("remote"))
+	if err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	if string(payload) != "local" {
+		t.Fatalf("bad payload %q", payload)
+	}
+	r.stopDelegate()
+
+	if len(d.payloads) != 1 || string(d.payloads[0]) != "remote" {
+		t.Fatalf("bad delegated payloads %q", d.payloads)
+	}
+}
+
+func TestVnodeCheckPredThreshold(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	r.config.PredecessorFailThreshold = 3
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn2.predecessor = &vn1.Vnode
+
+	// Deregister vn1
+	(r.transport.(*LocalTransport)).Deregister(&vn1.Vnode)
+
+	// Tolerate failures below the threshold
+	for i := 0; i < 2; i++ {
+		if err := vn2.checkPredecessor(); err != nil {
+			t.Fatalf("unexpected error! %s", err)
+		}
+		if vn2.predecessor == nil {
+			t.Fatalf("cleared pred early at %d", i)
+		}
+	}
+
+	// A live ping resets the count
+	r.transport.Register(&vn1.Vnode, vn1)
+	if err := vn2.checkPredecessor(); err != nil || vn2.predFails != 0 {
+		t.Fatalf("expected reset! %d %v", vn2.predFails, err)
+	}
+	(r.transport.(*LocalTransport)).Deregister(&vn1.Vnode)
+
+	for i := 0; i < 3; i++ {
+		if err := vn2.checkPredecessor(); err != nil {
+			t.Fatalf("unexpected error! %s", err)
+		}
+	}
+	if vn2.predecessor != nil {
+		t.Fatalf("expected pred to be cleared")
+	}
+}
+
+func TestVnodeCheckPredPingError(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	r.config.PredecessorFailThreshold = 3
+	r.WrapTransport(func(Transport) Transport { return &BlackholeTransport{} })
+
+	vn := r.vnodes[0]
+	vn.predecessor = &Vnode{Id: []byte{1}, Host: "remote"}
+
+	// Ping errors count toward the threshold, and are still returned
+	for i := 0; i < 3; i++ {
+		if vn.predecessor == nil {
+			t.Fatalf("cleared pred early at %d", i)
+		}
+		if err := vn.checkPredecessor(); err == nil {
+			t.Fatalf("expected ping error")
+		}
+	}
+	if vn.predecessor != nil {
+		t.Fatalf("expected pred to be cleared")
+	}
+}
+
+func TestVnodeCheckDeadPredDelegate(t *testing.T) {
+	d := &MockDelegate{}
+	r := makeRing()
+	sort.Sort(r)
+	r.config.Delegate = d
+	go r.delegateHandler()
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn2.predecessor = &vn1.Vnode
+
+	// Deregister vn1
+	(r.transport.(*LocalTransport)).Deregister(&vn1.Vnode)
+
+	if err := vn2.checkPredecessor(); err != nil {
+		t.Fatalf("unexpected error! %s", err)
+	}
+	r.stopDelegate()
+
+	if len(d.failed) != 1 || d.failed[0] != &vn1.Vnode {
+		t.Fatalf("expected failed peer! %v", d.failed)
+	}
+}
+
+func TestVnodeCheckNewSuccDeadDelegate(t *testing.T) {
+	d := &MockDelegate{}
+	r := makeRing()
+	sort.Sort(r)
+	r.config.Delegate = d
+	go r.delegateHandler()
+
+	vn1 := r.vnodes[0]
+	vn2 := r.vnodes[1]
+	vn3 := r.vnodes[2]
+
+	vn1.successors[0] = &vn2.Vnode
+	vn1.successors[1] = &vn3.Vnode
+	vn3.predecessor = &vn1.Vnode
+
+	// Remove vn2
+	(r.transport.(*LocalTransport)).Deregister(&vn2.Vnode)
+
+	if err := vn1.checkNewSuccessor(); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+	r.stopDelegate()
+
+	if len(d.failed) != 1 || d.failed[0] != &vn2.Vnode {
+		t.Fatalf("expected failed peer! %v", d.failed)
+	}
+}
+
 func TestVnodeFindSuccessors(t *testing.T) {
 	r := makeRing()
 	sort.Sort(r)
@@ -522,7 +1254,7 @@ func TestVnodeFindSuccessors(t *testing.T) {
 	// Do a lookup on the key
 	for i := 0; i < len(r.vnodes); i++ {
 		vn := r.vnodes[i]
-		succ, err := vn.FindSuccessors(1, key)
+		succ, _, err := vn.FindSuccessors(1, key, nil)
 		if err != nil {
 			t.Fatalf("unexpected err! %s", err)
 		}
@@ -558,7 +1290,7 @@ func TestVnodeFindSuccessorsMultSucc(t *testing.T) {
 	// Do a lookup on the key
 	for i := 0; i < len(r.vnodes); i++ {
 		vn := r.vnodes[i]
-		succ, err := vn.FindSuccessors(1, key)
+		succ, _, err := vn.FindSuccessors(1, key, nil)
 		if err != nil {
 			t.Fatalf("unexpected err! %s", err)
 		}
@@ -597,7 +1329,7 @@ func TestVnodeFindSuccessorsSomeDead(t *testing.T) {
 	// Do a lookup on the key
 	for i := 0; i < len(r.vnodes); i++ {
 		vn := r.vnodes[i]
-		succ, err := vn.FindSuccessors(1, key)
+		succ, _, err := vn.FindSuccessors(1, key, nil)
 		if err != nil {
 			t.Fatalf("(%d) unexpected err! %s", i, err)
 		}
@@ -626,6 +1358,21 @@ func TestVnodeClearPred(t *testing.T) {
 	if v.predecessor != p {
 		t.Fatalf("expect p predecessor!")
 	}
+
+	// Same ID on another host should not match
+	other := &Vnode{Id: []byte{12}, Host: "other"}
+	v.ClearPredecessor(other)
+	if v.predecessor != p {
+		t.Fatalf("expect p predecessor!")
+	}
+
+	// Fingers pointing at a leaving predecessor now point at us
+	v.finger = make([]*Vnode, 4)
+	v.finger[3] = p
+	v.ClearPredecessor(p)
+	if !v.finger[3].Equal(&v.Vnode) {
+		t.Fatalf("expected finger handed over. %v", v.finger[3])
+	}
 }
 
 func TestVnodeSkipSucc(t *testing.T) {
@@ -658,6 +1405,18 @@ func TestVnodeSkipSucc(t *testing.T) {
 	if v.knownSuccessors() != 2 {
 		t.Fatalf("bad num of suc")
 	}
+
+	// Fingers pointing at a leaving successor are handed over
+	v.finger = make([]*Vnode, 3)
+	v.finger[0] = s2
+	v.finger[1] = s2
+	v.finger[2] = s3
+	if err := v.SkipSuccessor(s2); err != nil {
+		t.Fatalf("unexpected err")
+	}
+	if v.finger[0] != s3 || v.finger[1] != s3 || v.finger[2] != s3 {
+		t.Fatalf("expected fingers handed over. %v", v.finger[:3])
+	}
 }
 
 func TestVnodeLeave(t *testing.T) {
@@ -682,3 +1441,135 @@ func TestVnodeLeave(t *testing.T) {
 		t.Fatalf("unexpected pred!")
 	}
 }
+
+func TestVnodeLeaveErrors(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	vn := r.vnodes[0]
+	vn.predecessor = &Vnode{Id: []byte{0}, Host: "dead"}
+	vn.successors[0] = &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "dead"}
+
+	// Both failures are reported
+	err := vn.leave()
+	if !errors.Is(err, ErrSkipSuccessor) || !errors.Is(err, ErrClearPredecessor) {
+		t.Fatalf("expected both errors! %v", err)
+	}
+
+	// Only the successor is unreachable
+	vn.predecessor = &r.vnodes[len(r.vnodes)-1].Vnode
+	err = vn.leave()
+	if errors.Is(err, ErrSkipSuccessor) || !errors.Is(err, ErrClearPredecessor) {
+		t.Fatalf("expected clear error only! %v", err)
+	}
+}
+
+func TestVnodeNormalizeSuccessors(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	vn := r.vnodes[0]
+	vn.successors[0] = &r.vnodes[1].Vnode
+	vn.successors[1] = &r.vnodes[3].Vnode
+	vn.successors[2] = &r.vnodes[2].Vnode
+	vn.successors[3] = &vn.Vnode
+	vn.successors[4] = &r.vnodes[3].Vnode
+	vn.successors[6] = &r.vnodes[4].Vnode
+	vn.normalizeSuccessors()
+
+	expect := []*Vnode{&r.vnodes[1].Vnode, &r.vnodes[3].Vnode, &r.vnodes[4].Vnode}
+	if vn.knownSuccessors() != len(expect) {
+		t.Fatalf("bad successors! %v", vn.successors)
+	}
+	for i, s := range expect {
+		if vn.successors[i] != s {
+			t.Fatalf("bad successor %d! %v", i, vn.successors[i])
+		}
+	}
+	if err := vn.validate(); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+}
+
+func TestVnodeValidate(t *testing.T) {
+	r := makeRing()
+	sort.Sort(r)
+	num := len(r.vnodes)
+	for i := 0; i < num; i++ {
+		r.vnodes[i].predecessor = &r.vnodes[(i+num-1)%num].Vnode
+		r.vnodes[i].successors[0] = &r.vnodes[(i+1)%num].Vnode
+		r.vnodes[i].successors[1] = &r.vnodes[(i+2)%num].Vnode
+	}
+	vn := r.vnodes[0]
+	if err := vn.validate(); err != nil {
+		t.Fatalf("unexpected err %s", err)
+	}
+
+	// Gap in the successors
+	vn.successors[1] = nil
+	vn.successors[2] = &r.vnodes[3].Vnode
+	if err := vn.validate(); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Out of order
+	vn.successors[1] = &r.vnodes[4].Vnode
+	if err := vn.validate(); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Duplicate
+	vn.successors[1] = &r.vnodes[1].Vnode
+	vn.successors[2] = nil
+	if err := vn.validate(); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Self as successor
+	vn.successors[1] = &vn.Vnode
+	if err := vn.validate(); err == nil {
+		t.Fatalf("expected err!")
+	}
+
+	// Self as predecessor
+	vn.successors[1] = &r.vnodes[2].Vnode
+	vn.predecessor = &vn.Vnode
+	if err := vn.validate(); err == nil {
+		t.Fatalf("expected err!")
+	}
+}
+
+// Blocks lookups to the "slow" host until released
+type slowTransport struct {
+	BlackholeTransport
+	release chan struct{}
+}
+
+func (st *slowTransport) FindSuccessors(vn *Vnode, n int, key []byte, visited []*Vnode) ([]*Vnode, []*Vnode, error) {
+	if vn.Host == "slow" {
+		<-st.release
+		return nil, nil, errors.New("slow host")
+	}
+	return []*Vnode{vn}, append(visited, vn), nil
+}
+
+func TestVnodeFindSuccessorsFanout(t *testing.T) {
+	r := makeRing()
+	r.config.LookupFanout = 2
+	sort.Sort(r)
+	st := &slowTransport{release: make(chan struct{})}
+	defer close(st.release)
+	r.WrapTransport(func(Transport) Transport { return st })
+	vn := r.vnodes[0]
+
+	// The closest vnode is slow, and the next is queried at once
+	fast := &Vnode{Id: powerOffset(vn.Id, 0, 160), Host: "fast"}
+	vn.successors[0] = fast
+	vn.finger[100] = &Vnode{Id: powerOffset(vn.Id, 100, 160), Host: "slow"}
+
+	res, _, err := vn.FindSuccessors(1, powerOffset(vn.Id, 159, 160), nil)
+	if err != nil {
+		t.Fatalf("unexpected err. %s", err)
+	}
+	if len(res) != 1 || res[0] != fast {
+		t.Fatalf("expected the fast vnode. %v", res)
+	}
+}